@@ -0,0 +1,352 @@
+// Package analyze summarizes what's in an oplog dump in a single streaming pass.
+package analyze
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	bsonScanner "github.com/Clever/oplog-replay/bson"
+	"github.com/Clever/oplog-replay/histogram"
+	"labix.org/v2/mgo/bson"
+)
+
+// maxCommands is the most command ops listed. The rest are only counted.
+const maxCommands = 100
+
+// maxBuckets is the most buckets in the histogram of ops over time. Past that, buckets are merged
+// into ones twice as wide.
+const maxBuckets = 120
+
+// Summary describes the ops in an oplog.
+type Summary struct {
+	Ops int `json:"ops"`
+	// Namespaces counts the ops by namespace and then op type.
+	Namespaces map[string]map[string]int `json:"namespaces"`
+
+	// The oplog timestamps of the first and last ops, as "seconds:increment"
+	FirstTimestamp string `json:"firstTs,omitempty"`
+	LastTimestamp  string `json:"lastTs,omitempty"`
+	// The same timestamps as RFC3339 times
+	OplogStart string `json:"oplogStart,omitempty"`
+	OplogEnd   string `json:"oplogEnd,omitempty"`
+	// SpanSeconds is how much oplog time the ops cover.
+	SpanSeconds float64 `json:"spanSeconds"`
+
+	// AverageOpsPerSec is the number of ops over the span.
+	AverageOpsPerSec float64 `json:"averageOpsPerSec"`
+	// PeakOpsPerSec is the most ops in any one second of oplog time.
+	PeakOpsPerSec int `json:"peakOpsPerSec"`
+	// OpsOverTime counts the ops in each BucketMinutes of oplog time. Buckets start out a minute
+	// wide, and double in width whenever there would be more than maxBuckets of them.
+	OpsOverTime   []Bucket `json:"opsOverTime"`
+	BucketMinutes int64    `json:"bucketMinutes"`
+	// OutOfOrder counts the ops whose ts is before the previous op's, e.g. in concatenated dumps
+	// or entries missing a ts. Ones before the first op's minute are left out of OpsOverTime.
+	OutOfOrder int `json:"outOfOrder"`
+
+	// DocumentSize is the distribution of op sizes in bytes of BSON.
+	DocumentSize Sizes `json:"documentSizeBytes"`
+
+	// HotKeys are the most frequently updated _ids.
+	HotKeys []HotKey `json:"hotKeys"`
+
+	// Commands are the first command ops, and CommandCount how many there were in total.
+	Commands     []Command `json:"commands"`
+	CommandCount int       `json:"commandCount"`
+}
+
+// Bucket is the number of ops in the BucketMinutes of oplog time from Start.
+type Bucket struct {
+	Start string `json:"start"`
+	Ops   int    `json:"ops"`
+}
+
+// Sizes summarizes a distribution of sizes in bytes.
+type Sizes struct {
+	Min  int64   `json:"min"`
+	P50  int64   `json:"p50"`
+	P90  int64   `json:"p90"`
+	P99  int64   `json:"p99"`
+	Max  int64   `json:"max"`
+	Mean float64 `json:"mean"`
+}
+
+// HotKey is a document that was updated often. Since the keys are tracked in bounded memory,
+// Updates can be overestimated by up to MaxError.
+type HotKey struct {
+	Ns       string `json:"ns"`
+	ID       string `json:"_id"`
+	Updates  int    `json:"updates"`
+	MaxError int    `json:"maxError"`
+}
+
+// Command is a command op, e.g. a "drop" or "createIndexes".
+type Command struct {
+	Ts      string `json:"ts"`
+	Ns      string `json:"ns"`
+	Command string `json:"command"`
+}
+
+// Analyzer builds a Summary one op at a time.
+type Analyzer struct {
+	summary  Summary
+	firstTs  bson.MongoTimestamp
+	lastTs   bson.MongoTimestamp
+	sizes    *histogram.Histogram
+	hotKeys  *topK
+	topKeys  int
+	second   int64
+	inSecond int
+	// buckets count the ops in each width minutes of oplog time from the minute first
+	buckets []int
+	first   int64
+	width   int64
+}
+
+// New returns an Analyzer that reports the topKeys most frequently updated _ids.
+func New(topKeys int) *Analyzer {
+	return &Analyzer{
+		summary: Summary{Namespaces: map[string]map[string]int{}},
+		sizes:   histogram.New(),
+		// Tracking more keys than are reported makes the counts of the reported ones more accurate
+		hotKeys: newTopK(topKeys * 10),
+		topKeys: topKeys,
+		second:  -1,
+		width:   1,
+	}
+}
+
+// op is the parts of an oplog entry the Analyzer looks at.
+type op struct {
+	Ts bson.MongoTimestamp `bson:"ts"`
+	Op string              `bson:"op"`
+	Ns string              `bson:"ns"`
+	O  bson.D              `bson:"o"`
+	O2 bson.M              `bson:"o2"`
+}
+
+// Add analyzes an op, given as its raw BSON.
+func (a *Analyzer) Add(raw []byte) error {
+	var o op
+	if err := bson.Unmarshal(raw, &o); err != nil {
+		return err
+	}
+	s := &a.summary
+	s.Ops++
+	if s.Namespaces[o.Ns] == nil {
+		s.Namespaces[o.Ns] = map[string]int{}
+	}
+	s.Namespaces[o.Ns][o.Op]++
+	a.sizes.Record(int64(len(raw)))
+
+	if a.firstTs == 0 {
+		a.firstTs = o.Ts
+	}
+	if o.Ts < a.lastTs {
+		s.OutOfOrder++
+	}
+	a.lastTs = o.Ts
+	a.addToRates(int64(o.Ts >> 32))
+
+	switch o.Op {
+	case "u":
+		if id, ok := o.O2["_id"]; ok {
+			a.hotKeys.add(o.Ns + "\x00" + formatID(id))
+		}
+	case "c":
+		s.CommandCount++
+		if len(s.Commands) < maxCommands {
+			s.Commands = append(s.Commands, Command{Ts: bsonScanner.FormatTimestamp(o.Ts), Ns: o.Ns, Command: formatCommand(o.O)})
+		}
+	}
+	return nil
+}
+
+// addToRates counts an op at the given second of oplog time. Oplogs are in order, so only the
+// current second and bucket need counting.
+func (a *Analyzer) addToRates(second int64) {
+	if second != a.second {
+		a.second = second
+		a.inSecond = 0
+	}
+	a.inSecond++
+	if a.inSecond > a.summary.PeakOpsPerSec {
+		a.summary.PeakOpsPerSec = a.inSecond
+	}
+
+	minute := second / 60
+	if a.buckets == nil {
+		a.first = minute
+	}
+	if minute < a.first {
+		return
+	}
+	for (minute-a.first)/a.width >= maxBuckets {
+		a.widen()
+	}
+	// Buckets without any ops are counted too, so the counts can be read as a histogram
+	for int64(len(a.buckets)) <= (minute-a.first)/a.width {
+		a.buckets = append(a.buckets, 0)
+	}
+	a.buckets[(minute-a.first)/a.width]++
+}
+
+// widen merges the buckets into ones twice as wide, aligned to multiples of the new width.
+func (a *Analyzer) widen() {
+	width := a.width * 2
+	first := a.first - a.first%width
+	buckets := []int{}
+	for i, count := range a.buckets {
+		j := int((a.first + int64(i)*a.width - first) / width)
+		if j == len(buckets) {
+			buckets = append(buckets, 0)
+		}
+		buckets[j] += count
+	}
+	a.buckets, a.first, a.width = buckets, first, width
+}
+
+// Summary returns the summary of the ops added so far.
+func (a *Analyzer) Summary() Summary {
+	s := a.summary
+	if a.firstTs != 0 {
+		s.FirstTimestamp, s.LastTimestamp = bsonScanner.FormatTimestamp(a.firstTs), bsonScanner.FormatTimestamp(a.lastTs)
+		s.OplogStart = time.Unix(int64(a.firstTs>>32), 0).UTC().Format(time.RFC3339)
+		s.OplogEnd = time.Unix(int64(a.lastTs>>32), 0).UTC().Format(time.RFC3339)
+		s.SpanSeconds = float64(a.lastTs>>32 - a.firstTs>>32)
+	}
+	if s.SpanSeconds > 0 {
+		s.AverageOpsPerSec = float64(s.Ops) / s.SpanSeconds
+	} else {
+		s.AverageOpsPerSec = float64(s.PeakOpsPerSec)
+	}
+	if a.sizes.Count() > 0 {
+		s.DocumentSize = Sizes{
+			Min:  a.sizes.Min(),
+			P50:  a.sizes.Quantile(0.5),
+			P90:  a.sizes.Quantile(0.9),
+			P99:  a.sizes.Quantile(0.99),
+			Max:  a.sizes.Max(),
+			Mean: a.sizes.Mean(),
+		}
+	}
+	s.HotKeys = []HotKey{}
+	for _, c := range a.hotKeys.top(a.topKeys) {
+		nsAndID := strings.SplitN(c.key, "\x00", 2)
+		s.HotKeys = append(s.HotKeys, HotKey{Ns: nsAndID[0], ID: nsAndID[1], Updates: c.count, MaxError: c.err})
+	}
+	if s.Commands == nil {
+		s.Commands = []Command{}
+	}
+	s.OpsOverTime = []Bucket{}
+	for i, count := range a.buckets {
+		start := time.Unix((a.first+int64(i)*a.width)*60, 0).UTC().Format(time.RFC3339)
+		s.OpsOverTime = append(s.OpsOverTime, Bucket{Start: start, Ops: count})
+	}
+	s.BucketMinutes = a.width
+	return s
+}
+
+// Scan analyzes every op in r.
+func Scan(r io.Reader, topKeys int) (Summary, error) {
+	a := New(topKeys)
+	scanner := bsonScanner.New(r)
+	for scanner.Scan() {
+		if err := a.Add(scanner.Bytes()); err != nil {
+			return a.Summary(), err
+		}
+	}
+	return a.Summary(), scanner.Err()
+}
+
+// WriteTable writes the summary in a human readable form.
+func (s Summary) WriteTable(w io.Writer) {
+	fmt.Fprintf(w, "%d ops from %s (%s) to %s (%s), %v of oplog time\n", s.Ops,
+		s.FirstTimestamp, s.OplogStart, s.LastTimestamp, s.OplogEnd, time.Duration(s.SpanSeconds)*time.Second)
+	fmt.Fprintf(w, "Ops/sec: %.1f average, %d peak\n", s.AverageOpsPerSec, s.PeakOpsPerSec)
+	if s.OutOfOrder > 0 {
+		fmt.Fprintf(w, "%d ops out of ts order\n", s.OutOfOrder)
+	}
+	fmt.Fprintf(w, "Op size: min %dB, p50 %dB, p90 %dB, p99 %dB, max %dB, mean %.0fB\n\n", s.DocumentSize.Min,
+		s.DocumentSize.P50, s.DocumentSize.P90, s.DocumentSize.P99, s.DocumentSize.Max, s.DocumentSize.Mean)
+
+	fmt.Fprintf(w, "%-40s %-3s %10s\n", "ns", "op", "count")
+	namespaces := []string{}
+	for ns := range s.Namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		ops := []string{}
+		for op := range s.Namespaces[ns] {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		for _, op := range ops {
+			fmt.Fprintf(w, "%-40s %-3s %10d\n", ns, op, s.Namespaces[ns][op])
+		}
+	}
+
+	if s.BucketMinutes == 1 {
+		fmt.Fprintf(w, "\nOps per minute:\n")
+	} else {
+		fmt.Fprintf(w, "\nOps per %d minutes:\n", s.BucketMinutes)
+	}
+	peak := 0
+	for _, b := range s.OpsOverTime {
+		if b.Ops > peak {
+			peak = b.Ops
+		}
+	}
+	for _, b := range s.OpsOverTime {
+		fmt.Fprintf(w, "%-20s %10d %s\n", b.Start, b.Ops, bar(b.Ops, peak, 50))
+	}
+
+	if len(s.HotKeys) > 0 {
+		fmt.Fprintf(w, "\nMost updated _ids:\n")
+		fmt.Fprintf(w, "%-40s %-26s %10s\n", "ns", "_id", "updates")
+		for _, k := range s.HotKeys {
+			fmt.Fprintf(w, "%-40s %-26s %10d\n", k.Ns, k.ID, k.Updates)
+		}
+	}
+
+	if s.CommandCount > 0 {
+		fmt.Fprintf(w, "\n%d commands:\n", s.CommandCount)
+		for _, c := range s.Commands {
+			fmt.Fprintf(w, "%-22s %-40s %s\n", c.Ts, c.Ns, c.Command)
+		}
+		if s.CommandCount > len(s.Commands) {
+			fmt.Fprintf(w, "... and %d more\n", s.CommandCount-len(s.Commands))
+		}
+	}
+}
+
+// bar returns a bar of up to width characters, in proportion to n out of max.
+func bar(n, max, width int) string {
+	if max == 0 {
+		return ""
+	}
+	b := make([]byte, n*width/max)
+	for i := range b {
+		b[i] = '#'
+	}
+	return string(b)
+}
+
+// formatCommand returns the name of a command and what it applies to, e.g. "drop: users".
+func formatCommand(command bson.D) string {
+	if len(command) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%s: %v", command[0].Name, command[0].Value)
+}
+
+func formatID(id interface{}) string {
+	if objectID, ok := id.(bson.ObjectId); ok {
+		return objectID.Hex()
+	}
+	return fmt.Sprint(id)
+}
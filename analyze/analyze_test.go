@@ -0,0 +1,138 @@
+package analyze
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func oplog(t *testing.T, ops ...bson.M) *bytes.Buffer {
+	var buf bytes.Buffer
+	for _, op := range ops {
+		raw, err := bson.Marshal(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(raw)
+	}
+	return &buf
+}
+
+func ts(seconds, inc int64) bson.MongoTimestamp {
+	return bson.MongoTimestamp(seconds<<32 | inc)
+}
+
+func TestScan(t *testing.T) {
+	r := oplog(t,
+		bson.M{"ts": ts(1445000000, 1), "op": "i", "ns": "app.users", "o": bson.M{"_id": 1}},
+		bson.M{"ts": ts(1445000000, 2), "op": "u", "ns": "app.users", "o2": bson.M{"_id": 1}, "o": bson.M{"$set": bson.M{"a": 1}}},
+		bson.M{"ts": ts(1445000000, 3), "op": "u", "ns": "app.users", "o2": bson.M{"_id": 1}, "o": bson.M{"$set": bson.M{"a": 2}}},
+		bson.M{"ts": ts(1445000001, 1), "op": "u", "ns": "app.orders", "o2": bson.M{"_id": 2}, "o": bson.M{"$set": bson.M{"a": 1}}},
+		bson.M{"ts": ts(1445000100, 1), "op": "c", "ns": "app.$cmd", "o": bson.D{{Name: "drop", Value: "orders"}}},
+	)
+	summary, err := Scan(r, 1)
+	assert.Nil(t, err)
+
+	assert.Equal(t, 5, summary.Ops)
+	assert.Equal(t, map[string]map[string]int{
+		"app.users":  {"i": 1, "u": 2},
+		"app.orders": {"u": 1},
+		"app.$cmd":   {"c": 1},
+	}, summary.Namespaces)
+	assert.Equal(t, "1445000000:1", summary.FirstTimestamp)
+	assert.Equal(t, "1445000100:1", summary.LastTimestamp)
+	assert.Equal(t, "2015-10-16T12:53:20Z", summary.OplogStart)
+	assert.Equal(t, float64(100), summary.SpanSeconds)
+	assert.Equal(t, 0.05, summary.AverageOpsPerSec)
+	assert.Equal(t, 3, summary.PeakOpsPerSec)
+	assert.Equal(t, []Bucket{{"2015-10-16T12:53:00Z", 4}, {"2015-10-16T12:54:00Z", 0}, {"2015-10-16T12:55:00Z", 1}}, summary.OpsOverTime)
+	assert.Equal(t, int64(1), summary.BucketMinutes)
+	assert.Equal(t, []HotKey{{Ns: "app.users", ID: "1", Updates: 2}}, summary.HotKeys)
+	assert.Equal(t, []Command{{Ts: "1445000100:1", Ns: "app.$cmd", Command: "drop: orders"}}, summary.Commands)
+	assert.Equal(t, 1, summary.CommandCount)
+	assert.True(t, summary.DocumentSize.Min > 0)
+	assert.True(t, summary.DocumentSize.Min <= summary.DocumentSize.P50)
+	assert.True(t, summary.DocumentSize.P50 <= summary.DocumentSize.Max)
+
+	var table bytes.Buffer
+	summary.WriteTable(&table)
+	assert.True(t, strings.Contains(table.String(), "drop: orders"))
+	_, err = json.Marshal(summary)
+	assert.Nil(t, err)
+}
+
+func TestScanTestdata(t *testing.T) {
+	f, err := os.Open("../bson/testdata.bson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	summary, err := Scan(f, 10)
+	assert.Nil(t, err)
+	total := 0
+	for _, ops := range summary.Namespaces {
+		for _, count := range ops {
+			total += count
+		}
+	}
+	assert.Equal(t, summary.Ops, total)
+	overTime := 0
+	for _, b := range summary.OpsOverTime {
+		overTime += b.Ops
+	}
+	assert.Equal(t, summary.Ops, overTime)
+}
+
+func TestBucketsWiden(t *testing.T) {
+	// An op every ten minutes for a week, followed by one more after a year's gap
+	ops := []bson.M{}
+	for i := int64(0); i < 7*24*6; i++ {
+		ops = append(ops, bson.M{"ts": ts(1445000000+i*600, 1), "op": "n", "ns": ""})
+	}
+	ops = append(ops, bson.M{"ts": ts(1445000000+365*24*3600, 1), "op": "n", "ns": ""})
+	summary, err := Scan(oplog(t, ops...), 1)
+	assert.Nil(t, err)
+	assert.True(t, len(summary.OpsOverTime) <= maxBuckets, "%d buckets", len(summary.OpsOverTime))
+	assert.Equal(t, int64(8192), summary.BucketMinutes)
+	total := 0
+	for _, b := range summary.OpsOverTime {
+		total += b.Ops
+	}
+	assert.Equal(t, len(ops), total)
+	assert.Equal(t, 1, summary.OpsOverTime[len(summary.OpsOverTime)-1].Ops)
+}
+
+func TestScanOutOfOrder(t *testing.T) {
+	// Descending timestamps, as in dumps concatenated in the wrong order, and an entry without one
+	r := oplog(t,
+		bson.M{"ts": ts(1445000600, 1), "op": "i", "ns": "app.users", "o": bson.M{"_id": 1}},
+		bson.M{"ts": ts(1445000300, 1), "op": "i", "ns": "app.users", "o": bson.M{"_id": 2}},
+		bson.M{"ts": ts(1445000000, 1), "op": "i", "ns": "app.users", "o": bson.M{"_id": 3}},
+		bson.M{"op": "n", "ns": ""},
+	)
+	summary, err := Scan(r, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, summary.Ops)
+	assert.Equal(t, 3, summary.OutOfOrder)
+	assert.Equal(t, []Bucket{{"2015-10-16T13:03:00Z", 1}}, summary.OpsOverTime)
+	var table bytes.Buffer
+	summary.WriteTable(&table)
+	assert.Contains(t, table.String(), "3 ops out of ts order")
+}
+
+func TestTopK(t *testing.T) {
+	top := newTopK(2)
+	for _, key := range []string{"a", "a", "a", "b", "b", "c"} {
+		top.add(key)
+	}
+	// "c" replaced "b", inheriting its count as the error
+	counters := top.top(2)
+	assert.Equal(t, 2, len(counters))
+	assert.Equal(t, counter{key: "a", count: 3}, *counters[0])
+	assert.Equal(t, counter{key: "c", count: 3, err: 2}, *counters[1])
+}
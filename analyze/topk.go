@@ -0,0 +1,68 @@
+package analyze
+
+import "sort"
+
+// topK finds the most frequent keys in a stream using the Space-Saving algorithm: it counts at
+// most capacity keys, and a new key replaces the one with the lowest count, inheriting that
+// count as its possible error.
+type topK struct {
+	capacity int
+	counters map[string]*counter
+}
+
+type counter struct {
+	key   string
+	count int
+	err   int
+}
+
+func newTopK(capacity int) *topK {
+	return &topK{capacity: capacity, counters: map[string]*counter{}}
+}
+
+func (t *topK) add(key string) {
+	if c, ok := t.counters[key]; ok {
+		c.count++
+		return
+	}
+	if len(t.counters) < t.capacity {
+		t.counters[key] = &counter{key: key, count: 1}
+		return
+	}
+	var min *counter
+	for _, c := range t.counters {
+		if min == nil || c.count < min.count {
+			min = c
+		}
+	}
+	if min == nil {
+		return
+	}
+	delete(t.counters, min.key)
+	t.counters[key] = &counter{key: key, count: min.count + 1, err: min.count}
+}
+
+// byCount sorts counters by descending count, then key.
+type byCount []*counter
+
+func (c byCount) Len() int      { return len(c) }
+func (c byCount) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byCount) Less(i, j int) bool {
+	if c[i].count != c[j].count {
+		return c[i].count > c[j].count
+	}
+	return c[i].key < c[j].key
+}
+
+// top returns the n keys with the highest counts.
+func (t *topK) top(n int) []*counter {
+	counters := byCount{}
+	for _, c := range t.counters {
+		counters = append(counters, c)
+	}
+	sort.Sort(counters)
+	if len(counters) > n {
+		counters = counters[:n]
+	}
+	return counters
+}
@@ -0,0 +1,135 @@
+// Package bench checks the latency of a replay against thresholds, so replays can be used as a
+// regression gate.
+package bench
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Clever/oplog-replay/replay"
+)
+
+// metrics are the latency statistics an Assertion can check.
+var metrics = map[string]func(p replay.Percentiles) float64{
+	"p50":  func(p replay.Percentiles) float64 { return p.P50 },
+	"p90":  func(p replay.Percentiles) float64 { return p.P90 },
+	"p99":  func(p replay.Percentiles) float64 { return p.P99 },
+	"max":  func(p replay.Percentiles) float64 { return p.Max },
+	"mean": func(p replay.Percentiles) float64 { return p.Mean },
+}
+
+// Assertion is a threshold on the latency of a replay's ops, e.g. "ns=app.orders,p99<50ms".
+type Assertion struct {
+	// Ns and Op restrict the assertion to ops in a namespace or of a type. Empty matches all.
+	Ns, Op string
+	// Metric is one of p50, p90, p99, max or mean.
+	Metric string
+	// Threshold is the latency the metric must be under, or at most if Inclusive is set.
+	Threshold time.Duration
+	Inclusive bool
+
+	spec string
+}
+
+// ParseAssertion parses an assertion of the form "[ns=<ns>,][op=<op>,]<metric><threshold>",
+// where metric is p50, p90, p99, max or mean, and threshold is '<' or '<=' followed by a
+// duration, e.g. "op=u,p99<=20ms".
+func ParseAssertion(spec string) (Assertion, error) {
+	a := Assertion{spec: spec}
+	parts := strings.Split(spec, ",")
+	for _, filter := range parts[:len(parts)-1] {
+		kv := strings.SplitN(filter, "=", 2)
+		if len(kv) != 2 {
+			return Assertion{}, fmt.Errorf("Invalid assertion %q: expected ns=<ns> or op=<op>, got %q", spec, filter)
+		}
+		switch kv[0] {
+		case "ns":
+			a.Ns = kv[1]
+		case "op":
+			a.Op = kv[1]
+		default:
+			return Assertion{}, fmt.Errorf("Invalid assertion %q: unknown filter %q", spec, kv[0])
+		}
+	}
+
+	condition := parts[len(parts)-1]
+	i := strings.Index(condition, "<")
+	if i < 0 {
+		return Assertion{}, fmt.Errorf("Invalid assertion %q: expected <metric><<threshold>", spec)
+	}
+	a.Metric = condition[:i]
+	if _, ok := metrics[a.Metric]; !ok {
+		return Assertion{}, fmt.Errorf("Invalid assertion %q: unknown metric %q", spec, a.Metric)
+	}
+	threshold := condition[i+1:]
+	if strings.HasPrefix(threshold, "=") {
+		a.Inclusive = true
+		threshold = threshold[1:]
+	}
+	var err error
+	if a.Threshold, err = time.ParseDuration(threshold); err != nil {
+		return Assertion{}, fmt.Errorf("Invalid assertion %q: %s", spec, err)
+	}
+	return a, nil
+}
+
+// String returns the assertion as it was written.
+func (a Assertion) String() string {
+	return a.spec
+}
+
+// Check returns an error if the replay breached the assertion. Assertions on ops that weren't
+// applied (after the warm-up) are breached, since they can't be checked.
+func (a Assertion) Check(stats replay.Stats) error {
+	return a.check(stats.LatencyOf(a.Ns, a.Op))
+}
+
+// check returns an error if the latency of the matching ops breached the assertion.
+func (a Assertion) check(latency replay.Percentiles, ok bool) error {
+	if !ok {
+		return fmt.Errorf("%s: no matching ops were applied", a)
+	}
+	actual := seconds(metrics[a.Metric](latency))
+	if actual > a.Threshold || (actual == a.Threshold && !a.Inclusive) {
+		return fmt.Errorf("%s: %s was %v", a, a.Metric, actual)
+	}
+	return nil
+}
+
+// WriteTable writes the latency percentiles of a replay by namespace and op type.
+func WriteTable(w io.Writer, stats replay.Stats) {
+	fmt.Fprintf(w, "%-40s %-3s %10s %12s %12s %12s %12s\n", "ns", "op", "applied", "p50", "p90", "p99", "max")
+	namespaces := []string{}
+	for ns := range stats.Ops {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	for _, ns := range namespaces {
+		ops := []string{}
+		for op := range stats.Ops[ns] {
+			ops = append(ops, op)
+		}
+		sort.Strings(ops)
+		for _, op := range ops {
+			counts := stats.Ops[ns][op]
+			if counts.Latency == nil {
+				continue
+			}
+			writeRow(w, ns, op, counts.Applied, *counts.Latency)
+		}
+	}
+	writeRow(w, "all", "", stats.Applied, stats.Latency)
+}
+
+func writeRow(w io.Writer, ns, op string, applied int, p replay.Percentiles) {
+	fmt.Fprintf(w, "%-40s %-3s %10d %12v %12v %12v %12v\n", ns, op, applied,
+		seconds(p.P50), seconds(p.P90), seconds(p.P99), seconds(p.Max))
+}
+
+// seconds converts seconds to a Duration.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
@@ -0,0 +1,69 @@
+package bench
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Clever/oplog-replay/replay"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAssertion(t *testing.T) {
+	a, err := ParseAssertion("p99<20ms")
+	assert.Nil(t, err)
+	assert.Equal(t, Assertion{Metric: "p99", Threshold: 20 * time.Millisecond, spec: "p99<20ms"}, a)
+
+	a, err = ParseAssertion("ns=app.orders,op=u,max<=1s")
+	assert.Nil(t, err)
+	assert.Equal(t, "app.orders", a.Ns)
+	assert.Equal(t, "u", a.Op)
+	assert.Equal(t, "max", a.Metric)
+	assert.Equal(t, time.Second, a.Threshold)
+	assert.True(t, a.Inclusive)
+
+	for _, spec := range []string{"", "p99", "p99>20ms", "p95<20ms", "p99<20", "db=app,p99<20ms", "app.orders,p99<20ms"} {
+		_, err := ParseAssertion(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	latency := replay.Percentiles{P50: 0.005, P90: 0.01, P99: 0.02, Max: 0.1, Mean: 0.006}
+
+	a, _ := ParseAssertion("p99<30ms")
+	assert.Nil(t, a.check(latency, true))
+	a, _ = ParseAssertion("p99<20ms")
+	assert.NotNil(t, a.check(latency, true))
+	a, _ = ParseAssertion("p99<=20ms")
+	assert.Nil(t, a.check(latency, true))
+	a, _ = ParseAssertion("max<50ms")
+	err := a.check(latency, true)
+	assert.NotNil(t, err)
+	assert.Equal(t, "max<50ms: max was 100ms", err.Error())
+
+	// Assertions that match no ops fail
+	a, _ = ParseAssertion("ns=app.missing,p99<1s")
+	assert.NotNil(t, a.check(replay.Percentiles{}, false))
+}
+
+func TestWriteTable(t *testing.T) {
+	latency := replay.Percentiles{P50: 0.005, P90: 0.01, P99: 0.02, Max: 0.1}
+	stats := replay.Stats{
+		Applied: 3,
+		Ops: map[string]map[string]*replay.OpCounts{
+			"app.users":  {"i": {Applied: 1, Latency: &latency}},
+			"app.orders": {"u": {Applied: 2, Latency: &latency}, "d": {Read: 1}},
+		},
+		Latency: latency,
+	}
+	var buf bytes.Buffer
+	WriteTable(&buf, stats)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t, 4, len(lines))
+	assert.True(t, strings.HasPrefix(lines[1], "app.orders"))
+	assert.True(t, strings.HasPrefix(lines[2], "app.users"))
+	assert.True(t, strings.HasPrefix(lines[3], "all"))
+	assert.Equal(t, []string{"app.orders", "u", "2", "5ms", "10ms", "20ms", "100ms"}, strings.Fields(lines[1]))
+}
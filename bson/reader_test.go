@@ -80,3 +80,9 @@ func TestParseLargeBSON(t *testing.T) {
 	}
 
 }
+
+func TestFormatTimestamp(t *testing.T) {
+	if formatted := FormatTimestamp(bson.MongoTimestamp(1445000000<<32 | 3)); formatted != "1445000000:3" {
+		t.Fatalf("Expected 1445000000:3, got %s", formatted)
+	}
+}
@@ -0,0 +1,12 @@
+package bson
+
+import (
+	"fmt"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// FormatTimestamp formats an oplog timestamp as "seconds:increment", the way mongo shows them.
+func FormatTimestamp(ts bson.MongoTimestamp) string {
+	return fmt.Sprintf("%d:%d", int64(ts>>32), int64(ts&0xffffffff))
+}
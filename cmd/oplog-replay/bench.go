@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/Clever/oplog-replay/bench"
+)
+
+// assertions is a flag that can be repeated to check several latency thresholds.
+type assertions []bench.Assertion
+
+func (a *assertions) String() string {
+	specs := []string{}
+	for _, assertion := range *a {
+		specs = append(specs, assertion.String())
+	}
+	return strings.Join(specs, " ")
+}
+
+func (a *assertions) Set(spec string) error {
+	assertion, err := bench.ParseAssertion(spec)
+	if err != nil {
+		return err
+	}
+	*a = append(*a, assertion)
+	return nil
+}
+
+// runBench replays the oplog like a normal replay, prints the latency of the ops applied, and
+// exits with status 1 if any of the assertions were breached.
+func runBench(args []string) error {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	options := addReplayFlags(flags)
+	var checks assertions
+	flags.Var(&checks, "assert", "Fail if the latency of the ops applied breaches this threshold, e.g. 'p99<20ms' or 'ns=app.orders,op=u,p99<=50ms'. Metrics are p50, p90, p99, max and mean. Can be repeated.")
+	flags.DurationVar(&options.warmup, "warmup", 0, "Leave the ops applied in this long (e.g. '30s') at the start of the replay out of the latency statistics.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: oplog-replay bench [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	stats, err := options.run(flags)
+	if err != nil {
+		return err
+	}
+	bench.WriteTable(os.Stdout, stats)
+
+	breached := false
+	for _, check := range checks {
+		if err := check.Check(stats); err != nil {
+			fmt.Fprintln(os.Stderr, "FAIL", err)
+			breached = true
+		} else {
+			fmt.Fprintln(os.Stderr, "PASS", check)
+		}
+	}
+	if breached {
+		os.Exit(1)
+	}
+	return nil
+}
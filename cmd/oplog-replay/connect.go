@@ -0,0 +1,105 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Clever/oplog-replay/connect"
+	"github.com/Clever/pathio"
+)
+
+// connectOptions are the flags that say how to connect to the host being replayed onto.
+type connectOptions struct {
+	host          *string
+	username      *string
+	password      *string
+	passwordFile  *string
+	authMechanism *string
+	authDatabase  *string
+	tls           *bool
+	tlsCAFile     *string
+	tlsCertFile   *string
+	tlsKeyFile    *string
+	tlsInsecure   *bool
+	w             *string
+	j             *bool
+	wtimeout      *time.Duration
+}
+
+// addConnectFlags defines the flags that say how to connect to the host in flags.
+func addConnectFlags(flags *flag.FlagSet) *connectOptions {
+	return &connectOptions{
+		host:          flags.String("host", "localhost", "Mongo host, or mongodb:// connection string, to playback onto."),
+		username:      flags.String("username", "", "User to authenticate as. Defaults to the user in the connection string, or the OPLOG_REPLAY_USERNAME environment variable."),
+		password:      flags.String("password", "", "Password to authenticate with. Defaults to the contents of 'password-file', the password in the connection string, or the OPLOG_REPLAY_PASSWORD environment variable."),
+		passwordFile:  flags.String("password-file", "", "File (local or s3://) containing the password to authenticate with."),
+		authMechanism: flags.String("auth-mechanism", "", "Auth mechanism: 'MONGODB-CR', 'PLAIN' or 'GSSAPI'. Defaults to the one in the connection string, or 'MONGODB-CR'."),
+		authDatabase:  flags.String("auth-database", "", "Database the user is defined in. Defaults to the one in the connection string, or 'admin'."),
+		tls:           flags.Bool("tls", false, "Connect with TLS."),
+		tlsCAFile:     flags.String("tls-ca-file", "", "PEM file of the certificate authorities to trust for TLS. Defaults to the system's."),
+		tlsCertFile:   flags.String("tls-cert-file", "", "PEM file of the client certificate for TLS. It can also contain the key."),
+		tlsKeyFile:    flags.String("tls-key-file", "", "PEM file of the client certificate's key for TLS, if it isn't in 'tls-cert-file'."),
+		tlsInsecure:   flags.Bool("tls-insecure", false, "Don't check the server's TLS certificate."),
+		w:             flags.String("w", "", "Write concern: how many servers have to acknowledge each batch of ops, or 'majority'. Defaults to the server's default."),
+		j:             flags.Bool("j", false, "Wait for each batch of ops to be journaled."),
+		wtimeout:      flags.Duration("wtimeout", 0, "How long to wait for the 'w' write concern before failing the replay. Defaults to no limit."),
+	}
+}
+
+// options returns the connection options from the connection string and the other flags, which
+// take precedence over it.
+func (o *connectOptions) options() (connect.Options, error) {
+	options, err := connect.ParseURI(*o.host)
+	if err != nil {
+		return connect.Options{}, err
+	}
+	password := *o.password
+	if password == "" && *o.passwordFile != "" {
+		var err error
+		if password, err = readSecretFile(*o.passwordFile); err != nil {
+			return connect.Options{}, err
+		}
+	}
+	options.Username = firstSet(*o.username, options.Username, os.Getenv("OPLOG_REPLAY_USERNAME"))
+	options.Password = firstSet(password, options.Password, os.Getenv("OPLOG_REPLAY_PASSWORD"))
+	options.AuthMechanism = firstSet(*o.authMechanism, options.AuthMechanism)
+	options.AuthSource = firstSet(*o.authDatabase, options.AuthSource)
+	options.TLS = options.TLS || *o.tls
+	options.TLSCAFile = firstSet(*o.tlsCAFile, options.TLSCAFile)
+	options.TLSCertFile = firstSet(*o.tlsCertFile, options.TLSCertFile)
+	options.TLSKeyFile = firstSet(*o.tlsKeyFile, options.TLSKeyFile)
+	options.TLSInsecure = options.TLSInsecure || *o.tlsInsecure
+	options.W = firstSet(*o.w, options.W)
+	options.J = options.J || *o.j
+	if *o.wtimeout > 0 {
+		options.WTimeout = *o.wtimeout
+	}
+	return options, nil
+}
+
+// firstSet returns the first of values that isn't empty.
+func firstSet(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// readSecretFile reads a secret, like a password, from a file (local or s3://), leaving out any
+// trailing newline.
+func readSecretFile(path string) (string, error) {
+	r, err := pathio.Reader(path)
+	if err != nil {
+		return "", err
+	}
+	contents, err := ioutil.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(contents), "\r\n"), nil
+}
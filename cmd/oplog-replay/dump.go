@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	bsonScanner "github.com/Clever/oplog-replay/bson"
+	"github.com/Clever/oplog-replay/extjson"
+	"github.com/Clever/oplog-replay/transform"
+)
+
+// dump prints oplog entries as Extended JSON, one per line.
+func dump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	path := flags.String("path", "/dev/stdin", "Oplog file to print (local or s3://)")
+	format := flags.String("format", "relaxed", "Extended JSON format. Valid options are 'relaxed' and 'canonical'.")
+	limit := flags.Int("limit", 0, "Print at most this many entries. Defaults to no limit.")
+	offset := flags.Int64("offset", 0, "Start reading at this byte offset, which must be the start of an entry.")
+	filterOpts := addFilterFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: oplog-replay dump [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	mode, err := extjson.ParseMode(*format)
+	if err != nil {
+		return err
+	}
+	f, err := filterOpts.filter()
+	if err != nil {
+		return err
+	}
+	input, err := readerWithRetry(*path)
+	if err != nil {
+		return err
+	}
+	if *offset > 0 {
+		if _, err := io.CopyN(ioutil.Discard, input, *offset); err != nil {
+			return fmt.Errorf("Failed to skip to offset %d: %s", *offset, err)
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	printed := 0
+	scanner := bsonScanner.New(input)
+	for scanner.Scan() && (*limit == 0 || printed < *limit) {
+		// Entries are decoded and filtered exactly as they are when replaying
+		op, doc, err := transform.DecodeDoc(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+		if !f.Match(op) {
+			continue
+		}
+		line, err := extjson.Marshal(doc, mode)
+		if err != nil {
+			return err
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+		printed++
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/Clever/oplog-replay/filter"
+	"github.com/Clever/oplog-replay/ratecontroller/control"
+	"labix.org/v2/mgo/bson"
+)
+
+// filterOptions are the flags that select which oplog entries to use.
+type filterOptions struct {
+	namespaces *string
+	ops        *string
+	fromTs     *string
+	toTs       *string
+}
+
+// addFilterFlags defines the flags that select oplog entries in flags.
+func addFilterFlags(flags *flag.FlagSet) *filterOptions {
+	return &filterOptions{
+		namespaces: flags.String("ns", "", "Only use entries in these comma separated namespaces. Patterns like 'app.*' are allowed. Defaults to all namespaces."),
+		ops:        flags.String("op", "", "Only use entries of these comma separated op types, e.g. 'i,u,d'. Use '<ns>=i,u' for a namespace and ';' between rules. Defaults to all types."),
+		fromTs:     flags.String("from-ts", "", "Only use entries at or after this oplog timestamp, given as 'seconds', 'seconds:increment' or an RFC3339 time."),
+		toTs:       flags.String("to-ts", "", "Only use entries at or before this oplog timestamp, given as 'seconds', 'seconds:increment' or an RFC3339 time."),
+	}
+}
+
+// filter returns the filter the flags describe, or nil if they don't filter anything.
+func (o *filterOptions) filter() (*filter.Filter, error) {
+	if *o.namespaces == "" && *o.ops == "" && *o.fromTs == "" && *o.toTs == "" {
+		return nil, nil
+	}
+	from, err := parseOptionalTimestamp(*o.fromTs)
+	if err != nil {
+		return nil, err
+	}
+	to, err := parseOptionalTimestamp(*o.toTs)
+	if err != nil {
+		return nil, err
+	}
+	ops, err := filter.ParseOps(*o.ops)
+	if err != nil {
+		return nil, err
+	}
+	return filter.New(splitList(*o.namespaces), ops, from, to)
+}
+
+func parseOptionalTimestamp(value string) (bson.MongoTimestamp, error) {
+	if value == "" {
+		return 0, nil
+	}
+	return control.ParseTimestamp(value)
+}
+
+// splitList splits a comma separated list, returning nil for an empty one.
+func splitList(list string) []string {
+	if list == "" {
+		return nil
+	}
+	return strings.Split(list, ",")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Clever/oplog-replay/guard"
+	"labix.org/v2/mgo"
+)
+
+// guardOptions are the flags that decide which servers can be replayed onto.
+type guardOptions struct {
+	allowSets      *string
+	denySets       *string
+	allowHosts     *string
+	denyHosts      *string
+	allowDatabases *string
+	denyDatabases  *string
+	confirm        *bool
+	token          *string
+}
+
+// addGuardFlags defines the flags that decide which servers can be replayed onto in flags.
+func addGuardFlags(flags *flag.FlagSet) *guardOptions {
+	return &guardOptions{
+		allowSets:      flags.String("allow-sets", "", "Comma separated patterns, e.g. 'staging-*', for the replica set names that can be replayed onto. Defaults to any set, or none."),
+		denySets:       flags.String("deny-sets", "*prod*", "Comma separated patterns for the replica set names that can't be replayed onto."),
+		allowHosts:     flags.String("allow-hosts", "", "Comma separated patterns for the hosts that can be replayed onto. Every member of the replica set has to match. Defaults to any host."),
+		denyHosts:      flags.String("deny-hosts", "*prod*", "Comma separated patterns for the hosts that can't be replayed onto, if any member of the replica set matches."),
+		allowDatabases: flags.String("allow-databases", "", "Comma separated patterns for the databases a host can have and still be replayed onto. Defaults to any database."),
+		denyDatabases:  flags.String("deny-databases", "", "Comma separated patterns for the databases a host can't have to be replayed onto."),
+		confirm:        flags.Bool("confirm", false, "Ask for the replica set name (or host, for a standalone server) to be typed in before replaying."),
+		token:          flags.String("i-know-what-im-doing", "", "The replica set name (or host, for a standalone server) being replayed onto, to confirm it without asking."),
+	}
+}
+
+// check returns an error if the server a session to the seeds is connected to can't be replayed
+// onto, or if that wasn't confirmed when it has to be. It's also an error if replicaSet is set and
+// the server isn't in it, since the driver doesn't check.
+func (o *guardOptions) check(seeds []string, replicaSet string, session *mgo.Session) error {
+	target, err := guard.Describe(session)
+	if err != nil {
+		return err
+	}
+	if replicaSet != "" && target.SetName != replicaSet {
+		return fmt.Errorf("Refusing to replay onto %s: the connection string is for replica set %s", target.Name(), replicaSet)
+	}
+	// Check the host as it was given too, in case it's an alias of the one the server knows
+	for _, seed := range seeds {
+		known := false
+		for _, h := range target.Hosts {
+			known = known || h == seed
+		}
+		if !known {
+			target.Hosts = append(target.Hosts, seed)
+		}
+	}
+
+	rules := guard.Rules{
+		AllowSets:      splitList(*o.allowSets),
+		DenySets:       splitList(*o.denySets),
+		AllowHosts:     splitList(*o.allowHosts),
+		DenyHosts:      splitList(*o.denyHosts),
+		AllowDatabases: splitList(*o.allowDatabases),
+		DenyDatabases:  splitList(*o.denyDatabases),
+	}
+	problems, err := rules.Check(target)
+	if err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("Refusing to replay onto %s: %s", target.Name(), strings.Join(problems, "; "))
+	}
+
+	switch {
+	case *o.token != "":
+		if *o.token != target.Name() {
+			return fmt.Errorf("Refusing to replay onto %s: --i-know-what-im-doing is set to %q", target.Name(), *o.token)
+		}
+	case *o.confirm:
+		// The oplog may be coming in on stdin, so ask on the terminal
+		tty, err := os.Open("/dev/tty")
+		if err != nil {
+			return fmt.Errorf("Can't ask for confirmation without a terminal, use --i-know-what-im-doing: %s", err)
+		}
+		defer tty.Close()
+		if err := guard.Confirm(target, tty, os.Stderr); err != nil {
+			return err
+		}
+	}
+	log.Printf("Replaying onto %s", target.Name())
+	return nil
+}
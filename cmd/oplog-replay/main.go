@@ -1,39 +1,247 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
 	"time"
 
+	"github.com/Clever/oplog-replay/connect"
+	"github.com/Clever/oplog-replay/metrics"
 	"github.com/Clever/oplog-replay/ratecontroller"
+	"github.com/Clever/oplog-replay/ratecontroller/bandwidth"
+	"github.com/Clever/oplog-replay/ratecontroller/control"
 	"github.com/Clever/oplog-replay/ratecontroller/fixed"
+	"github.com/Clever/oplog-replay/ratecontroller/poisson"
 	"github.com/Clever/oplog-replay/ratecontroller/relative"
+	"github.com/Clever/oplog-replay/ratecontroller/tokenbucket"
 	"github.com/Clever/oplog-replay/replay"
+	"github.com/Clever/oplog-replay/trace"
 	"github.com/Clever/pathio"
 	"github.com/cenkalti/backoff"
+	"labix.org/v2/mgo"
 )
 
+// subcommands are run instead of a replay when their name is the first argument.
+var subcommands = map[string]func(args []string) error{
+	"bench":      runBench,
+	"dump":       dump,
+	"split":      splitDump,
+	"stats":      stats,
+	"trace-diff": traceDiff,
+	"transform":  transformDump,
+	"validate":   validateDump,
+}
+
 func main() {
-	host := flag.String("host", "localhost", "Mongo host to playback onto.")
-	ratetype := flag.String("type", "fixed", "Type of rate limiting. Valid options are 'fixed' and 'relative'. See 'speed' for details on these types,")
-	speed := flag.Float64("speed", 1, "Sets the speed of the replay. For 'fixed' type replays this indicates the operations per second. For 'relative' type operations this indicates the speed relative to the initial oplog replay.")
-	path := flag.String("path", "/dev/stdin", "Oplog file to replay")
-	// See https://github.com/mongodb/docs/commit/238d6755a74c3c978cc272d318283f726379a43c for more details on the behavior of upsert
-	alwaysUpsert := flag.Bool("alwaysUpsert", false, "Convert all updates to upserts. Converting all updates to upserts prevents errors when replaying oplog dumps that have updates to documents followed by deletes to those same documents. Note that this flag is only applicable in Mongo version 2.6 and above.")
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			if err := subcommand(os.Args[2:]); err != nil {
+				panic(err)
+			}
+			return
+		}
+	}
+
+	options := addReplayFlags(flag.CommandLine)
 	flag.Parse()
+	if _, err := options.run(flag.CommandLine); err != nil {
+		panic(err)
+	}
+}
+
+// replayOptions are the flags that configure a replay.
+type replayOptions struct {
+	connect          *connectOptions
+	ratetype         *string
+	speed            *float64
+	maxGap           *time.Duration
+	maxOpsPerSec     *float64
+	maxBytesPerSec   *float64
+	burstBytes       *float64
+	jitter           *float64
+	seed             *int64
+	controlAddr      *string
+	maxDrift         *time.Duration
+	progressInterval *time.Duration
+	progressFormat   *string
+	metricsAddr      *string
+	reportPath       *string
+	tracePath        *string
+	path             *string
+	alwaysUpsert     *bool
+	translate        *bool
+	filter           *filterOptions
+	guard            *guardOptions
+	transform        *transformOptions
+
+	// warmup is how long at the start of the replay is left out of the latency statistics.
+	warmup time.Duration
+}
+
+// addReplayFlags defines the flags that configure a replay in flags.
+func addReplayFlags(flags *flag.FlagSet) *replayOptions {
+	return &replayOptions{
+		connect:          addConnectFlags(flags),
+		ratetype:         flags.String("type", "fixed", "Type of rate limiting. Valid options are 'fixed', 'relative', 'bandwidth', 'poisson' and 'jittered'. See 'speed' for details on these types,"),
+		speed:            flags.Float64("speed", 1, "Sets the speed of the replay. For 'fixed', 'poisson' and 'jittered' type replays this indicates the (mean) operations per second. For 'relative' type operations this indicates the speed relative to the initial oplog replay. For 'bandwidth' type replays this indicates the bytes of BSON per second."),
+		maxGap:           flags.Duration("max-gap", 0, "For 'relative' type replays, caps the oplog time between consecutive operations (e.g. '5s') so idle periods are skipped. The time skipped is reported when the replay finishes. Defaults to no cap."),
+		maxOpsPerSec:     flags.Float64("max-ops-per-sec", 0, "Caps the replay at this many operations per second, whatever the 'type'. Defaults to no cap."),
+		maxBytesPerSec:   flags.Float64("max-bytes-per-sec", 0, "Caps the replay at this many bytes of BSON per second, whatever the 'type'. Defaults to no cap."),
+		burstBytes:       flags.Float64("burst-bytes", 1024*1024, "How many bytes can be replayed in a burst by 'bandwidth' type replays and 'max-bytes-per-sec'."),
+		jitter:           flags.Float64("jitter", 0.5, "For 'jittered' type replays, how far the time between operations can vary from the mean, as a fraction of the mean."),
+		seed:             flags.Int64("seed", 1, "Random seed for 'poisson' and 'jittered' type replays. The same seed always produces the same schedule."),
+		controlAddr:      flags.String("control-addr", "", "Serve an HTTP API on this address (e.g. 'localhost:8080' or 'unix:/tmp/oplog-replay.sock') to pause, resume, change the speed of and skip ahead in the replay while it's running. Defaults to off."),
+		maxDrift:         flags.Duration("max-drift", 0, "Fail the replay if any operation is released more than this long (e.g. '30s') after it was scheduled, i.e. if the host can't keep up with the requested speed. Defaults to no limit."),
+		progressInterval: flags.Duration("progress-interval", time.Minute, "How often to log progress while replaying. Set to 0 to disable."),
+		progressFormat:   flags.String("progress-format", "text", "Format of progress logs. Valid options are 'text' and 'json'."),
+		metricsAddr:      flags.String("metrics-addr", "", "Serve Prometheus metrics at /metrics on this address (e.g. ':9090'). Defaults to off."),
+		reportPath:       flags.String("report", "", "Write a JSON report of the replay to this path (local or s3://) when it finishes. Defaults to off."),
+		tracePath:        flags.String("trace", "", "Write a record for every operation applied to this file. It's CSV if the name ends in '.csv' and JSONL otherwise, and gzipped if it ends in '.gz'. Defaults to off."),
+		path:             flags.String("path", "/dev/stdin", "Oplog file to replay"),
+		// See https://github.com/mongodb/docs/commit/238d6755a74c3c978cc272d318283f726379a43c for more details on the behavior of upsert
+		alwaysUpsert: flags.Bool("alwaysUpsert", false, "Convert all updates to upserts. Converting all updates to upserts prevents errors when replaying oplog dumps that have updates to documents followed by deletes to those same documents. Note that this flag is only applicable in Mongo version 2.6 and above."),
+		translate:    flags.Bool("translate", true, "Translate ops for the version of the host: remove fields it doesn't know or that refer to the server the oplog came from, and convert update and index build formats it can't apply."),
+		filter:       addFilterFlags(flags),
+		guard:        addGuardFlags(flags),
+		transform:    addTransformFlags(flags),
+	}
+}
 
-	controller, err := getControllerFromTypeAndSpeed(*ratetype, *speed)
+// run replays the oplog as configured by the options, which were parsed from flags.
+func (o *replayOptions) run(flags *flag.FlagSet) (replay.Stats, error) {
+	if *o.progressFormat != "text" && *o.progressFormat != "json" {
+		return replay.Stats{}, fmt.Errorf("Unknown progress format: %s", *o.progressFormat)
+	}
+
+	controller, err := getControllerFromTypeAndSpeed(*o.ratetype, *o.speed, *o.maxGap, *o.burstBytes, *o.jitter, *o.seed)
 	if err != nil {
-		panic(err)
+		return replay.Stats{}, err
+	}
+	if *o.maxOpsPerSec > 0 {
+		controller = ratecontroller.Max(controller, tokenbucket.New(*o.maxOpsPerSec, 1))
+	}
+	if *o.maxBytesPerSec > 0 {
+		controller = ratecontroller.Max(controller, bandwidth.New(*o.maxBytesPerSec, *o.burstBytes))
+	}
+	if *o.controlAddr != "" {
+		controlled := control.New(controller, *o.speed)
+		listener, err := control.Listen(*o.controlAddr)
+		if err != nil {
+			return replay.Stats{}, fmt.Errorf("Couldn't serve the control API: %s", err)
+		}
+		// Serving stops when the listener is closed at the end of the replay
+		defer listener.Close()
+		go http.Serve(listener, controlled.Handler())
+		controller = controlled
 	}
-	input, err := readerWithRetry(*path)
+	f, err := o.filter.filter()
 	if err != nil {
-		panic(err)
+		return replay.Stats{}, err
 	}
-	if err := replay.ReplayOplog(input, controller, *alwaysUpsert, *host); err != nil {
-		panic(err)
+	stage, err := o.transform.stage()
+	if err != nil {
+		return replay.Stats{}, err
 	}
+	connection, err := o.connect.options()
+	if err != nil {
+		return replay.Stats{}, err
+	}
+	dialInfo, err := connection.DialInfo()
+	if err != nil {
+		return replay.Stats{}, err
+	}
+	writeConcern, err := connection.WriteConcern()
+	if err != nil {
+		return replay.Stats{}, err
+	}
+	input, err := readerWithRetry(*o.path)
+	if err != nil {
+		return replay.Stats{}, err
+	}
+	replayer := &replay.Replayer{
+		Controller:   controller,
+		AlwaysUpsert: *o.alwaysUpsert,
+		Host:         strings.Join(dialInfo.Addrs, ","),
+		WriteConcern: writeConcern,
+		MaxDrift:     *o.maxDrift,
+		Warmup:       o.warmup,
+		Filter:       f,
+		Transform:    stage,
+		Translate:    *o.translate,
+
+		ProgressInterval: *o.progressInterval,
+		ProgressJSON:     *o.progressFormat == "json",
+		InputSize:        inputSize(*o.path),
+	}
+	replayer.Dial = func() (*mgo.Session, error) {
+		return connect.Dial(dialInfo)
+	}
+	replayer.Check = func(session *mgo.Session) error {
+		return o.guard.check(dialInfo.Addrs, connection.ReplicaSet, session)
+	}
+	if *o.metricsAddr != "" {
+		replayer.Metrics = metrics.NewRegistry()
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", replayer.Metrics)
+		listener, err := net.Listen("tcp", *o.metricsAddr)
+		if err != nil {
+			return replay.Stats{}, fmt.Errorf("Couldn't serve metrics: %s", err)
+		}
+		defer listener.Close()
+		go http.Serve(listener, mux)
+	}
+	if *o.tracePath != "" {
+		if replayer.Trace, err = trace.Create(*o.tracePath); err != nil {
+			return replay.Stats{}, err
+		}
+	}
+	stats, err := replayer.Run(input)
+	if replayer.Trace != nil {
+		if err := replayer.Trace.Close(); err != nil {
+			log.Println("Failed to write trace:", err)
+		}
+	}
+	if *o.reportPath != "" {
+		if err := writeReport(*o.reportPath, flags, stats); err != nil {
+			log.Println("Failed to write report:", err)
+		}
+	}
+	return stats, err
+}
+
+// secretFlags are left out of reports, which are often uploaded and shared.
+var secretFlags = map[string]bool{
+	"username": true, "password": true, "password-file": true, "i-know-what-im-doing": true,
+}
+
+// writeReport writes the replay's stats, along with the flags it was run with, as JSON to path.
+func writeReport(path string, flags *flag.FlagSet, stats replay.Stats) error {
+	settings := map[string]string{}
+	flags.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch {
+		case secretFlags[f.Name] && value != "":
+			value = "redacted"
+		case f.Name == "host":
+			value = connect.StripCredentials(value)
+		}
+		settings[f.Name] = value
+	})
+	report, err := json.MarshalIndent(struct {
+		replay.Stats
+		Settings map[string]string `json:"settings"`
+	}{stats, settings}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return pathio.Write(path, report)
 }
 
 // readerWithRetry gets a reader from the path, retrying if necessary.
@@ -60,12 +268,31 @@ func readerWithRetry(path string) (io.Reader, error) {
 
 }
 
-func getControllerFromTypeAndSpeed(ratetype string, speed float64) (ratecontroller.Controller, error) {
+// inputSize returns the size of the file at path, or 0 if it isn't a local regular file.
+func inputSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return 0
+	}
+	return info.Size()
+}
+
+func getControllerFromTypeAndSpeed(ratetype string, speed float64, maxGap time.Duration,
+	burstBytes, jitter float64, seed int64) (ratecontroller.Controller, error) {
+	if maxGap != 0 && ratetype != "relative" {
+		return nil, fmt.Errorf("max-gap only applies to 'relative' type replays")
+	}
 	if ratetype == "fixed" {
 		return fixed.New(speed), nil
 	} else if ratetype == "relative" {
-		return relative.New(speed), nil
+		return relative.NewWithMaxGap(speed, maxGap), nil
+	} else if ratetype == "bandwidth" {
+		return bandwidth.New(speed, burstBytes), nil
+	} else if ratetype == "poisson" {
+		return poisson.New(speed, seed), nil
+	} else if ratetype == "jittered" {
+		return poisson.NewJittered(speed, jitter, seed), nil
 	} else {
-		return nil, fmt.Errorf("Unknown type: " + ratetype)
+		return nil, fmt.Errorf("Unknown type: %s", ratetype)
 	}
 }
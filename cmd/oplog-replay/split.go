@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Clever/oplog-replay/split"
+	"github.com/Clever/pathio"
+)
+
+// splitDump splits an oplog dump into several, and writes a manifest of the parts.
+func splitDump(args []string) error {
+	flags := flag.NewFlagSet("split", flag.ExitOnError)
+	path := flags.String("path", "/dev/stdin", "Oplog file to split (local or s3://)")
+	out := flags.String("out", "", "Template for the path (local or s3://) of each part, e.g. 'out/{db}/{hour}.bson'. Placeholders are {ns}, {db}, {coll}, {group}, {date}, {hour}, {window} and {part}.")
+	groups := flags.String("group", "", "Named groups of namespace patterns to split by, e.g. 'people=app.users,app.profiles;logs=logs.*'. Ops no group matches are skipped. --out must use {group}.")
+	window := flags.Duration("window", 0, "Split into windows of this much oplog time, e.g. '10m'. --out must use {window}.")
+	maxBytes := flags.Int64("max-bytes", 0, "Start a new part before one gets bigger than this many bytes. --out must use {part}.")
+	maxOps := flags.Int("max-ops", 0, "Start a new part before one gets more than this many ops. --out must use {part}.")
+	manifestPath := flags.String("manifest", "", "Write a JSON manifest listing each part's ts range and op count to this path (local or s3://). Defaults to stdout.")
+	filterOpts := addFilterFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: oplog-replay split --out <template> [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *out == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	f, err := filterOpts.filter()
+	if err != nil {
+		return err
+	}
+	parsedGroups, err := split.ParseGroups(*groups)
+	if err != nil {
+		return err
+	}
+	input, err := readerWithRetry(*path)
+	if err != nil {
+		return err
+	}
+	manifest, err := split.Split(input, split.Options{
+		Path:     *out,
+		Window:   *window,
+		MaxBytes: *maxBytes,
+		MaxOps:   *maxOps,
+		Filter:   f,
+		Groups:   parsedGroups,
+	})
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if *manifestPath == "" {
+		fmt.Println(string(encoded))
+		return nil
+	}
+	return pathio.Write(*manifestPath, encoded)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Clever/oplog-replay/transform"
+	"github.com/Clever/oplog-replay/transform/amplify"
+	"github.com/Clever/oplog-replay/transform/commands"
+	"github.com/Clever/oplog-replay/transform/policy"
+	"github.com/Clever/oplog-replay/transform/rename"
+	"github.com/Clever/oplog-replay/transform/sample"
+	"github.com/Clever/oplog-replay/transform/scrub"
+	"github.com/Clever/oplog-replay/transform/timeshift"
+	"github.com/Clever/oplog-replay/transform/translate"
+	"github.com/Clever/pathio"
+)
+
+// transformOptions are the flags that configure how ops are rewritten.
+type transformOptions struct {
+	amplify         *int
+	amplifyFields   *string
+	amplifyID       *string
+	amplifyNs       *bool
+	commands        *string
+	allowCommands   *string
+	deleteAs        *string
+	insertAs        *string
+	softDeleteField *string
+	rename          *string
+	sample          *float64
+	scrubRules      *string
+	scrubSecretFile *string
+	timeShift       *string
+	timeShiftFields *string
+	timeShiftTypes  *string
+}
+
+// addTransformFlags defines the flags that configure how ops are rewritten in flags.
+func addTransformFlags(flags *flag.FlagSet) *transformOptions {
+	return &transformOptions{
+		amplify:         flags.Int("amplify", 1, "Apply each insert, update and delete this many times, with the _ids of the copies rewritten."),
+		amplifyFields:   flags.String("amplify-fields", "", "Comma separated '<ns>:<field>' holding ids to rewrite like the _ids in copies, e.g. 'app.orders:userId'."),
+		amplifyID:       flags.String("amplify-id", "objectid", "How ids are rewritten in copies: 'objectid', 'xor' or 'prefix'."),
+		amplifyNs:       flags.Bool("amplify-ns-suffix", false, "Send each copy to its own collection, with the copy number as a suffix, e.g. 'app.users_2'."),
+		commands:        flags.String("commands", "safe", "Which commands to replay: 'all', 'safe' (everything but commands that drop data, indexes or settings) or 'none'. Blocked commands are logged and skipped."),
+		allowCommands:   flags.String("allow-command", "", "Comma separated commands to replay whatever 'commands' is set to, e.g. 'drop,dropIndexes'."),
+		deleteAs:        flags.String("delete-as", "", "What to do with deletes: 'delete', 'skip' or 'soft'. Use '<ns>=skip' for a namespace and ';' between rules. Defaults to 'delete'."),
+		insertAs:        flags.String("insert-as", "", "What to do with inserts: 'insert' or 'upsert'. Use '<ns>=upsert' for a namespace and ';' between rules. Defaults to 'insert'."),
+		softDeleteField: flags.String("soft-delete-field", "_deleted", "Field soft deletes set to the time of the delete."),
+		rename:          flags.String("rename", "", "Comma separated databases or namespaces to rename, e.g. 'app=app_staging,logs.requests=logs.old'."),
+		sample:          flags.Float64("sample", 1, "Fraction of documents to replay the inserts, updates and deletes of, chosen by a hash of their namespace and _id."),
+		scrubRules:      flags.String("scrub-rules", "", "JSON file (local or s3://) of rules for dropping, nulling, hashing or faking fields. Rules use the namespaces from before any --rename."),
+		scrubSecretFile: flags.String("scrub-secret-file", "", "File (local or s3://) containing the secret for the HMAC used to hash and fake fields. Defaults to the OPLOG_REPLAY_SCRUB_SECRET environment variable."),
+		timeShift:       flags.String("time-shift", "", "Shift dates and ObjectId timestamps forward by this much (e.g. '2160h'), or by 'now' minus the time of the first op. Defaults to no shift."),
+		timeShiftFields: flags.String("time-shift-fields", "", "Comma separated '<ns>' or '<ns>:<field>' to shift, e.g. 'app.sessions:createdAt,logs.*'. Defaults to every field in every namespace."),
+		timeShiftTypes:  flags.String("time-shift-types", "date,objectid", "Comma separated types of values to shift: 'date' and 'objectid'."),
+	}
+}
+
+// stage returns the stages the replay pipeline applies to each op: the transforms the flags
+// describe, followed by the commands guard.
+func (o *transformOptions) stage() (transform.Stage, error) {
+	chain := transform.Chain{}
+	// Sample first, so documents are chosen by their _ids as recorded
+	if *o.sample != 1 {
+		sampler, err := sample.New(*o.sample)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, sampler)
+	}
+	if *o.deleteAs != "" || *o.insertAs != "" {
+		policy, err := o.policy()
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, policy)
+	}
+	if *o.scrubRules != "" {
+		scrubber, err := o.scrubber()
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, scrubber)
+	}
+	if *o.timeShift != "" {
+		shifter, err := o.shifter()
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, shifter)
+	}
+	if *o.amplify != 1 {
+		amplifier, err := o.amplifier()
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, amplifier)
+	}
+	if *o.rename != "" {
+		renamer, err := rename.New(splitList(*o.rename))
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, renamer)
+	}
+	if len(chain) > 0 {
+		// Stages find the fields an update changes in its modifiers, so diffs are turned into them
+		// first
+		chain = append(transform.Chain{translate.NewDiffConverter()}, chain...)
+	}
+	guard, err := commands.New(*o.commands, splitList(*o.allowCommands))
+	if err != nil {
+		return nil, err
+	}
+	return append(chain, guard), nil
+}
+
+func (o *transformOptions) policy() (*policy.Policy, error) {
+	deleteAs, err := policy.ParseRules(*o.deleteAs)
+	if err != nil {
+		return nil, err
+	}
+	insertAs, err := policy.ParseRules(*o.insertAs)
+	if err != nil {
+		return nil, err
+	}
+	return policy.New(policy.Options{DeleteAs: deleteAs, InsertAs: insertAs, SoftDeleteField: *o.softDeleteField})
+}
+
+func (o *transformOptions) scrubber() (*scrub.Scrubber, error) {
+	r, err := pathio.Reader(*o.scrubRules)
+	if err != nil {
+		return nil, err
+	}
+	rules, err := scrub.ParseRules(r)
+	if err != nil {
+		return nil, err
+	}
+	// The secret isn't taken as a flag, so it can't end up in reports or process listings
+	secret := os.Getenv("OPLOG_REPLAY_SCRUB_SECRET")
+	if *o.scrubSecretFile != "" {
+		if secret, err = readSecretFile(*o.scrubSecretFile); err != nil {
+			return nil, err
+		}
+	}
+	return scrub.New(rules, []byte(secret))
+}
+
+func (o *transformOptions) amplifier() (*amplify.Amplifier, error) {
+	fields := []amplify.Field{}
+	for _, spec := range splitList(*o.amplifyFields) {
+		field, err := amplify.ParseField(spec)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+	return amplify.New(*o.amplify, *o.amplifyID, fields, *o.amplifyNs)
+}
+
+func (o *transformOptions) shifter() (*timeshift.Shifter, error) {
+	rules := []timeshift.Rule{}
+	for _, spec := range splitList(*o.timeShiftFields) {
+		rule, err := timeshift.ParseRule(spec)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	dates, objectIDs := false, false
+	for _, t := range splitList(*o.timeShiftTypes) {
+		switch t {
+		case "date":
+			dates = true
+		case "objectid":
+			objectIDs = true
+		default:
+			return nil, fmt.Errorf("Unknown time shift type: %s", t)
+		}
+	}
+	if *o.timeShift == "now" {
+		return timeshift.NewSinceStart(rules, dates, objectIDs), nil
+	}
+	offset, err := time.ParseDuration(*o.timeShift)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid time shift %q: %s", *o.timeShift, err)
+	}
+	return timeshift.New(offset, rules, dates, objectIDs), nil
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Clever/oplog-replay/analyze"
+)
+
+// stats summarizes what's in an oplog dump without replaying it.
+func stats(args []string) error {
+	flags := flag.NewFlagSet("stats", flag.ExitOnError)
+	path := flags.String("path", "/dev/stdin", "Oplog file to analyze")
+	format := flags.String("format", "text", "Output format. Valid options are 'text' and 'json'.")
+	topKeys := flags.Int("top-keys", 10, "How many of the most frequently updated _ids to list.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: oplog-replay stats [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("Unknown format: %s", *format)
+	}
+	if *topKeys < 0 {
+		flags.Usage()
+		return fmt.Errorf("--top-keys can't be negative: %d", *topKeys)
+	}
+
+	input, err := readerWithRetry(*path)
+	if err != nil {
+		return err
+	}
+	summary, err := analyze.Scan(input, *topKeys)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		out, err := json.MarshalIndent(summary, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(out))
+		return nil
+	}
+	summary.WriteTable(os.Stdout)
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Clever/oplog-replay/trace"
+)
+
+// traceDiff compares two traces written with --trace, and summarizes which ops got slower.
+func traceDiff(args []string) error {
+	flags := flag.NewFlagSet("trace-diff", flag.ExitOnError)
+	top := flags.Int("top", 20, "How many of the largest regressions to list.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: oplog-replay trace-diff [flags] <base trace> <other trace>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	base, err := trace.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer base.Close()
+	other, err := trace.Open(flags.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer other.Close()
+
+	diff, err := trace.Compare(base, other, *top)
+	if err != nil {
+		return err
+	}
+	diff.WriteSummary(os.Stdout)
+	return nil
+}
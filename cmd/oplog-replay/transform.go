@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	bsonScanner "github.com/Clever/oplog-replay/bson"
+	"github.com/Clever/oplog-replay/extjson"
+	"github.com/Clever/oplog-replay/transform"
+	"github.com/Clever/pathio"
+	"labix.org/v2/mgo/bson"
+)
+
+// transformDump filters and rewrites an oplog dump like a replay would, and writes the result to
+// a new dump instead of a host.
+func transformDump(args []string) error {
+	flags := flag.NewFlagSet("transform", flag.ExitOnError)
+	path := flags.String("path", "/dev/stdin", "Oplog file to transform (local or s3://)")
+	out := flags.String("out", "", "Path (local or s3://) to write the transformed oplog to.")
+	format := flags.String("format", "", "Output format. Valid options are 'bson' and 'jsonl' (canonical Extended JSON). Defaults to 'jsonl' if --out ends in '.jsonl' or '.json', and 'bson' otherwise.")
+	filterOpts := addFilterFlags(flags)
+	transformOpts := addTransformFlags(flags)
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: oplog-replay transform --out <path> [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if *out == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *format == "" {
+		*format = "bson"
+		if strings.HasSuffix(*out, ".jsonl") || strings.HasSuffix(*out, ".json") {
+			*format = "jsonl"
+		}
+	}
+	if *format != "bson" && *format != "jsonl" {
+		return fmt.Errorf("Unknown format: %s", *format)
+	}
+
+	f, err := filterOpts.filter()
+	if err != nil {
+		return err
+	}
+	stage, err := transformOpts.stage()
+	if err != nil {
+		return err
+	}
+	input, err := readerWithRetry(*path)
+	if err != nil {
+		return err
+	}
+
+	// Writing to S3 needs the length up front, so the output is spooled to a local file first
+	spool, err := ioutil.TempFile("", "oplog-replay-transform")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	w := bufio.NewWriter(spool)
+
+	read, written := 0, 0
+	scanner := bsonScanner.New(input)
+	for scanner.Scan() {
+		op, err := transform.Decode(scanner.Bytes())
+		if err != nil {
+			return err
+		}
+		read++
+		if !f.Match(op) {
+			continue
+		}
+		ops, err := stage.Apply(op)
+		if err != nil {
+			return err
+		}
+		for _, op := range ops {
+			// Like a replay, skip ops without a namespace, e.g. no-ops
+			if op["ns"] == "" {
+				continue
+			}
+			if err := writeOp(w, op, scanner.Bytes(), *format); err != nil {
+				return err
+			}
+			written++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	size, err := spool.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return err
+	}
+	if _, err := spool.Seek(0, os.SEEK_SET); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(*out, "s3://") {
+		if err := os.MkdirAll(filepath.Dir(*out), 0755); err != nil {
+			return err
+		}
+	}
+	if err := pathio.WriteReader(*out, spool, size); err != nil {
+		return err
+	}
+	log.Printf("Read %d ops, wrote %d to %s", read, written, *out)
+	logReport(stage)
+	return nil
+}
+
+// writeOp writes an op as BSON, or as a line of canonical Extended JSON. Its fields keep the order
+// they have in the entry it was read from.
+func writeOp(w *bufio.Writer, op map[string]interface{}, template []byte, format string) error {
+	raw, err := transform.Encode(op, template)
+	if err != nil {
+		return err
+	}
+	if format == "bson" {
+		_, err := w.Write(raw)
+		return err
+	}
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return err
+	}
+	line, err := extjson.Marshal(doc, extjson.Canonical)
+	if err != nil {
+		return err
+	}
+	w.Write(line)
+	return w.WriteByte('\n')
+}
+
+// logReport logs a transform stage's summary, if it has one.
+func logReport(stage transform.Stage) {
+	if reporter, ok := stage.(transform.Reporter); ok {
+		if report := reporter.Report(); report != "" {
+			log.Println(report)
+		}
+	}
+}
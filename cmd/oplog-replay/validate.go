@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/Clever/oplog-replay/replay"
+	"github.com/Clever/oplog-replay/validate"
+)
+
+// validateDump checks that an oplog dump is well formed, printing every problem found, and exits
+// with status 1 if any are at least as bad as --fail-on.
+func validateDump(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	path := flags.String("path", "/dev/stdin", "Oplog file to validate (local or s3://)")
+	maxHashes := flags.Int("max-hashes", validate.DefaultMaxHashes, "How many h values to remember to find duplicates across the whole dump. Each takes about 40 bytes.")
+	failOn := flags.String("fail-on", "error", "Exit with status 1 if there are problems of this severity or worse. Valid options are 'warning' and 'error'.")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: oplog-replay validate [flags]\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	threshold, err := validate.ParseSeverity(*failOn)
+	if err != nil {
+		return err
+	}
+
+	input, err := readerWithRetry(*path)
+	if err != nil {
+		return err
+	}
+	result, err := validate.Validate(input, *maxHashes, func(p validate.Problem) {
+		fmt.Println(p)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Checked %d entries (%s): %d errors, %d warnings\n",
+		result.Entries, replay.FormatBytes(result.Bytes), result.Errors, result.Warnings)
+	if result.UntrackedHashes > 0 {
+		fmt.Printf("Only checked for duplicates of the first %d h values: raise --max-hashes to check the other %d\n",
+			*maxHashes, result.UntrackedHashes)
+	}
+	if worst, any := result.Worst(); any && worst >= threshold {
+		os.Exit(1)
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+// Package extjson writes BSON documents as MongoDB Extended JSON (v2), so oplog entries can be
+// read without the Mongo tools.
+package extjson
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Mode is a flavor of Extended JSON.
+type Mode int
+
+const (
+	// Relaxed writes numbers and most dates as plain JSON, losing some type information.
+	Relaxed Mode = iota
+	// Canonical keeps the exact BSON type of every value.
+	Canonical
+)
+
+// ParseMode parses "relaxed" or "canonical".
+func ParseMode(name string) (Mode, error) {
+	switch name {
+	case "relaxed":
+		return Relaxed, nil
+	case "canonical":
+		return Canonical, nil
+	}
+	return 0, fmt.Errorf("Unknown Extended JSON mode: %s", name)
+}
+
+// Marshal returns doc as Extended JSON. Documents should be decoded into a bson.D to keep their
+// fields in order.
+func Marshal(doc bson.D, mode Mode) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := writeValue(&buf, doc, mode); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeValue(buf *bytes.Buffer, v interface{}, mode Mode) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case string:
+		writeString(buf, v)
+	case int:
+		if mode == Canonical {
+			fmt.Fprintf(buf, `{"$numberInt":"%d"}`, v)
+		} else {
+			buf.WriteString(strconv.Itoa(v))
+		}
+	case int64:
+		if mode == Canonical {
+			fmt.Fprintf(buf, `{"$numberLong":"%d"}`, v)
+		} else {
+			buf.WriteString(strconv.FormatInt(v, 10))
+		}
+	case float64:
+		writeFloat(buf, v, mode)
+	case bson.D:
+		buf.WriteByte('{')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeString(buf, elem.Name)
+			buf.WriteByte(':')
+			if err := writeValue(buf, elem.Value, mode); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case bson.M:
+		// Only the scopes of JavaScript values are decoded as maps, and their order is lost
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		doc := bson.D{}
+		for _, key := range keys {
+			doc = append(doc, bson.DocElem{Name: key, Value: v[key]})
+		}
+		return writeValue(buf, doc, mode)
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, elem := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeValue(buf, elem, mode); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case bson.ObjectId:
+		fmt.Fprintf(buf, `{"$oid":"%s"}`, v.Hex())
+	case []byte:
+		writeBinary(buf, 0x00, v)
+	case bson.Binary:
+		writeBinary(buf, v.Kind, v.Data)
+	case time.Time:
+		ms := v.Unix()*1000 + int64(v.Nanosecond()/1e6)
+		if mode == Relaxed && v.Year() >= 1970 && v.Year() <= 9999 {
+			fmt.Fprintf(buf, `{"$date":"%s"}`, v.UTC().Format("2006-01-02T15:04:05.999Z07:00"))
+		} else {
+			fmt.Fprintf(buf, `{"$date":{"$numberLong":"%d"}}`, ms)
+		}
+	case bson.MongoTimestamp:
+		fmt.Fprintf(buf, `{"$timestamp":{"t":%d,"i":%d}}`, uint32(v>>32), uint32(v))
+	case bson.RegEx:
+		buf.WriteString(`{"$regularExpression":{"pattern":`)
+		writeString(buf, v.Pattern)
+		buf.WriteString(`,"options":`)
+		writeString(buf, v.Options)
+		buf.WriteString("}}")
+	case bson.JavaScript:
+		buf.WriteString(`{"$code":`)
+		writeString(buf, v.Code)
+		if v.Scope != nil {
+			buf.WriteString(`,"$scope":`)
+			if err := writeValue(buf, v.Scope, mode); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case bson.Symbol:
+		buf.WriteString(`{"$symbol":`)
+		writeString(buf, string(v))
+		buf.WriteByte('}')
+	default:
+		switch v {
+		case bson.MinKey:
+			buf.WriteString(`{"$minKey":1}`)
+		case bson.MaxKey:
+			buf.WriteString(`{"$maxKey":1}`)
+		case bson.Undefined:
+			buf.WriteString(`{"$undefined":true}`)
+		default:
+			return fmt.Errorf("Can't write %T as Extended JSON", v)
+		}
+	}
+	return nil
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	// Marshaling a string can't fail
+	encoded, _ := json.Marshal(s)
+	buf.Write(encoded)
+}
+
+func writeFloat(buf *bytes.Buffer, f float64, mode Mode) {
+	var s string
+	switch {
+	case math.IsNaN(f):
+		s = "NaN"
+	case math.IsInf(f, 1):
+		s = "Infinity"
+	case math.IsInf(f, -1):
+		s = "-Infinity"
+	default:
+		s = strconv.FormatFloat(f, 'G', -1, 64)
+		if !strings.ContainsAny(s, ".EN") {
+			s += ".0"
+		}
+		if mode == Relaxed {
+			buf.WriteString(s)
+			return
+		}
+	}
+	fmt.Fprintf(buf, `{"$numberDouble":"%s"}`, s)
+}
+
+func writeBinary(buf *bytes.Buffer, kind byte, data []byte) {
+	fmt.Fprintf(buf, `{"$binary":{"base64":"%s","subType":"%02x"}}`, base64.StdEncoding.EncodeToString(data), kind)
+}
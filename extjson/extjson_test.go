@@ -0,0 +1,81 @@
+package extjson
+
+import (
+	"encoding/json"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestMarshal(t *testing.T) {
+	date := time.Date(2015, 10, 16, 12, 53, 20, 123e6, time.UTC)
+	tests := []struct {
+		value              interface{}
+		relaxed, canonical string
+	}{
+		{nil, `null`, `null`},
+		{true, `true`, `true`},
+		{"a\"b", `"a\"b"`, `"a\"b"`},
+		{1, `1`, `{"$numberInt":"1"}`},
+		{int64(1) << 40, `1099511627776`, `{"$numberLong":"1099511627776"}`},
+		{1.0, `1.0`, `{"$numberDouble":"1.0"}`},
+		{-1.5, `-1.5`, `{"$numberDouble":"-1.5"}`},
+		{1e300, `1E+300`, `{"$numberDouble":"1E+300"}`},
+		{math.Inf(-1), `{"$numberDouble":"-Infinity"}`, `{"$numberDouble":"-Infinity"}`},
+		{math.NaN(), `{"$numberDouble":"NaN"}`, `{"$numberDouble":"NaN"}`},
+		{bson.ObjectIdHex("5392478b53a5b29c16f834f2"), `{"$oid":"5392478b53a5b29c16f834f2"}`, `{"$oid":"5392478b53a5b29c16f834f2"}`},
+		{[]byte("hi"), `{"$binary":{"base64":"aGk=","subType":"00"}}`, `{"$binary":{"base64":"aGk=","subType":"00"}}`},
+		{bson.Binary{Kind: 0x04, Data: []byte("hi")}, `{"$binary":{"base64":"aGk=","subType":"04"}}`, `{"$binary":{"base64":"aGk=","subType":"04"}}`},
+		{date, `{"$date":"2015-10-16T12:53:20.123Z"}`, `{"$date":{"$numberLong":"1445000000123"}}`},
+		{bson.MongoTimestamp(1445000000<<32 | 3), `{"$timestamp":{"t":1445000000,"i":3}}`, `{"$timestamp":{"t":1445000000,"i":3}}`},
+		{bson.RegEx{Pattern: "^a", Options: "i"}, `{"$regularExpression":{"pattern":"^a","options":"i"}}`, `{"$regularExpression":{"pattern":"^a","options":"i"}}`},
+		{bson.JavaScript{Code: "f()"}, `{"$code":"f()"}`, `{"$code":"f()"}`},
+		{bson.JavaScript{Code: "f()", Scope: bson.M{"b": 1, "a": 2}}, `{"$code":"f()","$scope":{"a":2,"b":1}}`, `{"$code":"f()","$scope":{"a":{"$numberInt":"2"},"b":{"$numberInt":"1"}}}`},
+		{bson.Symbol("s"), `{"$symbol":"s"}`, `{"$symbol":"s"}`},
+		{bson.MinKey, `{"$minKey":1}`, `{"$minKey":1}`},
+		{bson.MaxKey, `{"$maxKey":1}`, `{"$maxKey":1}`},
+		{bson.Undefined, `{"$undefined":true}`, `{"$undefined":true}`},
+		{[]interface{}{1, "a"}, `[1,"a"]`, `[{"$numberInt":"1"},"a"]`},
+		{bson.D{{Name: "z", Value: 1}, {Name: "a", Value: bson.D{}}}, `{"z":1,"a":{}}`, `{"z":{"$numberInt":"1"},"a":{}}`},
+	}
+	for _, test := range tests {
+		doc := bson.D{{Name: "v", Value: test.value}}
+		relaxed, err := Marshal(doc, Relaxed)
+		assert.Nil(t, err)
+		assert.Equal(t, `{"v":`+test.relaxed+`}`, string(relaxed))
+		canonical, err := Marshal(doc, Canonical)
+		assert.Nil(t, err)
+		assert.Equal(t, `{"v":`+test.canonical+`}`, string(canonical))
+		var decoded interface{}
+		assert.Nil(t, json.Unmarshal(canonical, &decoded), string(canonical))
+	}
+
+	_, err := Marshal(bson.D{{Name: "v", Value: struct{}{}}}, Relaxed)
+	assert.NotNil(t, err)
+}
+
+func TestMarshalDecoded(t *testing.T) {
+	// Round trip through BSON, since that's where the documents come from
+	raw, err := bson.Marshal(bson.D{
+		{Name: "ts", Value: bson.MongoTimestamp(1445000000<<32 | 1)},
+		{Name: "op", Value: "i"},
+		{Name: "o", Value: bson.D{{Name: "_id", Value: bson.ObjectIdHex("5392478b53a5b29c16f834f2")}, {Name: "n", Value: int64(5)}}},
+	})
+	assert.Nil(t, err)
+	var doc bson.D
+	assert.Nil(t, bson.Unmarshal(raw, &doc))
+	out, err := Marshal(doc, Relaxed)
+	assert.Nil(t, err)
+	assert.Equal(t, `{"ts":{"$timestamp":{"t":1445000000,"i":1}},"op":"i","o":{"_id":{"$oid":"5392478b53a5b29c16f834f2"},"n":5}}`, string(out))
+}
+
+func TestParseMode(t *testing.T) {
+	mode, err := ParseMode("canonical")
+	assert.Nil(t, err)
+	assert.Equal(t, Canonical, mode)
+	_, err = ParseMode("shell")
+	assert.NotNil(t, err)
+}
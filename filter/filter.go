@@ -0,0 +1,125 @@
+// Package filter selects which oplog entries to replay or inspect.
+package filter
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Filter matches oplog entries by namespace, op type and timestamp. A nil Filter matches every
+// entry.
+type Filter struct {
+	namespaces []string
+	ops        []opsRule
+	from, to   bson.MongoTimestamp
+}
+
+// OpsRule selects the op types to match in the namespaces matching a pattern.
+type OpsRule struct {
+	// Ns is the namespace the rule applies to. Patterns like "app.*" are allowed, and an empty Ns
+	// applies to every namespace. Commands are in "<db>.$cmd".
+	Ns string
+	// Ops are the op types to match, e.g. "i" and "u".
+	Ops []string
+}
+
+type opsRule struct {
+	ns  string
+	ops map[string]bool
+}
+
+var opTypes = map[string]bool{"i": true, "u": true, "d": true, "c": true, "n": true}
+
+// ParseOps parses semicolon separated rules given as "[<ns>=]<op types>", e.g. "logs.*=i;i,u,d".
+func ParseOps(spec string) ([]OpsRule, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	rules := []OpsRule{}
+	for _, rule := range strings.Split(spec, ";") {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) == 1 {
+			parts = []string{"", parts[0]}
+		}
+		if parts[1] == "" {
+			return nil, fmt.Errorf("Invalid op types %q: expected [<ns>=]<op types>", rule)
+		}
+		rules = append(rules, OpsRule{Ns: parts[0], Ops: strings.Split(parts[1], ",")})
+	}
+	return rules, nil
+}
+
+// New returns a Filter that matches entries whose namespace matches any of the namespaces
+// patterns, whose op type is in the first of the ops rules that matches their namespace, and
+// whose ts is between from and to inclusive. Namespace patterns use path.Match syntax, e.g.
+// "app.*". Empty namespaces or ops, or a zero from or to, match everything, as do namespaces no
+// ops rule matches.
+func New(namespaces []string, ops []OpsRule, from, to bson.MongoTimestamp) (*Filter, error) {
+	for _, pattern := range namespaces {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("Invalid namespace pattern %q: %s", pattern, err)
+		}
+	}
+	f := &Filter{namespaces: namespaces, from: from, to: to}
+	for _, rule := range ops {
+		if _, err := path.Match(rule.Ns, ""); err != nil {
+			return nil, fmt.Errorf("Invalid namespace pattern %q: %s", rule.Ns, err)
+		}
+		types := map[string]bool{}
+		for _, op := range rule.Ops {
+			if !opTypes[op] {
+				return nil, fmt.Errorf("Unknown op type %q", op)
+			}
+			types[op] = true
+		}
+		f.ops = append(f.ops, opsRule{ns: rule.Ns, ops: types})
+	}
+	return f, nil
+}
+
+// Match returns whether the entry passes the filter.
+func (f *Filter) Match(op map[string]interface{}) bool {
+	if f == nil {
+		return true
+	}
+	ns, _ := op["ns"].(string)
+	for _, rule := range f.ops {
+		if matches(rule.ns, ns) {
+			opType, _ := op["op"].(string)
+			if !rule.ops[opType] {
+				return false
+			}
+			break
+		}
+	}
+	if len(f.namespaces) > 0 {
+		matched := false
+		for _, pattern := range f.namespaces {
+			if matches(pattern, ns) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if f.from != 0 || f.to != 0 {
+		ts, _ := op["ts"].(bson.MongoTimestamp)
+		if ts < f.from || (f.to != 0 && ts > f.to) {
+			return false
+		}
+	}
+	return true
+}
+
+func matches(pattern, ns string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, ns)
+	return matched
+}
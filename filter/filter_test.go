@@ -0,0 +1,82 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func op(ns, opType string, seconds int64) map[string]interface{} {
+	return map[string]interface{}{"ns": ns, "op": opType, "ts": bson.MongoTimestamp(seconds << 32)}
+}
+
+func TestNilFilter(t *testing.T) {
+	var f *Filter
+	assert.True(t, f.Match(op("app.users", "i", 1)))
+}
+
+func TestNamespaces(t *testing.T) {
+	f, err := New([]string{"app.users", "logs.*"}, nil, 0, 0)
+	assert.Nil(t, err)
+	assert.True(t, f.Match(op("app.users", "i", 1)))
+	assert.True(t, f.Match(op("logs.requests", "i", 1)))
+	assert.False(t, f.Match(op("app.orders", "i", 1)))
+	assert.False(t, f.Match(op("", "n", 1)))
+
+	_, err = New([]string{"app.[users"}, nil, 0, 0)
+	assert.NotNil(t, err)
+}
+
+func TestOps(t *testing.T) {
+	f, err := New(nil, []OpsRule{{Ops: []string{"u", "d"}}}, 0, 0)
+	assert.Nil(t, err)
+	assert.True(t, f.Match(op("app.users", "u", 1)))
+	assert.True(t, f.Match(op("app.users", "d", 1)))
+	assert.False(t, f.Match(op("app.users", "i", 1)))
+
+	_, err = New(nil, []OpsRule{{Ops: []string{"i", "x"}}}, 0, 0)
+	assert.NotNil(t, err)
+}
+
+func TestParseOps(t *testing.T) {
+	rules, err := ParseOps("logs.*=i;i,u")
+	assert.Nil(t, err)
+	assert.Equal(t, []OpsRule{{Ns: "logs.*", Ops: []string{"i"}}, {Ns: "", Ops: []string{"i", "u"}}}, rules)
+	rules, err = ParseOps("")
+	assert.Nil(t, err)
+	assert.Nil(t, rules)
+	for _, spec := range []string{"app.users=", "i;"} {
+		_, err := ParseOps(spec)
+		assert.NotNil(t, err, spec)
+	}
+	_, err = New(nil, []OpsRule{{Ns: "app.[", Ops: []string{"i"}}}, 0, 0)
+	assert.NotNil(t, err)
+}
+
+func TestOpsPerNamespace(t *testing.T) {
+	rules, err := ParseOps("logs.*=i;app.*=i,u")
+	assert.Nil(t, err)
+	f, err := New(nil, rules, 0, 0)
+	assert.Nil(t, err)
+	assert.True(t, f.Match(op("app.users", "u", 1)))
+	assert.False(t, f.Match(op("app.users", "d", 1)))
+	assert.True(t, f.Match(op("logs.requests", "i", 1)))
+	assert.False(t, f.Match(op("logs.requests", "u", 1)))
+	// Namespaces no rule matches keep every op type
+	assert.True(t, f.Match(op("other.things", "d", 1)))
+}
+
+func TestTimestamps(t *testing.T) {
+	f, err := New(nil, nil, bson.MongoTimestamp(10<<32), bson.MongoTimestamp(20<<32))
+	assert.Nil(t, err)
+	assert.False(t, f.Match(op("app.users", "i", 9)))
+	assert.True(t, f.Match(op("app.users", "i", 10)))
+	assert.True(t, f.Match(op("app.users", "i", 20)))
+	assert.False(t, f.Match(op("app.users", "i", 21)))
+
+	// Without a "to" there's no upper bound
+	f, err = New(nil, nil, bson.MongoTimestamp(10<<32), 0)
+	assert.Nil(t, err)
+	assert.True(t, f.Match(op("app.users", "i", 1<<30)))
+}
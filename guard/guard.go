@@ -0,0 +1,176 @@
+// Package guard checks the server a replay would write to, so oplogs aren't replayed onto
+// production by mistake.
+package guard
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Server runs commands against the admin database. *mgo.Session is a Server.
+type Server interface {
+	Run(cmd interface{}, result interface{}) error
+}
+
+// Target describes a server.
+type Target struct {
+	// SetName is the name of the replica set, or "" if the server isn't in one.
+	SetName string
+	// Hosts are the host:ports of the server and the other members of its replica set.
+	Hosts []string
+	// Databases are the names of the databases on the server.
+	Databases []string
+}
+
+// Name is the name of the target users have to confirm: the replica set name, or the host if it
+// isn't in one.
+func (t Target) Name() string {
+	if t.SetName != "" || len(t.Hosts) == 0 {
+		return t.SetName
+	}
+	return t.Hosts[0]
+}
+
+// Describe asks the server what it is with hello (or isMaster on servers too old for it),
+// replSetGetStatus and listDatabases.
+func Describe(server Server) (Target, error) {
+	var hello struct {
+		SetName  string   `bson:"setName"`
+		Me       string   `bson:"me"`
+		Hosts    []string `bson:"hosts"`
+		Passives []string `bson:"passives"`
+		Arbiters []string `bson:"arbiters"`
+	}
+	if err := server.Run("hello", &hello); err != nil {
+		if err := server.Run("isMaster", &hello); err != nil {
+			return Target{}, fmt.Errorf("Couldn't run isMaster: %s", err)
+		}
+	}
+	hosts := map[string]bool{}
+	for _, list := range [][]string{{hello.Me}, hello.Hosts, hello.Passives, hello.Arbiters} {
+		for _, host := range list {
+			hosts[host] = true
+		}
+	}
+
+	if hello.SetName != "" {
+		var status struct {
+			Members []struct {
+				Name string `bson:"name"`
+			} `bson:"members"`
+		}
+		if err := server.Run("replSetGetStatus", &status); err != nil {
+			return Target{}, fmt.Errorf("Couldn't run replSetGetStatus: %s", err)
+		}
+		for _, member := range status.Members {
+			hosts[member.Name] = true
+		}
+	}
+
+	var databases struct {
+		Databases []struct {
+			Name string `bson:"name"`
+		} `bson:"databases"`
+	}
+	if err := server.Run("listDatabases", &databases); err != nil {
+		return Target{}, fmt.Errorf("Couldn't run listDatabases: %s", err)
+	}
+
+	target := Target{SetName: hello.SetName}
+	for host := range hosts {
+		if host != "" {
+			target.Hosts = append(target.Hosts, host)
+		}
+	}
+	sort.Strings(target.Hosts)
+	for _, db := range databases.Databases {
+		target.Databases = append(target.Databases, db.Name)
+	}
+	return target, nil
+}
+
+// systemDatabases are on every server, so they aren't checked.
+var systemDatabases = map[string]bool{"admin": true, "local": true, "config": true}
+
+// Rules are patterns, like "*prod*", for the replica set names, hosts and databases a replay may
+// write to. Patterns use path.Match syntax and are matched case insensitively. A target is
+// refused if anything about it matches a Deny pattern, or if there are Allow patterns and
+// something doesn't match any of them.
+type Rules struct {
+	AllowSets, DenySets           []string
+	AllowHosts, DenyHosts         []string
+	AllowDatabases, DenyDatabases []string
+}
+
+// Check returns the reasons the target is refused, if any.
+func (r Rules) Check(target Target) ([]string, error) {
+	problems := []string{}
+	check := func(kind, name string, allow, deny []string) error {
+		if pattern, err := match(deny, name); err != nil {
+			return err
+		} else if pattern != "" {
+			problems = append(problems, fmt.Sprintf("%s %q matches denied pattern %q", kind, name, pattern))
+			return nil
+		}
+		if len(allow) == 0 {
+			return nil
+		}
+		if pattern, err := match(allow, name); err != nil {
+			return err
+		} else if pattern == "" {
+			problems = append(problems, fmt.Sprintf("%s %q doesn't match any allowed pattern", kind, name))
+		}
+		return nil
+	}
+
+	if err := check("Replica set", target.SetName, r.AllowSets, r.DenySets); err != nil {
+		return nil, err
+	}
+	for _, host := range target.Hosts {
+		if err := check("Host", host, r.AllowHosts, r.DenyHosts); err != nil {
+			return nil, err
+		}
+	}
+	for _, db := range target.Databases {
+		if systemDatabases[db] {
+			continue
+		}
+		if err := check("Database", db, r.AllowDatabases, r.DenyDatabases); err != nil {
+			return nil, err
+		}
+	}
+	return problems, nil
+}
+
+// match returns the first of the patterns that name matches, or "" if none do.
+func match(patterns []string, name string) (string, error) {
+	for _, pattern := range patterns {
+		matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(name))
+		if err != nil {
+			return "", fmt.Errorf("Invalid pattern %q: %s", pattern, err)
+		}
+		if matched {
+			return pattern, nil
+		}
+	}
+	return "", nil
+}
+
+// Confirm asks the user to type the target's name to confirm replaying onto it, returning an
+// error unless they do.
+func Confirm(target Target, r io.Reader, w io.Writer) error {
+	fmt.Fprintf(w, "Replaying onto %s (hosts %s). Type %q to continue: ",
+		target.Name(), strings.Join(target.Hosts, ", "), target.Name())
+	answer, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	if strings.TrimSpace(answer) != target.Name() {
+		return fmt.Errorf("Replay onto %s not confirmed", target.Name())
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package guard
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+// fakeServer answers commands with canned responses.
+type fakeServer map[string]bson.M
+
+func (s fakeServer) Run(cmd interface{}, result interface{}) error {
+	response, ok := s[cmd.(string)]
+	if !ok {
+		return fmt.Errorf("no such cmd: %s", cmd)
+	}
+	raw, err := bson.Marshal(response)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, result)
+}
+
+var databases = bson.M{"databases": []bson.M{{"name": "admin"}, {"name": "local"}, {"name": "app"}}}
+
+func TestDescribeReplicaSet(t *testing.T) {
+	target, err := Describe(fakeServer{
+		"hello": {"setName": "staging", "me": "db1:27017", "hosts": []string{"db1:27017", "db2:27017"},
+			"arbiters": []string{"arb:27017"}},
+		"replSetGetStatus": {"members": []bson.M{{"name": "db1:27017"}, {"name": "hidden:27017"}}},
+		"listDatabases":    databases,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, Target{
+		SetName:   "staging",
+		Hosts:     []string{"arb:27017", "db1:27017", "db2:27017", "hidden:27017"},
+		Databases: []string{"admin", "local", "app"},
+	}, target)
+	assert.Equal(t, "staging", target.Name())
+}
+
+func TestDescribeStandalone(t *testing.T) {
+	// Old servers don't have hello, and standalones don't have replSetGetStatus
+	target, err := Describe(fakeServer{
+		"isMaster":      {"ismaster": true},
+		"listDatabases": databases,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, Target{Databases: []string{"admin", "local", "app"}}, target)
+
+	target.Hosts = []string{"localhost:27017"}
+	assert.Equal(t, "localhost:27017", target.Name())
+}
+
+func TestDescribeErrors(t *testing.T) {
+	_, err := Describe(fakeServer{"listDatabases": databases})
+	assert.NotNil(t, err)
+	_, err = Describe(fakeServer{"hello": {"setName": "staging"}, "listDatabases": databases})
+	assert.NotNil(t, err)
+	_, err = Describe(fakeServer{"hello": {}})
+	assert.NotNil(t, err)
+}
+
+func TestCheck(t *testing.T) {
+	target := Target{
+		SetName:   "staging-rs",
+		Hosts:     []string{"db1.staging:27017", "db2.staging:27017"},
+		Databases: []string{"admin", "app", "reports"},
+	}
+	for _, test := range []struct {
+		rules    Rules
+		problems []string
+	}{
+		{Rules{}, []string{}},
+		{Rules{DenySets: []string{"*PROD*"}, DenyHosts: []string{"*prod*"}}, []string{}},
+		{Rules{DenySets: []string{"staging*"}}, []string{`Replica set "staging-rs" matches denied pattern "staging*"`}},
+		{Rules{AllowSets: []string{"dev*"}}, []string{`Replica set "staging-rs" doesn't match any allowed pattern`}},
+		{Rules{AllowHosts: []string{"db1.*"}}, []string{`Host "db2.staging:27017" doesn't match any allowed pattern`}},
+		{Rules{DenyHosts: []string{"db2.*"}, AllowHosts: []string{"*"}}, []string{`Host "db2.staging:27017" matches denied pattern "db2.*"`}},
+		// admin, local and config aren't checked
+		{Rules{AllowDatabases: []string{"app"}}, []string{`Database "reports" doesn't match any allowed pattern`}},
+		{Rules{DenyDatabases: []string{"a*"}}, []string{`Database "app" matches denied pattern "a*"`}},
+	} {
+		problems, err := test.rules.Check(target)
+		assert.Nil(t, err)
+		assert.Equal(t, test.problems, problems, fmt.Sprintf("%+v", test.rules))
+	}
+
+	_, err := Rules{DenyHosts: []string{"["}}.Check(target)
+	assert.NotNil(t, err)
+}
+
+func TestConfirm(t *testing.T) {
+	target := Target{SetName: "staging", Hosts: []string{"db1:27017"}}
+	out := &bytes.Buffer{}
+	assert.Nil(t, Confirm(target, strings.NewReader("staging\n"), out))
+	assert.Equal(t, `Replaying onto staging (hosts db1:27017). Type "staging" to continue: `, out.String())
+	assert.NotNil(t, Confirm(target, strings.NewReader("yes\n"), out))
+	assert.NotNil(t, Confirm(target, strings.NewReader(""), out))
+}
@@ -0,0 +1,147 @@
+// Package histogram records distributions of non-negative values, like latencies or sizes, in a
+// fixed amount of memory. Values are grouped into buckets that are at most 1/16th (~6%) as wide
+// as the values in them, so quantiles are accurate to within that much.
+package histogram
+
+import "math"
+
+const (
+	subBucketBits = 4
+	subBuckets    = 1 << subBucketBits
+	numBuckets    = 64 * subBuckets
+)
+
+// Histogram is a distribution of int64 values. The zero value is not usable; use New.
+type Histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+	min    int64
+	max    int64
+}
+
+// New returns an empty Histogram.
+func New() *Histogram {
+	return &Histogram{counts: make([]int64, numBuckets)}
+}
+
+// bitLength returns the number of bits needed to represent v.
+func bitLength(v int64) uint {
+	n := uint(0)
+	for ; v > 0; v >>= 1 {
+		n++
+	}
+	return n
+}
+
+// bucketIndex returns the bucket v belongs in. Values below subBuckets get a bucket each, and
+// every power of two above that is split into subBuckets buckets.
+func bucketIndex(v int64) int {
+	if v < subBuckets {
+		return int(v)
+	}
+	exponent := bitLength(v) - subBucketBits
+	return int(exponent)*subBuckets + int(v>>(exponent-1)&(subBuckets-1))
+}
+
+// bucketUpperBound returns the largest value that falls in the bucket.
+func bucketUpperBound(index int) int64 {
+	if index < subBuckets {
+		return int64(index)
+	}
+	exponent := uint(index / subBuckets)
+	sub := int64(index % subBuckets)
+	lower := (subBuckets + sub) << (exponent - 1)
+	return lower + (1 << (exponent - 1)) - 1
+}
+
+// Record adds a value to the histogram. Negative values are recorded as 0.
+func (h *Histogram) Record(v int64) {
+	if v < 0 {
+		v = 0
+	}
+	h.counts[bucketIndex(v)]++
+	if h.count == 0 || v < h.min {
+		h.min = v
+	}
+	if v > h.max {
+		h.max = v
+	}
+	h.count++
+	h.sum += float64(v)
+}
+
+// Merge adds all the values recorded in other to h.
+func (h *Histogram) Merge(other *Histogram) {
+	if other.count == 0 {
+		return
+	}
+	for i, c := range other.counts {
+		h.counts[i] += c
+	}
+	if h.count == 0 || other.min < h.min {
+		h.min = other.min
+	}
+	if other.max > h.max {
+		h.max = other.max
+	}
+	h.count += other.count
+	h.sum += other.sum
+}
+
+// Count returns the number of values recorded.
+func (h *Histogram) Count() int64 { return h.count }
+
+// Min returns the smallest value recorded, or 0 if there are none.
+func (h *Histogram) Min() int64 { return h.min }
+
+// Max returns the largest value recorded, or 0 if there are none.
+func (h *Histogram) Max() int64 { return h.max }
+
+// Sum returns the total of all values recorded.
+func (h *Histogram) Sum() float64 { return h.sum }
+
+// Mean returns the average of the values recorded, or 0 if there are none.
+func (h *Histogram) Mean() float64 {
+	if h.count == 0 {
+		return 0
+	}
+	return h.sum / float64(h.count)
+}
+
+// Quantile returns the value below which the fraction q (between 0 and 1) of recorded values
+// fall, e.g. Quantile(0.99) is the 99th percentile. It returns 0 if nothing has been recorded.
+func (h *Histogram) Quantile(q float64) int64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.count)))
+	if rank < 1 {
+		rank = 1
+	}
+	seen := int64(0)
+	for i, c := range h.counts {
+		seen += c
+		if seen >= rank {
+			// Never report more than was actually seen
+			if upper := bucketUpperBound(i); upper < h.max {
+				return upper
+			}
+			return h.max
+		}
+	}
+	return h.max
+}
+
+// CountAtOrBelow returns how many recorded values are at most v, to bucket precision.
+func (h *Histogram) CountAtOrBelow(v int64) int64 {
+	if v < 0 {
+		return 0
+	}
+	total := int64(0)
+	last := bucketIndex(v)
+	for i := 0; i <= last && i < len(h.counts); i++ {
+		total += h.counts[i]
+	}
+	return total
+}
@@ -0,0 +1,43 @@
+package histogram
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuckets(t *testing.T) {
+	for _, v := range []int64{0, 1, 15, 16, 17, 31, 32, 33, 1000, 123456789, 1 << 62} {
+		index := bucketIndex(v)
+		upper := bucketUpperBound(index)
+		assert.True(t, v <= upper, "%d should be at most the upper bound %d", v, upper)
+		if index > 0 {
+			assert.True(t, v > bucketUpperBound(index-1), "%d should be above the previous bucket", v)
+		}
+		// Buckets are at most 1/16th as wide as the values in them
+		assert.True(t, float64(upper-v) <= float64(v)/16, "%d has a bucket that's too wide", v)
+	}
+}
+
+func TestQuantiles(t *testing.T) {
+	h := New()
+	assert.Equal(t, int64(0), h.Quantile(0.5))
+	for i := int64(1); i <= 1000; i++ {
+		h.Record(i)
+	}
+	assert.Equal(t, int64(1000), h.Count())
+	assert.Equal(t, int64(1), h.Min())
+	assert.Equal(t, int64(1000), h.Max())
+	assert.InDelta(t, 500.5, h.Mean(), 0.001)
+	assert.InEpsilon(t, 500, h.Quantile(0.5), 1.0/16)
+	assert.InEpsilon(t, 990, h.Quantile(0.99), 1.0/16)
+	assert.Equal(t, int64(1000), h.Quantile(1))
+	assert.InEpsilon(t, 100, h.CountAtOrBelow(100), 1.0/16)
+
+	other := New()
+	other.Record(5000)
+	h.Merge(other)
+	assert.Equal(t, int64(1001), h.Count())
+	assert.Equal(t, int64(5000), h.Max())
+	assert.Equal(t, int64(5000), h.Quantile(1))
+}
@@ -0,0 +1,206 @@
+// Package metrics exposes counters, gauges and histograms over HTTP in the Prometheus text
+// format, so replays can be scraped by a Prometheus server.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Registry is a set of metrics. It implements http.Handler, serving the current value of every
+// metric in the Prometheus text format.
+type Registry struct {
+	lock     sync.Mutex
+	metrics  []metric
+	onScrape []func()
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.metrics = append(r.metrics, m)
+}
+
+// OnScrape registers a function that's called before every scrape, e.g. to update gauges.
+func (r *Registry) OnScrape(f func()) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.onScrape = append(r.onScrape, f)
+}
+
+// ServeHTTP writes every metric in the Prometheus text format.
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	onScrape := append([]func(){}, r.onScrape...)
+	metrics := append([]metric{}, r.metrics...)
+	r.lock.Unlock()
+
+	for _, f := range onScrape {
+		f()
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	buffered := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(buffered)
+	}
+	buffered.Flush()
+}
+
+// vec holds a value per combination of label values.
+type vec struct {
+	name, help, kind string
+	labels           []string
+
+	lock   sync.Mutex
+	values map[string]float64
+}
+
+func newVec(name, help, kind string, labels []string) *vec {
+	return &vec{name: name, help: help, kind: kind, labels: labels, values: map[string]float64{}}
+}
+
+func (v *vec) key(labelValues []string) string {
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("%s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+	return formatLabels(v.labels, labelValues)
+}
+
+func (v *vec) write(w io.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	writeHeader(w, v.name, v.help, v.kind)
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, key, formatValue(v.values[key]))
+	}
+}
+
+// Counter is a value that only goes up, optionally split by labels.
+type Counter struct{ *vec }
+
+// NewCounter registers a Counter with the given label names.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newVec(name, help, "counter", labels)}
+	r.register(c)
+	return c
+}
+
+// Add increases the counter for the given label values by delta.
+func (c *Counter) Add(delta float64, labelValues ...string) {
+	key := c.key(labelValues)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[key] += delta
+}
+
+// Gauge is a value that can go up and down, optionally split by labels.
+type Gauge struct{ *vec }
+
+// NewGauge registers a Gauge with the given label names.
+func (r *Registry) NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{newVec(name, help, "gauge", labels)}
+	r.register(g)
+	return g
+}
+
+// Set sets the gauge for the given label values.
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	key := g.key(labelValues)
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values[key] = value
+}
+
+// Histogram counts observations in cumulative buckets.
+type Histogram struct {
+	name, help string
+	buckets    []float64
+
+	lock   sync.Mutex
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// NewHistogram registers a Histogram with the given bucket upper bounds, in increasing order.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{name: name, help: help, buckets: buckets, counts: make([]int64, len(buckets))}
+	r.register(h)
+	return h
+}
+
+// Observe records a value.
+func (h *Histogram) Observe(value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", h.name, formatValue(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n", h.name, formatValue(h.sum))
+	fmt.Fprintf(w, "%s_count %d\n", h.name, h.count)
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	help = strings.Replace(strings.Replace(help, `\`, `\\`, -1), "\n", `\n`, -1)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelValueEscaper.Replace(values[i]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
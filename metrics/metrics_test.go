@@ -0,0 +1,63 @@
+package metrics
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func scrape(t *testing.T, r *Registry) string {
+	server := httptest.NewServer(r)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	r := NewRegistry()
+	counter := r.NewCounter("ops_total", "Ops seen.", "ns", "op")
+	gauge := r.NewGauge("depth", "Queue depth.")
+	histogram := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+
+	counter.Add(1, "db.a", "i")
+	counter.Add(2, "db.a", "i")
+	counter.Add(1, `db."b"`, "u")
+	histogram.Observe(0.05)
+	histogram.Observe(0.5)
+	histogram.Observe(5)
+	scrapes := 0
+	r.OnScrape(func() {
+		scrapes++
+		gauge.Set(7)
+	})
+
+	body := scrape(t, r)
+	assert.Equal(t, 1, scrapes)
+	assert.Equal(t, `# HELP ops_total Ops seen.
+# TYPE ops_total counter
+ops_total{ns="db.\"b\"",op="u"} 1
+ops_total{ns="db.a",op="i"} 3
+# HELP depth Queue depth.
+# TYPE depth gauge
+depth 7
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+`, body)
+}
+
+func TestWrongNumberOfLabels(t *testing.T) {
+	counter := NewRegistry().NewCounter("ops_total", "Ops seen.", "ns")
+	assert.Panics(t, func() { counter.Add(1) })
+}
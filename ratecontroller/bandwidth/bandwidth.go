@@ -0,0 +1,33 @@
+package bandwidth
+
+import (
+	"github.com/Clever/oplog-replay/ratecontroller"
+	"github.com/Clever/oplog-replay/ratecontroller/tokenbucket"
+	"labix.org/v2/mgo/bson"
+)
+
+// Size returns the size in bytes of the op's BSON encoding, or 0 if it can't be encoded. It's only
+// used for ops whose size wasn't passed in, since encoding every op again is expensive.
+func Size(op map[string]interface{}) float64 {
+	raw, err := bson.Marshal(op)
+	if err != nil {
+		return 0
+	}
+	return float64(len(raw))
+}
+
+// New returns a rate controller that limits the replay to bytesPerSecond bytes of BSON per
+// second on average, allowing bursts of up to burstBytes. An op larger than burstBytes is still
+// applied, but the ops after it wait until it's been paid for. Like tokenbucket.New, it can be
+// used as a ceiling with ratecontroller.Max.
+func New(bytesPerSecond, burstBytes float64) ratecontroller.Controller {
+	return tokenbucket.NewWithCost(bytesPerSecond, burstBytes, "bytes", cost)
+}
+
+// cost is the size of the entry an op was read from, or of its encoding if that isn't known.
+func cost(op map[string]interface{}, size int) float64 {
+	if size > 0 {
+		return float64(size)
+	}
+	return Size(op)
+}
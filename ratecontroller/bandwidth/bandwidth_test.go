@@ -0,0 +1,53 @@
+package bandwidth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Clever/oplog-replay/ratecontroller"
+	"github.com/Clever/oplog-replay/ratecontroller/fixed"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestSize(t *testing.T) {
+	op := map[string]interface{}{"ts": bson.MongoTimestamp(10 << 32), "h": int64(1000), "v": 2, "op": "i", "ns": "testdb.test", "o": map[string]interface{}{"some": "insert"}}
+	raw, err := bson.Marshal(op)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(len(raw)), Size(op))
+}
+
+func TestBandwidthController(t *testing.T) {
+	startTime := int(time.Now().Unix())
+	op := map[string]interface{}{"ts": bson.MongoTimestamp(startTime << 32), "h": 1000, "v": 2, "op": "i", "ns": "testdb.test", "o": map[string]interface{}{"some": "insert"}}
+	size := Size(op)
+
+	// Allow two ops worth of bytes per second, with no burst beyond a single op
+	controller := New(2*size, size)
+	assert.Equal(t, int64(0), controller.WaitTime(op).Nanoseconds())
+	waitDuration := controller.WaitTime(op)
+	if waitDuration.Seconds() > 0.5 || waitDuration.Seconds() <= 0.4 {
+		t.Fatalf("Wait duration not in range of (0.4, 0.5] secs. Is: %f", waitDuration.Seconds())
+	}
+
+	// As a ceiling on a fast fixed rate replay, bandwidth is the limiting factor
+	controller = ratecontroller.Max(fixed.New(1000), New(2*size, size))
+	assert.Equal(t, int64(0), controller.WaitTime(op).Nanoseconds())
+	waitDuration = controller.WaitTime(op)
+	if waitDuration.Seconds() > 0.5 || waitDuration.Seconds() <= 0.4 {
+		t.Fatalf("Wait duration not in range of (0.4, 0.5] secs. Is: %f", waitDuration.Seconds())
+	}
+}
+
+func TestBandwidthControllerUsesReadSize(t *testing.T) {
+	// The op is much smaller than the size it was read with, which is what's paid for, including
+	// through a ceiling
+	op := map[string]interface{}{"op": "n", "ns": ""}
+	for _, controller := range []ratecontroller.Controller{New(1000, 1000), ratecontroller.Max(fixed.New(1000), New(1000, 1000))} {
+		assert.Equal(t, int64(0), ratecontroller.WaitTime(controller, op, 600).Nanoseconds())
+		waitDuration := ratecontroller.WaitTime(controller, op, 600)
+		if waitDuration.Seconds() > 0.2 || waitDuration.Seconds() <= 0.1 {
+			t.Fatalf("Wait duration not in range of (0.1, 0.2] secs. Is: %f", waitDuration.Seconds())
+		}
+	}
+}
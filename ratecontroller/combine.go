@@ -0,0 +1,98 @@
+package ratecontroller
+
+import (
+	"strings"
+	"time"
+)
+
+type combinedController struct {
+	a, b          Controller
+	combine       func(a, b time.Duration) time.Duration
+	lastScheduled time.Time
+}
+
+func (controller *combinedController) WaitTime(op map[string]interface{}) time.Duration {
+	return controller.WaitTimeSized(op, 0)
+}
+
+// WaitTimeSized passes the op's size on to the combined controllers that use it.
+func (controller *combinedController) WaitTimeSized(op map[string]interface{}, size int) time.Duration {
+	// Both controllers need to see every op, so always call both before combining
+	now := time.Now()
+	waitA := WaitTime(controller.a, op, size)
+	waitB := WaitTime(controller.b, op, size)
+	wait := controller.combine(waitA, waitB)
+
+	// The op was due when the controller whose wait time won had it scheduled
+	controller.lastScheduled = ScheduledTime(controller.b, now, waitB)
+	if wait == waitA {
+		controller.lastScheduled = ScheduledTime(controller.a, now, waitA)
+	}
+	return wait
+}
+
+// LastScheduled returns when the last op was due.
+func (controller *combinedController) LastScheduled() time.Time {
+	return controller.lastScheduled
+}
+
+// Report joins the reports of the combined controllers.
+func (controller *combinedController) Report() string {
+	reports := []string{}
+	for _, c := range []Controller{controller.a, controller.b} {
+		if reporter, ok := c.(Reporter); ok {
+			if report := reporter.Report(); report != "" {
+				reports = append(reports, report)
+			}
+		}
+	}
+	return strings.Join(reports, "\n")
+}
+
+// SetSpeed changes the speed of the first controller, which is the primary one. The second is
+// usually a ceiling, and keeps its rate.
+func (controller *combinedController) SetSpeed(speed float64) {
+	if adjustable, ok := controller.a.(Adjustable); ok {
+		adjustable.SetSpeed(speed)
+	}
+}
+
+// Delay delays both controllers.
+func (controller *combinedController) Delay(d time.Duration) {
+	for _, c := range []Controller{controller.a, controller.b} {
+		if adjustable, ok := c.(Adjustable); ok {
+			adjustable.Delay(d)
+		}
+	}
+}
+
+// Reset resets both controllers.
+func (controller *combinedController) Reset() {
+	for _, c := range []Controller{controller.a, controller.b} {
+		if adjustable, ok := c.(Adjustable); ok {
+			adjustable.Reset()
+		}
+	}
+}
+
+// Max returns a controller that waits for the longer of the two controllers' wait times, so an
+// op is only applied once both controllers allow it. Use it to put a ceiling on a controller.
+func Max(a, b Controller) Controller {
+	return &combinedController{a: a, b: b, combine: func(x, y time.Duration) time.Duration {
+		if x > y {
+			return x
+		}
+		return y
+	}}
+}
+
+// Min returns a controller that waits for the shorter of the two controllers' wait times, so an
+// op is applied as soon as either controller allows it.
+func Min(a, b Controller) Controller {
+	return &combinedController{a: a, b: b, combine: func(x, y time.Duration) time.Duration {
+		if x < y {
+			return x
+		}
+		return y
+	}}
+}
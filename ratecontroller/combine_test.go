@@ -0,0 +1,60 @@
+package ratecontroller_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Clever/oplog-replay/ratecontroller"
+	"github.com/Clever/oplog-replay/ratecontroller/fixed"
+	"github.com/Clever/oplog-replay/ratecontroller/relative"
+	"github.com/Clever/oplog-replay/ratecontroller/tokenbucket"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestMaxCapsRelativeController(t *testing.T) {
+	startTime := int(time.Now().Unix())
+	op := map[string]interface{}{"ts": bson.MongoTimestamp(startTime << 32), "h": 1000, "v": 2, "op": "n", "ns": "", "o": map[string]interface{}{"message": "nop"}}
+
+	// An infinitely fast relative replay capped at 10 ops/sec
+	controller := ratecontroller.Max(relative.New(0), fixed.New(10))
+
+	waitDuration := controller.WaitTime(op)
+	assert.Equal(t, int64(0), waitDuration.Nanoseconds())
+	// The relative controller would apply the second op immediately, but the ceiling doesn't
+	waitDuration = controller.WaitTime(op)
+	if waitDuration.Seconds() > 0.1 || waitDuration.Seconds() <= 0.0 {
+		t.Fatalf("Wait duration not in range of (0.0, 0.1] secs. Is: %f", waitDuration.Seconds())
+	}
+
+	// Ops far apart in the oplog still wait for the relative controller
+	laterOp := map[string]interface{}{"ts": bson.MongoTimestamp((startTime + 3) << 32), "h": 1001, "v": 2, "op": "n", "ns": "", "o": map[string]interface{}{"message": "nop"}}
+	controller = ratecontroller.Max(relative.New(1), tokenbucket.New(10, 1))
+	assert.Equal(t, int64(0), controller.WaitTime(op).Nanoseconds())
+	waitDuration = controller.WaitTime(laterOp)
+	if waitDuration.Seconds() > 3.0 || waitDuration.Seconds() <= 2.9 {
+		t.Fatalf("Wait duration not in range of (2.9, 3.0] secs. Is: %f", waitDuration.Seconds())
+	}
+}
+
+func TestMinTakesFasterController(t *testing.T) {
+	startTime := int(time.Now().Unix())
+	firstOp := map[string]interface{}{"ts": bson.MongoTimestamp(startTime << 32), "h": 1000, "v": 2, "op": "n", "ns": "", "o": map[string]interface{}{"message": "nop"}}
+	secondOp := map[string]interface{}{"ts": bson.MongoTimestamp((startTime + 3) << 32), "h": 1001, "v": 2, "op": "n", "ns": "", "o": map[string]interface{}{"message": "nop"}}
+
+	controller := ratecontroller.Min(relative.New(1), fixed.New(10))
+
+	assert.Equal(t, int64(0), controller.WaitTime(firstOp).Nanoseconds())
+	// The relative controller wants to wait 3 seconds, but the fixed one only 100ms
+	waitDuration := controller.WaitTime(secondOp)
+	if waitDuration.Seconds() > 0.1 || waitDuration.Seconds() <= 0.0 {
+		t.Fatalf("Wait duration not in range of (0.0, 0.1] secs. Is: %f", waitDuration.Seconds())
+	}
+}
+
+func TestCombinedReport(t *testing.T) {
+	controller := ratecontroller.Max(relative.NewWithMaxGap(1, time.Second), tokenbucket.New(10, 1))
+	report := controller.(ratecontroller.Reporter).Report()
+	assert.Contains(t, report, "Capped 0 idle gaps")
+	assert.Contains(t, report, "Throttled 0 of 0 ops")
+}
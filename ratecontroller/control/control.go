@@ -0,0 +1,294 @@
+package control
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bsonScanner "github.com/Clever/oplog-replay/bson"
+	"github.com/Clever/oplog-replay/ratecontroller"
+	"labix.org/v2/mgo/bson"
+)
+
+// Controller wraps another rate controller so it can be paused, resumed, sped up or slowed
+// down, and skipped ahead while a replay is running, through the HTTP API returned by Handler.
+type Controller struct {
+	controller    ratecontroller.Controller
+	lastScheduled time.Time
+
+	// lock guards everything below. Changes requested through the API are recorded here and
+	// handed to the wrapped controller on the next call to WaitTime, so the wrapped controller
+	// is only ever used from the replay's goroutine.
+	lock      sync.Mutex
+	resumed   chan struct{}
+	stopped   chan struct{}
+	stop      sync.Once
+	speed     float64
+	newSpeed  bool
+	paused    bool
+	pausedAt  time.Time
+	pausedFor time.Duration
+	reset     bool
+	skipUntil bson.MongoTimestamp
+	lastTs    bson.MongoTimestamp
+	released  int
+	skipped   int
+}
+
+// Status describes the state of the replay as seen by the Controller.
+type Status struct {
+	Paused    bool    `json:"paused"`
+	Speed     float64 `json:"speed"`
+	Released  int     `json:"released"`
+	Skipped   int     `json:"skipped"`
+	Timestamp string  `json:"ts,omitempty"`
+	Time      string  `json:"time,omitempty"`
+	SkipUntil string  `json:"skipUntil,omitempty"`
+}
+
+// New wraps controller, which was created with the given speed.
+func New(controller ratecontroller.Controller, speed float64) *Controller {
+	return &Controller{controller: controller, speed: speed, stopped: make(chan struct{})}
+}
+
+// WaitTime blocks while the replay is paused, applies any pending changes to the wrapped
+// controller, and then returns its wait time. It returns 0 straight away once the Controller is
+// stopped.
+func (c *Controller) WaitTime(op map[string]interface{}) time.Duration {
+	return c.WaitTimeSized(op, 0)
+}
+
+// WaitTimeSized is WaitTime, passing the op's size on to the wrapped controller if it uses it.
+func (c *Controller) WaitTimeSized(op map[string]interface{}, size int) time.Duration {
+	c.lock.Lock()
+	for c.paused {
+		resumed := c.resumed
+		c.lock.Unlock()
+		select {
+		case <-resumed:
+		case <-c.stopped:
+			return 0
+		}
+		c.lock.Lock()
+	}
+	adjustable, canAdjust := c.controller.(ratecontroller.Adjustable)
+	if canAdjust {
+		if c.pausedFor > 0 {
+			adjustable.Delay(c.pausedFor)
+		}
+		if c.newSpeed {
+			adjustable.SetSpeed(c.speed)
+		}
+		if c.reset {
+			adjustable.Reset()
+		}
+	}
+	c.pausedFor, c.newSpeed, c.reset = 0, false, false
+	if ts, ok := op["ts"].(bson.MongoTimestamp); ok {
+		c.lastTs = ts
+	}
+	c.released++
+	c.lock.Unlock()
+
+	now := time.Now()
+	wait := ratecontroller.WaitTime(c.controller, op, size)
+	c.lastScheduled = ratecontroller.ScheduledTime(c.controller, now, wait)
+	return wait
+}
+
+// Stop implements ratecontroller.Stopper, so a paused replay can still end.
+func (c *Controller) Stop() {
+	c.stop.Do(func() { close(c.stopped) })
+}
+
+// LastScheduled returns when the last op was due according to the wrapped controller. Like
+// WaitTime, it must only be called from the replay's goroutine.
+func (c *Controller) LastScheduled() time.Time {
+	return c.lastScheduled
+}
+
+// Skip drops ops from before the timestamp requested through the API. Once it reaches the first
+// op after it, the wrapped controller's schedule is reset so the replay carries on from there.
+func (c *Controller) Skip(op map[string]interface{}) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.skipUntil == 0 {
+		return false
+	}
+	if ts, ok := op["ts"].(bson.MongoTimestamp); ok && ts < c.skipUntil {
+		c.lastTs = ts
+		c.skipped++
+		return true
+	}
+	c.skipUntil = 0
+	c.reset = true
+	return false
+}
+
+// Report forwards the wrapped controller's report, if it has one.
+func (c *Controller) Report() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	report := ""
+	if reporter, ok := c.controller.(ratecontroller.Reporter); ok {
+		report = reporter.Report()
+	}
+	if c.skipped > 0 {
+		report = strings.TrimSpace(report + fmt.Sprintf("\nSkipped %d ops on request", c.skipped))
+	}
+	return report
+}
+
+// Pause stops ops from being released until Resume is called.
+func (c *Controller) Pause() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.paused {
+		c.paused = true
+		c.pausedAt = time.Now()
+		c.resumed = make(chan struct{})
+	}
+}
+
+// Resume releases ops again after a Pause. The schedule is pushed back by the time spent paused.
+func (c *Controller) Resume() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.paused {
+		c.paused = false
+		c.pausedFor += time.Now().Sub(c.pausedAt)
+		close(c.resumed)
+	}
+}
+
+// SetSpeed changes the speed of the wrapped controller, which must be ratecontroller.Adjustable.
+func (c *Controller) SetSpeed(speed float64) error {
+	if _, ok := c.controller.(ratecontroller.Adjustable); !ok {
+		return fmt.Errorf("Controller doesn't support changing speed")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.speed = speed
+	c.newSpeed = true
+	return nil
+}
+
+// SkipTo drops all ops from before ts.
+func (c *Controller) SkipTo(ts bson.MongoTimestamp) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.skipUntil = ts
+}
+
+// Status returns the current state of the replay.
+func (c *Controller) Status() Status {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	status := Status{Paused: c.paused, Speed: c.speed, Released: c.released, Skipped: c.skipped}
+	if c.lastTs != 0 {
+		status.Timestamp = bsonScanner.FormatTimestamp(c.lastTs)
+		status.Time = time.Unix(int64(c.lastTs>>32), 0).UTC().Format(time.RFC3339)
+	}
+	if c.skipUntil != 0 {
+		status.SkipUntil = bsonScanner.FormatTimestamp(c.skipUntil)
+	}
+	return status
+}
+
+// ParseTimestamp parses an oplog timestamp given as "seconds", "seconds:increment" or an RFC3339 time.
+func ParseTimestamp(value string) (bson.MongoTimestamp, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return bson.MongoTimestamp(t.Unix() << 32), nil
+	}
+	parts := strings.SplitN(value, ":", 2)
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid timestamp %q", value)
+	}
+	increment := int64(0)
+	if len(parts) == 2 {
+		if increment, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+			return 0, fmt.Errorf("Invalid timestamp %q", value)
+		}
+	}
+	return bson.MongoTimestamp(seconds<<32 | increment), nil
+}
+
+// Handler returns an HTTP API for the Controller:
+//
+//	GET  /status              the current Status
+//	POST /pause               pause the replay
+//	POST /resume              resume the replay
+//	POST /speed?value=<speed> change the speed
+//	POST /skip?ts=<ts>        skip ahead to an oplog timestamp (see ParseTimestamp)
+//
+// Every endpoint responds with the Status as JSON.
+func (c *Controller) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", c.handle("GET", func(r *http.Request) error { return nil }))
+	mux.HandleFunc("/pause", c.handle("POST", func(r *http.Request) error {
+		c.Pause()
+		return nil
+	}))
+	mux.HandleFunc("/resume", c.handle("POST", func(r *http.Request) error {
+		c.Resume()
+		return nil
+	}))
+	mux.HandleFunc("/speed", c.handle("POST", func(r *http.Request) error {
+		speed, err := strconv.ParseFloat(r.FormValue("value"), 64)
+		if err != nil {
+			return fmt.Errorf("Invalid speed %q", r.FormValue("value"))
+		}
+		return c.SetSpeed(speed)
+	}))
+	mux.HandleFunc("/skip", c.handle("POST", func(r *http.Request) error {
+		ts, err := ParseTimestamp(r.FormValue("ts"))
+		if err != nil {
+			return err
+		}
+		c.SkipTo(ts)
+		return nil
+	}))
+	return mux
+}
+
+func (c *Controller) handle(method string, action func(r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, fmt.Sprintf("%s requires %s", r.URL.Path, method), http.StatusMethodNotAllowed)
+			return
+		}
+		if err := action(r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.Status())
+	}
+}
+
+// ListenAndServe serves the API on addr, which is either a TCP address like "localhost:8080" or
+// a Unix socket path prefixed with "unix:".
+func (c *Controller) ListenAndServe(addr string) error {
+	listener, err := Listen(addr)
+	if err != nil {
+		return err
+	}
+	return http.Serve(listener, c.Handler())
+}
+
+// Listen listens on addr, which is either a TCP address like "localhost:8080" or a Unix socket
+// path prefixed with "unix:". Listening before serving means a bad address is an error up front,
+// rather than once the replay has started.
+func Listen(addr string) (net.Listener, error) {
+	network := "tcp"
+	if strings.HasPrefix(addr, "unix:") {
+		network, addr = "unix", strings.TrimPrefix(addr, "unix:")
+	}
+	return net.Listen(network, addr)
+}
@@ -0,0 +1,160 @@
+package control
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Clever/oplog-replay/ratecontroller/fixed"
+	"github.com/Clever/oplog-replay/ratecontroller/relative"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func opAt(seconds int) map[string]interface{} {
+	return map[string]interface{}{"ts": bson.MongoTimestamp(seconds << 32), "h": 1000, "v": 2, "op": "n", "ns": "", "o": map[string]interface{}{"message": "nop"}}
+}
+
+func post(t *testing.T, server *httptest.Server, path string, values url.Values) Status {
+	resp, err := http.PostForm(server.URL+path, values)
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var status Status
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&status))
+	return status
+}
+
+func TestPauseAndResume(t *testing.T) {
+	controller := New(fixed.New(1000), 1000)
+	server := httptest.NewServer(controller.Handler())
+	defer server.Close()
+
+	status := post(t, server, "/pause", nil)
+	assert.True(t, status.Paused)
+
+	released := make(chan time.Duration)
+	go func() { released <- controller.WaitTime(opAt(10)) }()
+	select {
+	case <-released:
+		t.Fatal("Op was released while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	status = post(t, server, "/resume", nil)
+	assert.False(t, status.Paused)
+	select {
+	case wait := <-released:
+		assert.Equal(t, int64(0), wait.Nanoseconds())
+	case <-time.After(time.Second):
+		t.Fatal("Op wasn't released after resuming")
+	}
+
+	resp, err := http.Get(server.URL + "/status")
+	assert.Nil(t, err)
+	var status2 Status
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&status2))
+	resp.Body.Close()
+	assert.Equal(t, 1, status2.Released)
+	assert.Equal(t, "10:0", status2.Timestamp)
+}
+
+func TestStopWhilePaused(t *testing.T) {
+	controller := New(fixed.New(1000), 1000)
+	controller.Pause()
+	released := make(chan time.Duration)
+	go func() { released <- controller.WaitTime(opAt(10)) }()
+
+	controller.Stop()
+	controller.Stop()
+	select {
+	case wait := <-released:
+		assert.Equal(t, int64(0), wait.Nanoseconds())
+	case <-time.After(time.Second):
+		t.Fatal("Op wasn't released after stopping")
+	}
+	assert.Equal(t, 0, controller.Status().Released)
+
+	// Pausing again after resuming still blocks
+	controller = New(fixed.New(1000), 1000)
+	controller.Pause()
+	controller.Resume()
+	controller.Pause()
+	go func() { released <- controller.WaitTime(opAt(10)) }()
+	select {
+	case <-released:
+		t.Fatal("Op was released while paused")
+	case <-time.After(100 * time.Millisecond):
+	}
+	controller.Resume()
+	<-released
+}
+
+func TestSetSpeed(t *testing.T) {
+	controller := New(fixed.New(1), 1)
+	server := httptest.NewServer(controller.Handler())
+	defer server.Close()
+
+	op := opAt(10)
+	assert.Equal(t, int64(0), controller.WaitTime(op).Nanoseconds())
+	status := post(t, server, "/speed", url.Values{"value": {"10"}})
+	assert.Equal(t, float64(10), status.Speed)
+
+	// At the original speed the next op would be a second away. The op after it is at the new speed.
+	waitDuration := controller.WaitTime(op)
+	if waitDuration.Seconds() > 1.0 || waitDuration.Seconds() <= 0.9 {
+		t.Fatalf("Wait duration not in range of (0.9, 1.0] secs. Is: %f", waitDuration.Seconds())
+	}
+	waitDuration = controller.WaitTime(op)
+	if waitDuration.Seconds() > 1.1 || waitDuration.Seconds() <= 1.0 {
+		t.Fatalf("Wait duration not in range of (1.0, 1.1] secs. Is: %f", waitDuration.Seconds())
+	}
+
+	resp, err := http.PostForm(server.URL+"/speed", url.Values{"value": {"fast"}})
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestSkipAhead(t *testing.T) {
+	start := int(time.Now().Unix())
+	controller := New(relative.New(1), 1)
+	server := httptest.NewServer(controller.Handler())
+	defer server.Close()
+
+	assert.False(t, controller.Skip(opAt(start)))
+	assert.Equal(t, int64(0), controller.WaitTime(opAt(start)).Nanoseconds())
+
+	status := post(t, server, "/skip", url.Values{"ts": {time.Unix(int64(start+3600), 0).UTC().Format(time.RFC3339)}})
+	assert.NotEmpty(t, status.SkipUntil)
+
+	assert.True(t, controller.Skip(opAt(start+1)))
+	assert.True(t, controller.Skip(opAt(start+3599)))
+	// The first op after the skip is applied straight away, rather than an hour later
+	assert.False(t, controller.Skip(opAt(start+3600)))
+	assert.Equal(t, int64(0), controller.WaitTime(opAt(start+3600)).Nanoseconds())
+	assert.Contains(t, controller.Report(), "Skipped 2 ops")
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	server := httptest.NewServer(New(fixed.New(1), 1).Handler())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/pause")
+	assert.Nil(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestParseTimestamp(t *testing.T) {
+	ts, err := ParseTimestamp("1445000000:7")
+	assert.Nil(t, err)
+	assert.Equal(t, bson.MongoTimestamp(1445000000<<32|7), ts)
+	ts, err = ParseTimestamp("2015-10-16T12:53:20Z")
+	assert.Nil(t, err)
+	assert.Equal(t, bson.MongoTimestamp(1445000000<<32), ts)
+	_, err = ParseTimestamp("yesterday")
+	assert.NotNil(t, err)
+}
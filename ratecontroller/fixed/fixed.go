@@ -11,6 +11,7 @@ type fixedRateController struct {
 	opsPerSecond    float64
 	totalOpsSeen    int
 	replayStartTime time.Time
+	lastScheduled   time.Time
 }
 
 func (controller *fixedRateController) WaitTime(op map[string]interface{}) time.Duration {
@@ -18,12 +19,37 @@ func (controller *fixedRateController) WaitTime(op map[string]interface{}) time.
 
 	// Figure out when we should apply the operation by doing the math
 	timeShouldApplyOp := float64(controller.totalOpsSeen) / controller.opsPerSecond
+	controller.lastScheduled = controller.replayStartTime.Add(time.Duration(timeShouldApplyOp * float64(time.Second)))
 	// Note that we convert to milliseconds because otherwise we seem to run into rounding errors
 	msToWait := math.Max(timeShouldApplyOp-elapsedTime, 0) * 1000
 	controller.totalOpsSeen++
 	return time.Duration(msToWait) * time.Millisecond
 }
 
+// LastScheduled returns when the last op was due.
+func (controller *fixedRateController) LastScheduled() time.Time {
+	return controller.lastScheduled
+}
+
+// SetSpeed changes the operations per second, keeping the next op at its scheduled time.
+func (controller *fixedRateController) SetSpeed(operationsPerSecond float64) {
+	opsSeen := float64(controller.totalOpsSeen)
+	shift := opsSeen/controller.opsPerSecond - opsSeen/operationsPerSecond
+	controller.replayStartTime = controller.replayStartTime.Add(time.Duration(shift * float64(time.Second)))
+	controller.opsPerSecond = operationsPerSecond
+}
+
+// Delay pushes the schedule back by d.
+func (controller *fixedRateController) Delay(d time.Duration) {
+	controller.replayStartTime = controller.replayStartTime.Add(d)
+}
+
+// Reset restarts the schedule from now.
+func (controller *fixedRateController) Reset() {
+	controller.totalOpsSeen = 0
+	controller.replayStartTime = time.Now()
+}
+
 // New returns a rate controller that controls oplog entries at a rate of
 // X per second
 func New(operationsPerSecond float64) ratecontroller.Controller {
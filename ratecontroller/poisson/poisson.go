@@ -0,0 +1,158 @@
+package poisson
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/Clever/oplog-replay/ratecontroller"
+)
+
+type poissonRateController struct {
+	opsPerSecond float64
+	// interval returns a random time between ops for a mean rate of one op per second
+	interval        func() float64
+	nextOpTime      float64
+	replayStartTime time.Time
+	lastScheduled   time.Time
+
+	// Ops per second actually achieved, tracked with Welford's algorithm over one second windows
+	// of release times from windowStart. restart starts the windows again from the next op, so
+	// time skipped or spent paused isn't counted as empty windows.
+	windowStart   time.Time
+	restart       bool
+	lastRelease   time.Time
+	currentSecond int
+	currentCount  int
+	windows       int
+	mean          float64
+	m2            float64
+}
+
+func (controller *poissonRateController) WaitTime(op map[string]interface{}) time.Duration {
+	now := time.Now()
+	elapsedTime := now.Sub(controller.replayStartTime).Seconds()
+
+	timeShouldApplyOp := controller.nextOpTime
+	controller.lastScheduled = controller.replayStartTime.Add(time.Duration(timeShouldApplyOp * float64(time.Second)))
+	controller.nextOpTime += controller.interval() / controller.opsPerSecond
+
+	// The op is released when it's due, or straight away if the replay is behind
+	released := now
+	if controller.lastScheduled.After(now) {
+		released = controller.lastScheduled
+	}
+	controller.record(released)
+
+	// Note that we convert to milliseconds because otherwise we seem to run into rounding errors
+	msToWait := math.Max(timeShouldApplyOp-elapsedTime, 0) * 1000
+	return time.Duration(msToWait) * time.Millisecond
+}
+
+// LastScheduled returns when the last op was due.
+func (controller *poissonRateController) LastScheduled() time.Time {
+	return controller.lastScheduled
+}
+
+// SetSpeed changes the mean operations per second for ops after the next one.
+func (controller *poissonRateController) SetSpeed(operationsPerSecond float64) {
+	controller.opsPerSecond = operationsPerSecond
+}
+
+// Delay pushes the schedule back by d.
+func (controller *poissonRateController) Delay(d time.Duration) {
+	controller.replayStartTime = controller.replayStartTime.Add(d)
+	controller.restart = true
+}
+
+// Reset restarts the schedule from now.
+func (controller *poissonRateController) Reset() {
+	controller.nextOpTime = time.Now().Sub(controller.replayStartTime).Seconds()
+	controller.restart = true
+}
+
+// record counts an op released at the given time. After a restart the window in progress is
+// dropped, since it was cut short.
+func (controller *poissonRateController) record(released time.Time) {
+	if controller.restart {
+		controller.windowStart, controller.currentSecond, controller.currentCount = released, 0, 0
+		controller.restart = false
+	}
+	second := int(released.Sub(controller.windowStart).Seconds())
+	for controller.currentSecond < second {
+		controller.addWindow(float64(controller.currentCount))
+		controller.currentCount = 0
+		controller.currentSecond++
+	}
+	controller.currentCount++
+	controller.lastRelease = released
+}
+
+func (controller *poissonRateController) addWindow(count float64) {
+	controller.windows, controller.mean, controller.m2 = welford(controller.windows, controller.mean, controller.m2, count)
+}
+
+// welford adds a sample to a count, mean and sum of squared differences from the mean.
+func welford(n int, mean, m2, sample float64) (int, float64, float64) {
+	n++
+	delta := sample - mean
+	mean += delta / float64(n)
+	m2 += delta * (sample - mean)
+	return n, mean, m2
+}
+
+// Report summarizes the mean and variance of the ops per second achieved, measured over one
+// second windows of when ops were released. The last window is usually only part of a second, up
+// to a mean interval after the last op, so its count is scaled to a full second.
+func (controller *poissonRateController) Report() string {
+	windows, mean, m2 := controller.windows, controller.mean, controller.m2
+	seconds := float64(controller.windows)
+	end := controller.lastRelease.Sub(controller.windowStart).Seconds() + 1/controller.opsPerSecond
+	partial := math.Min(end, float64(controller.currentSecond+1)) - float64(controller.currentSecond)
+	if controller.currentCount > 0 && partial > 0 {
+		windows, mean, m2 = welford(windows, mean, m2, float64(controller.currentCount)/partial)
+		seconds += partial
+	}
+	if windows == 0 {
+		return fmt.Sprintf("Released no ops (target %v ops/sec)", controller.opsPerSecond)
+	}
+	variance := 0.0
+	if windows > 1 {
+		variance = m2 / float64(windows-1)
+	}
+	return fmt.Sprintf("Achieved a mean of %.2f ops/sec with a variance of %.2f over %.1f seconds (target %v ops/sec)",
+		mean, variance, seconds, controller.opsPerSecond)
+}
+
+// New returns a rate controller that applies oplog entries at a mean rate of operationsPerSecond,
+// with exponentially distributed times between them, i.e. as a Poisson process. The same seed
+// always produces the same schedule.
+func New(operationsPerSecond float64, seed int64) ratecontroller.Controller {
+	random := rand.New(rand.NewSource(seed))
+	now := time.Now()
+	return &poissonRateController{
+		opsPerSecond:    operationsPerSecond,
+		interval:        random.ExpFloat64,
+		replayStartTime: now,
+		windowStart:     now,
+	}
+}
+
+// NewJittered returns a rate controller that applies oplog entries at a mean rate of
+// operationsPerSecond, with the time between them uniformly distributed within jitter (a fraction
+// between 0 and 1) of the mean. A jitter of 0 spaces them evenly, like fixed.New. The same seed
+// always produces the same schedule.
+func NewJittered(operationsPerSecond, jitter float64, seed int64) ratecontroller.Controller {
+	random := rand.New(rand.NewSource(seed))
+	jitter = math.Min(math.Max(jitter, 0), 1)
+	now := time.Now()
+	return &poissonRateController{
+		opsPerSecond: operationsPerSecond,
+		interval: func() float64 {
+			return 1 + jitter*(2*random.Float64()-1)
+		},
+		replayStartTime: now,
+		windowStart:     now,
+	}
+}
@@ -0,0 +1,99 @@
+package poisson
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Clever/oplog-replay/ratecontroller"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func nopOp() map[string]interface{} {
+	startTime := int(time.Now().Unix())
+	return map[string]interface{}{"ts": bson.MongoTimestamp(startTime << 32), "h": 1000, "v": 2, "op": "n", "ns": "", "o": map[string]interface{}{"message": "nop"}}
+}
+
+func TestPoissonRateController(t *testing.T) {
+	op := nopOp()
+	controller := New(10, 1)
+
+	// Should be 0 for the first call
+	assert.Equal(t, int64(0), controller.WaitTime(op).Nanoseconds())
+	// The rest of the schedule is random, but always in the future
+	waitDuration := controller.WaitTime(op)
+	assert.True(t, waitDuration > 0, "Expected a positive wait, got %v", waitDuration)
+}
+
+func TestPoissonRateControllerIsReproducible(t *testing.T) {
+	op := nopOp()
+	first := New(100, 42).(*poissonRateController)
+	second := New(100, 42).(*poissonRateController)
+	for i := 0; i < 100; i++ {
+		first.WaitTime(op)
+		second.WaitTime(op)
+		assert.Equal(t, first.nextOpTime, second.nextOpTime)
+	}
+	different := New(100, 43).(*poissonRateController)
+	different.WaitTime(op)
+	different.WaitTime(op)
+	assert.NotEqual(t, first.nextOpTime, different.nextOpTime)
+}
+
+func TestPoissonRateControllerStatistics(t *testing.T) {
+	op := nopOp()
+	controller := New(100, 1).(*poissonRateController)
+	for i := 0; i < 100000; i++ {
+		controller.WaitTime(op)
+	}
+	// For a Poisson process both the mean and the variance of the count per second are the rate
+	assert.InDelta(t, 100, controller.mean, 2)
+	assert.InDelta(t, 100, controller.m2/float64(controller.windows-1), 15)
+	assert.Contains(t, controller.Report(), "target 100 ops/sec")
+}
+
+func TestJitteredRateController(t *testing.T) {
+	op := nopOp()
+	controller := NewJittered(100, 0.5, 1).(*poissonRateController)
+	for i := 0; i < 10000; i++ {
+		before := controller.nextOpTime
+		controller.WaitTime(op)
+		interval := controller.nextOpTime - before
+		if interval < 0.005 || interval > 0.015 {
+			t.Fatalf("Interval not in range of [0.005, 0.015] secs. Is: %f", interval)
+		}
+	}
+	assert.InDelta(t, 100, controller.mean, 1)
+
+	// Without jitter the schedule is the same as a fixed rate
+	var c ratecontroller.Controller = NewJittered(10, 0, 1)
+	c.WaitTime(op)
+	assert.InDelta(t, 0.1, c.(*poissonRateController).nextOpTime, 1e-9)
+}
+
+func TestReportIncludesPartialWindow(t *testing.T) {
+	op := nopOp()
+	controller := NewJittered(8, 0, 1).(*poissonRateController)
+	assert.Contains(t, controller.Report(), "Released no ops")
+	// A second and a half of ops at an even 8 ops/sec, the last half second of which is scaled up
+	for i := 0; i < 12; i++ {
+		controller.WaitTime(op)
+	}
+	assert.Equal(t, "Achieved a mean of 8.00 ops/sec with a variance of 0.00 over 1.5 seconds (target 8 ops/sec)",
+		controller.Report())
+}
+
+func TestReportSkipsPauses(t *testing.T) {
+	op := nopOp()
+	controller := NewJittered(8, 0, 1).(*poissonRateController)
+	for i := 0; i < 4; i++ {
+		controller.WaitTime(op)
+	}
+	// An hour paused isn't an hour of empty windows, and the window cut short by it is dropped
+	controller.Delay(time.Hour)
+	for i := 0; i < 8; i++ {
+		controller.WaitTime(op)
+	}
+	assert.Equal(t, "Achieved a mean of 8.00 ops/sec with a variance of 0.00 over 1.0 seconds (target 8 ops/sec)",
+		controller.Report())
+}
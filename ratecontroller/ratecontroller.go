@@ -8,3 +8,66 @@ type Controller interface {
 	// Note that WaitTime should only be called once for each operation.
 	WaitTime(op map[string]interface{}) time.Duration
 }
+
+// Reporter is an optional interface for Controllers that can summarize how they paced a replay.
+type Reporter interface {
+	// Report returns a human readable summary, or an empty string if there is nothing to report.
+	Report() string
+}
+
+// Adjustable is an optional interface for Controllers that can be reconfigured while a replay is
+// running. None of the methods move ops that have already been scheduled.
+type Adjustable interface {
+	// SetSpeed changes the speed, with the same meaning as the speed the Controller was created with.
+	SetSpeed(speed float64)
+	// Delay pushes the rest of the schedule back by d, e.g. to account for time spent paused.
+	Delay(d time.Duration)
+	// Reset restarts the schedule so that the next op is applied immediately, e.g. after skipping ahead.
+	Reset()
+}
+
+// Skipper is an optional interface for Controllers that can drop ops from the replay entirely.
+// Skip is called before WaitTime, and WaitTime isn't called for ops that are skipped.
+type Skipper interface {
+	Skip(op map[string]interface{}) bool
+}
+
+// Stopper is an optional interface for Controllers whose WaitTime can block, e.g. while paused.
+// Stop is called when the replay ends, and makes any blocked or later calls to WaitTime return.
+type Stopper interface {
+	Stop()
+}
+
+// Sizer is an optional interface for Controllers that pace ops by their size. WaitTime calls
+// WaitTimeSized instead of WaitTime on a Sizer, with the size in bytes of the BSON entry the op was
+// read from, before any transforms, so the op doesn't have to be encoded again to measure it. A
+// size of 0 means it isn't known.
+type Sizer interface {
+	WaitTimeSized(op map[string]interface{}, size int) time.Duration
+}
+
+// WaitTime returns how long until an op of the given size should be applied, passing the size on
+// if the controller is a Sizer.
+func WaitTime(controller Controller, op map[string]interface{}, size int) time.Duration {
+	if sizer, ok := controller.(Sizer); ok {
+		return sizer.WaitTimeSized(op, size)
+	}
+	return controller.WaitTime(op)
+}
+
+// Scheduler is an optional interface for Controllers that keep a schedule. When a replay falls
+// behind WaitTime returns 0, which hides how late the op is. Scheduler reveals it.
+type Scheduler interface {
+	// LastScheduled returns when the op passed to the most recent call to WaitTime was due.
+	LastScheduled() time.Time
+}
+
+// ScheduledTime returns when the op passed to the controller's most recent call to WaitTime was
+// due, given that the call was made at now and returned wait. Controllers that aren't Schedulers
+// are assumed to have scheduled the op for when they said.
+func ScheduledTime(controller Controller, now time.Time, wait time.Duration) time.Time {
+	if scheduler, ok := controller.(Scheduler); ok {
+		return scheduler.LastScheduled()
+	}
+	return now.Add(wait)
+}
@@ -1,6 +1,7 @@
 package relative
 
 import (
+	"fmt"
 	"math"
 	"time"
 
@@ -10,19 +11,41 @@ import (
 
 type relativeRateController struct {
 	speedMultiplier float64
+	maxGap          time.Duration
+	started         bool
 	logStartTime    int
+	lastEventTime   int
 	startTime       time.Time
+	lastScheduled   time.Time
+
+	// skippedTime is the total amount of oplog time (in seconds) removed by capping gaps at maxGap.
+	// anchorSkippedTime is how much had been skipped when the schedule was last (re)started.
+	skippedTime       float64
+	anchorSkippedTime float64
+	skippedGaps       int
 }
 
 func (controller *relativeRateController) WaitTime(op map[string]interface{}) time.Duration {
 	eventTime := int((op["ts"].(bson.MongoTimestamp)) >> 32)
-	if controller.logStartTime == 0 {
+	if !controller.started {
+		controller.started = true
 		controller.logStartTime = eventTime
+		controller.lastEventTime = eventTime
+		controller.anchorSkippedTime = controller.skippedTime
+	}
+
+	// Compress idle periods by pretending any gap longer than maxGap was only maxGap long
+	gap := float64(eventTime - controller.lastEventTime)
+	if controller.maxGap > 0 && gap > controller.maxGap.Seconds() {
+		controller.skippedTime += gap - controller.maxGap.Seconds()
+		controller.skippedGaps++
 	}
+	controller.lastEventTime = eventTime
 
-	relativeEventTime := float64(eventTime - controller.logStartTime)
+	relativeEventTime := controller.scheduledOplogTime(eventTime)
 	// Scale the event time by the speed multipler
 	scaledEventTime := relativeEventTime / controller.speedMultiplier
+	controller.lastScheduled = controller.startTime.Add(time.Duration(scaledEventTime * float64(time.Second)))
 	timeElapsed := time.Now().Sub(controller.startTime).Seconds()
 
 	// Convert to ms to avoid rounding issues
@@ -30,11 +53,64 @@ func (controller *relativeRateController) WaitTime(op map[string]interface{}) ti
 	return time.Duration(msToWait) * time.Millisecond
 }
 
+// scheduledOplogTime returns how far into the schedule (in seconds of oplog time) an event is.
+func (controller *relativeRateController) scheduledOplogTime(eventTime int) float64 {
+	return float64(eventTime-controller.logStartTime) - (controller.skippedTime - controller.anchorSkippedTime)
+}
+
+// LastScheduled returns when the last op was due.
+func (controller *relativeRateController) LastScheduled() time.Time {
+	return controller.lastScheduled
+}
+
+// SetSpeed changes the speed multiplier, keeping the most recent op at its scheduled time so the
+// ops after it are paced at the new speed from there.
+func (controller *relativeRateController) SetSpeed(speed float64) {
+	if speed == -1 || speed == 0 {
+		speed = math.Inf(1)
+	}
+	if controller.started {
+		position := controller.scheduledOplogTime(controller.lastEventTime)
+		shift := position/controller.speedMultiplier - position/speed
+		controller.startTime = controller.startTime.Add(time.Duration(shift * float64(time.Second)))
+	}
+	controller.speedMultiplier = speed
+}
+
+// Delay pushes the schedule back by d.
+func (controller *relativeRateController) Delay(d time.Duration) {
+	controller.startTime = controller.startTime.Add(d)
+}
+
+// Reset restarts the schedule from the next op.
+func (controller *relativeRateController) Reset() {
+	controller.started = false
+	controller.startTime = time.Now()
+}
+
+// Report summarizes how much idle time was skipped by capping gaps.
+func (controller *relativeRateController) Report() string {
+	if controller.maxGap == 0 {
+		return ""
+	}
+	skipped := time.Duration(controller.skippedTime * float64(time.Second))
+	return fmt.Sprintf("Capped %d idle gaps at %v, skipping %v of oplog time (%v of replay time)",
+		controller.skippedGaps, controller.maxGap, skipped,
+		time.Duration(float64(skipped)/controller.speedMultiplier))
+}
+
 // New returns a rate controller that the plays the oplog at a speed that's a
 // multiple of the original oplog speed.
 func New(speed float64) ratecontroller.Controller {
+	return NewWithMaxGap(speed, 0)
+}
+
+// NewWithMaxGap returns a relative rate controller that caps the oplog time between any two
+// consecutive operations at maxGap, so idle periods don't stall the replay. Pacing within busy
+// periods is unchanged. A maxGap of 0 disables the cap.
+func NewWithMaxGap(speed float64, maxGap time.Duration) ratecontroller.Controller {
 	if speed == -1 || speed == 0 {
 		speed = math.Inf(1)
 	}
-	return &relativeRateController{speedMultiplier: speed, startTime: time.Now()}
+	return &relativeRateController{speedMultiplier: speed, maxGap: maxGap, startTime: time.Now()}
 }
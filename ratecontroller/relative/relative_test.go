@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/Clever/oplog-replay/ratecontroller"
 	"github.com/stretchr/testify/assert"
 	"labix.org/v2/mgo/bson"
 )
@@ -31,3 +32,54 @@ func TestRelativeRateController(t *testing.T) {
 	waitDuration = controller.WaitTime(secondOp)
 	assert.Equal(t, int64(0), waitDuration.Nanoseconds())
 }
+
+func TestRelativeRateControllerMaxGap(t *testing.T) {
+	startTime := int(time.Now().Unix())
+	firstOp := map[string]interface{}{"ts": bson.MongoTimestamp(startTime << 32), "h": 1000, "v": 2, "op": "n", "ns": "", "o": map[string]interface{}{"message": "nop"}}
+	controller := NewWithMaxGap(10, time.Second)
+
+	waitDuration := controller.WaitTime(firstOp)
+	assert.Equal(t, int64(0), waitDuration.Nanoseconds())
+
+	// The next entry is an hour later, but the gap is capped at one second of oplog time,
+	// so at 10x it should be applied within 100ms
+	secondOp := map[string]interface{}{"ts": bson.MongoTimestamp((startTime + 3600) << 32), "h": 1001, "v": 2, "op": "n", "ns": "", "o": map[string]interface{}{"message": "nop"}}
+	waitDuration = controller.WaitTime(secondOp)
+	if waitDuration.Seconds() > 0.1 || waitDuration.Seconds() <= 0.0 {
+		t.Fatalf("Wait duration not in range of (0.0, 100] ms. Is: %f", waitDuration.Seconds())
+	}
+
+	// Gaps shorter than the cap keep their original pacing
+	time.Sleep(time.Duration(100) * time.Millisecond)
+	thirdOp := map[string]interface{}{"ts": bson.MongoTimestamp((startTime + 3601) << 32), "h": 1002, "v": 2, "op": "n", "ns": "", "o": map[string]interface{}{"message": "nop"}}
+	waitDuration = controller.WaitTime(thirdOp)
+	if waitDuration.Seconds() > 0.1 || waitDuration.Seconds() <= 0.0 {
+		t.Fatalf("Wait duration not in range of (0.0, 100] ms. Is: %f", waitDuration.Seconds())
+	}
+
+	report := controller.(ratecontroller.Reporter).Report()
+	assert.Contains(t, report, "Capped 1 idle gaps")
+	assert.Contains(t, report, "59m59s of oplog time")
+}
+
+func TestRelativeRateControllerSetSpeed(t *testing.T) {
+	startTime := int(time.Now().Unix())
+	firstOp := map[string]interface{}{"ts": bson.MongoTimestamp(startTime << 32), "h": 1000, "v": 2, "op": "n", "ns": "", "o": map[string]interface{}{"message": "nop"}}
+	secondOp := map[string]interface{}{"ts": bson.MongoTimestamp((startTime + 10) << 32), "h": 1001, "v": 2, "op": "n", "ns": "", "o": map[string]interface{}{"message": "nop"}}
+	controller := New(1)
+
+	assert.Equal(t, int64(0), controller.WaitTime(firstOp).Nanoseconds())
+	// At 1x the next op would be 10 seconds away, but at 100x it's only 100ms
+	controller.(ratecontroller.Adjustable).SetSpeed(100)
+	waitDuration := controller.WaitTime(secondOp)
+	if waitDuration.Seconds() > 0.1 || waitDuration.Seconds() <= 0.0 {
+		t.Fatalf("Wait duration not in range of (0.0, 100] ms. Is: %f", waitDuration.Seconds())
+	}
+
+	// Delaying pushes it back
+	controller.(ratecontroller.Adjustable).Delay(time.Second)
+	waitDuration = controller.WaitTime(secondOp)
+	if waitDuration.Seconds() > 1.1 || waitDuration.Seconds() <= 1.0 {
+		t.Fatalf("Wait duration not in range of (1.0, 1.1] secs. Is: %f", waitDuration.Seconds())
+	}
+}
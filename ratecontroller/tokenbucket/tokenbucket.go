@@ -0,0 +1,78 @@
+package tokenbucket
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/Clever/oplog-replay/ratecontroller"
+)
+
+type tokenBucketController struct {
+	rate      float64
+	burst     float64
+	cost      func(op map[string]interface{}, size int) float64
+	unit      string
+	tokens    float64
+	lastCheck time.Time
+
+	totalOps     int
+	throttledOps int
+}
+
+func (controller *tokenBucketController) WaitTime(op map[string]interface{}) time.Duration {
+	return controller.WaitTimeSized(op, 0)
+}
+
+// WaitTimeSized takes the tokens for an op whose cost may depend on its size.
+func (controller *tokenBucketController) WaitTimeSized(op map[string]interface{}, size int) time.Duration {
+	now := time.Now()
+	// Refill the bucket for the time that has passed, up to the burst size
+	refill := now.Sub(controller.lastCheck).Seconds() * controller.rate
+	controller.tokens = math.Min(controller.burst, controller.tokens+refill)
+	controller.lastCheck = now
+
+	// Take the tokens for this op. If there weren't enough the bucket goes into debt, and the op
+	// has to wait until the debt would have been paid off.
+	controller.tokens -= controller.cost(op, size)
+	controller.totalOps++
+	if controller.tokens >= 0 {
+		return 0
+	}
+	controller.throttledOps++
+	// Note that we convert to milliseconds because otherwise we seem to run into rounding errors
+	msToWait := -controller.tokens / controller.rate * 1000
+	return time.Duration(msToWait) * time.Millisecond
+}
+
+// SetSpeed changes the rate the bucket refills at.
+func (controller *tokenBucketController) SetSpeed(rate float64) {
+	controller.rate = rate
+}
+
+// Delay does nothing, since the bucket has no schedule. It refills while the replay is paused.
+func (controller *tokenBucketController) Delay(d time.Duration) {}
+
+// Reset does nothing, since the bucket has no schedule.
+func (controller *tokenBucketController) Reset() {}
+
+// Report summarizes how often the bucket limited the replay.
+func (controller *tokenBucketController) Report() string {
+	return fmt.Sprintf("Throttled %d of %d ops at %v %s/sec", controller.throttledOps,
+		controller.totalOps, controller.rate, controller.unit)
+}
+
+// New returns a rate controller that allows at most operationsPerSecond ops per second on
+// average, with bursts of up to burst ops. It's most useful as a ceiling on another controller,
+// e.g. ratecontroller.Max(relative.New(10), tokenbucket.New(5000, 1)).
+func New(operationsPerSecond, burst float64) ratecontroller.Controller {
+	return NewWithCost(operationsPerSecond, burst, "ops", func(map[string]interface{}, int) float64 { return 1 })
+}
+
+// NewWithCost returns a token bucket rate controller where each op takes cost(op, size) tokens,
+// size being the size in bytes of the entry the op was read from, or 0 if it isn't known. The
+// bucket refills at rate tokens per second and holds at most burst tokens. unit describes what a
+// token represents, for reporting.
+func NewWithCost(rate, burst float64, unit string, cost func(op map[string]interface{}, size int) float64) ratecontroller.Controller {
+	return &tokenBucketController{rate: rate, burst: burst, cost: cost, unit: unit, tokens: burst, lastCheck: time.Now()}
+}
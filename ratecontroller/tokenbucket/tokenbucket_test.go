@@ -0,0 +1,52 @@
+package tokenbucket
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Clever/oplog-replay/ratecontroller"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func TestTokenBucketController(t *testing.T) {
+	startTime := int(time.Now().Unix())
+	op := map[string]interface{}{"ts": bson.MongoTimestamp(startTime << 32), "h": 1000, "v": 2, "op": "n", "ns": "", "o": map[string]interface{}{"message": "nop"}}
+
+	controller := New(10, 2)
+
+	// The bucket starts full, so the first two ops can burst
+	assert.Equal(t, int64(0), controller.WaitTime(op).Nanoseconds())
+	assert.Equal(t, int64(0), controller.WaitTime(op).Nanoseconds())
+
+	// The third has to wait for a token
+	waitDuration := controller.WaitTime(op)
+	if waitDuration.Seconds() > 0.1 || waitDuration.Seconds() <= 0.0 {
+		t.Fatalf("Wait duration not in range of (0.0, 0.1] secs. Is: %f", waitDuration.Seconds())
+	}
+
+	// After 300ms the debt is paid off and there's room for two more, but the bucket never holds
+	// more than the burst size
+	time.Sleep(time.Duration(300) * time.Millisecond)
+	assert.Equal(t, int64(0), controller.WaitTime(op).Nanoseconds())
+	assert.Equal(t, int64(0), controller.WaitTime(op).Nanoseconds())
+	waitDuration = controller.WaitTime(op)
+	if waitDuration.Seconds() > 0.1 || waitDuration.Seconds() <= 0.0 {
+		t.Fatalf("Wait duration not in range of (0.0, 0.1] secs. Is: %f", waitDuration.Seconds())
+	}
+}
+
+func TestTokenBucketControllerWithCost(t *testing.T) {
+	op := map[string]interface{}{"op": "i"}
+	controller := NewWithCost(1000, 1000, "bytes", func(op map[string]interface{}, size int) float64 {
+		return float64(size)
+	})
+
+	assert.Equal(t, int64(0), ratecontroller.WaitTime(controller, op, 500).Nanoseconds())
+	assert.Equal(t, int64(0), ratecontroller.WaitTime(controller, op, 500).Nanoseconds())
+	// The bucket is empty, so the next 500 bytes take about half a second
+	waitDuration := ratecontroller.WaitTime(controller, op, 500)
+	if waitDuration.Seconds() > 0.5 || waitDuration.Seconds() <= 0.4 {
+		t.Fatalf("Wait duration not in range of (0.4, 0.5] secs. Is: %f", waitDuration.Seconds())
+	}
+}
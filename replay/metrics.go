@@ -0,0 +1,36 @@
+package replay
+
+import (
+	"fmt"
+
+	"github.com/Clever/oplog-replay/metrics"
+)
+
+// replayMetrics are the metrics exported by a replay.
+type replayMetrics struct {
+	read, applied, skipped, failed *metrics.Counter
+	batchSize, applyLatency        *metrics.Histogram
+	timestamp, lag, queueDepth     *metrics.Gauge
+}
+
+func newReplayMetrics(r *metrics.Registry) *replayMetrics {
+	return &replayMetrics{
+		read:    r.NewCounter("oplog_replay_ops_read_total", "Operations read from the oplog.", "ns", "op"),
+		applied: r.NewCounter("oplog_replay_ops_applied_total", "Operations applied to the host.", "ns", "op"),
+		skipped: r.NewCounter("oplog_replay_ops_skipped_total", "Operations read but not applied.", "ns", "op"),
+		failed:  r.NewCounter("oplog_replay_ops_failed_total", "Operations that failed to apply.", "ns", "op"),
+		batchSize: r.NewHistogram("oplog_replay_batch_size", "Operations per applyOps batch.",
+			[]float64{1, 2, 5, 10, 15, 20, 50, 100}),
+		applyLatency: r.NewHistogram("oplog_replay_apply_ops_duration_seconds", "How long each applyOps batch took.",
+			[]float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}),
+		timestamp: r.NewGauge("oplog_replay_oplog_timestamp_seconds", "Oplog ts of the last operation applied."),
+		lag: r.NewGauge("oplog_replay_schedule_lag_seconds",
+			"How long after its scheduled time the last operation was applied."),
+		queueDepth: r.NewGauge("oplog_replay_queue_depth", "Operations waiting in each stage of the replay.", "queue"),
+	}
+}
+
+// opLabels returns the namespace and op type labels for an op.
+func opLabels(op map[string]interface{}) (string, string) {
+	return fmt.Sprint(op["ns"]), fmt.Sprint(op["op"])
+}
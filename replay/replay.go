@@ -1,12 +1,18 @@
 package replay
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 
 	bsonScanner "github.com/Clever/oplog-replay/bson"
+	"github.com/Clever/oplog-replay/filter"
+	"github.com/Clever/oplog-replay/metrics"
 	"github.com/Clever/oplog-replay/ratecontroller"
+	"github.com/Clever/oplog-replay/trace"
+	"github.com/Clever/oplog-replay/transform"
+	"github.com/Clever/oplog-replay/transform/translate"
 	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 
@@ -29,10 +35,20 @@ func NewFailedOperationError(op map[string]interface{}) *FailedOperationError {
 	}
 }
 
+// readOp is an operation along with the size in bytes of the BSON entry it was read from, so rate
+// controllers that pace by size don't have to encode it again. Ops from a transform share the
+// size of the entry they came from.
+type readOp struct {
+	op   map[string]interface{}
+	size int
+}
+
 // ParseBSON parses the bson from the Reader interface. It returns a channel that the caller can use
-// to retrieve the parsed BSON ops, and a channel for parse errors.
-func parseBSON(done <-chan struct{}, r io.Reader) (<-chan map[string]interface{}, <-chan error) {
-	c := make(chan map[string]interface{})
+// to retrieve the parsed BSON ops, and a channel for parse errors. Ops that don't match the filter
+// are skipped, and the rest are passed through the stage, if it isn't nil.
+func parseBSON(done <-chan struct{}, r io.Reader, f *filter.Filter, stage transform.Stage,
+	t *tracker) (<-chan readOp, <-chan error) {
+	c := make(chan readOp)
 	errc := make(chan error, 1)
 
 	go func() {
@@ -40,15 +56,33 @@ func parseBSON(done <-chan struct{}, r io.Reader) (<-chan map[string]interface{}
 		scanner := bsonScanner.New(r)
 	scan:
 		for scanner.Scan() {
-			op := map[string]interface{}{}
-			if err := bson.Unmarshal(scanner.Bytes(), &op); err != nil {
+			op, err := transform.Decode(scanner.Bytes())
+			if err != nil {
 				errc <- err
 				return
 			}
-			select {
-			case c <- op:
-			case <-done:
-				break scan
+			size := len(scanner.Bytes())
+			t.opRead(op, size)
+			if !f.Match(op) {
+				t.opSkipped(op)
+				continue
+			}
+			ops := []map[string]interface{}{op}
+			if stage != nil {
+				if ops, err = stage.Apply(op); err != nil {
+					errc <- err
+					return
+				}
+				if len(ops) == 0 {
+					t.opSkipped(op)
+				}
+			}
+			for _, op := range ops {
+				select {
+				case c <- readOp{op: op, size: size}:
+				case <-done:
+					break scan
+				}
 			}
 		}
 		if err := scanner.Err(); err != nil {
@@ -60,22 +94,50 @@ func parseBSON(done <-chan struct{}, r io.Reader) (<-chan map[string]interface{}
 	return c, errc
 }
 
+// timedOp is an operation along with when the rate controller scheduled it to be applied, and
+// when it was actually handed to the host to be applied. The release time is only set once the op
+// has made it through the queue and the batcher, so time spent waiting on a slow host counts as
+// drift.
+type timedOp struct {
+	op        map[string]interface{}
+	scheduled time.Time
+	released  time.Time
+}
+
+// batch is a list of operations that are applied together.
+type batch []timedOp
+
+// ops returns the operations in the batch in the form applyOps expects.
+func (b batch) ops() []interface{} {
+	ops := make([]interface{}, len(b))
+	for i, op := range b {
+		ops[i] = op.op
+	}
+	return ops
+}
+
 // controlRate takes operations on an input channel puts them into the returned output
 // channel at a rate dictated by the passed in rate controller.
-func controlRate(done <-chan struct{}, ops <-chan map[string]interface{},
-	controller ratecontroller.Controller) <-chan map[string]interface{} {
+func controlRate(done <-chan struct{}, ops <-chan readOp,
+	controller ratecontroller.Controller, t *tracker) <-chan timedOp {
 	// The choice of 20 for the maximum number of operations to apply at once is fairly arbitrary
-	c := make(chan map[string]interface{}, 20)
+	c := make(chan timedOp, 20)
 
+	skipper, canSkip := controller.(ratecontroller.Skipper)
 	go func() {
 		defer close(c)
-		for op := range ops {
-			if op["ns"] == "" {
+		for read := range ops {
+			op := read.op
+			if op["ns"] == "" || (canSkip && skipper.Skip(op)) {
+				t.opSkipped(op)
 				continue
 			}
-			time.Sleep(controller.WaitTime(op))
+			now := time.Now()
+			wait := ratecontroller.WaitTime(controller, op, read.size)
+			scheduled := ratecontroller.ScheduledTime(controller, now, wait)
+			time.Sleep(wait)
 			select {
-			case c <- op:
+			case c <- timedOp{op: op, scheduled: scheduled}:
 			case <-done:
 			}
 		}
@@ -85,14 +147,14 @@ func controlRate(done <-chan struct{}, ops <-chan map[string]interface{},
 
 // batchOps takes an input buffered channel and returns a channel which will contain batched
 // ops.  The maximum batch size is the size of the buffered input channel.
-func batchOps(done <-chan struct{}, ops <-chan map[string]interface{}) <-chan []interface{} {
-	c := make(chan []interface{})
+func batchOps(done <-chan struct{}, ops <-chan timedOp) <-chan batch {
+	c := make(chan batch)
 
 	go func() {
 		defer close(c)
 		// In a loop grab as many elements as you can before you would block (the default case)
 		// Only place non-empty batches into the output channel.
-		elements := make([]interface{}, 0)
+		elements := make(batch, 0)
 
 		// Send the current list of elements as a batch, unless it's empty. Returns whether or not a batch was sent.
 		sendElements := func() bool {
@@ -101,7 +163,7 @@ func batchOps(done <-chan struct{}, ops <-chan map[string]interface{}) <-chan []
 			}
 			select {
 			case c <- elements:
-				elements = make([]interface{}, 0)
+				elements = make(batch, 0)
 			case <-done:
 			}
 			return true
@@ -127,10 +189,20 @@ func batchOps(done <-chan struct{}, ops <-chan map[string]interface{}) <-chan []
 }
 
 // oplogReplay takes in a channel of batched operations and applys them using the
-// supplied function.  Returns an error if the apply operation fails.
-func oplogReplay(batches <-chan []interface{}, applyOps func([]interface{}) error) error {
+// supplied function, recording their timing with the tracker. Returns an error if the
+// apply operation fails, or if the tracker finds the replay has fallen too far behind.
+func oplogReplay(batches <-chan batch, applyOps func([]interface{}) error, t *tracker) error {
 	for batch := range batches {
-		if err := applyOps(batch); err != nil {
+		started := time.Now()
+		for i := range batch {
+			batch[i].released = started
+		}
+		if err := applyOps(batch.ops()); err != nil {
+			t.batchFailed(batch, err)
+			return err
+		}
+		if err := t.batchApplied(batch, started, time.Now()); err != nil {
+			t.replayFailed(err)
 			return err
 		}
 	}
@@ -138,10 +210,14 @@ func oplogReplay(batches <-chan []interface{}, applyOps func([]interface{}) erro
 }
 
 // getApplyOpsFunc returns the applyOps function. It's separated out for unit testing
-func getApplyOpsFunc(session *mgo.Session, alwaysUpsert bool) func([]interface{}) error {
+func getApplyOpsFunc(session *mgo.Session, alwaysUpsert bool, writeConcern *mgo.Safe) func([]interface{}) error {
 	return func(ops []interface{}) error {
 		var result map[string]interface{}
-		if err := session.Run(bson.D{{"applyOps", ops}, {"alwaysUpsert", alwaysUpsert}}, &result); err != nil {
+		cmd := bson.D{{Name: "applyOps", Value: ops}, {Name: "alwaysUpsert", Value: alwaysUpsert}}
+		if writeConcern != nil {
+			cmd = append(cmd, bson.DocElem{Name: "writeConcern", Value: writeConcernDoc(writeConcern)})
+		}
+		if err := session.Run(cmd, &result); err != nil {
 			return err
 		}
 		// We have to inspect the response from session.Run to determine if the oplog operation
@@ -162,40 +238,205 @@ func getApplyOpsFunc(session *mgo.Session, alwaysUpsert bool) func([]interface{}
 		}
 		numApplied, ok := result["applied"].(int)
 		if !ok {
-			return fmt.Errorf("Failed to cast applied %s as int", numApplied)
+			return fmt.Errorf("Failed to cast applied %v as int", result["applied"])
 		}
 		if numApplied != len(ops) {
-			return fmt.Errorf("Operations applied %s does not match operations sent %s", numApplied, len(ops))
+			return fmt.Errorf("Operations applied %d does not match operations sent %d", numApplied, len(ops))
 		}
 		return nil
 	}
 }
 
+// writeConcernDoc returns the writeConcern document for a command.
+func writeConcernDoc(safe *mgo.Safe) bson.D {
+	doc := bson.D{}
+	if safe.WMode != "" {
+		doc = append(doc, bson.DocElem{Name: "w", Value: safe.WMode})
+	} else if safe.W > 0 {
+		doc = append(doc, bson.DocElem{Name: "w", Value: safe.W})
+	}
+	if safe.J {
+		doc = append(doc, bson.DocElem{Name: "j", Value: true})
+	}
+	if safe.WTimeout > 0 {
+		doc = append(doc, bson.DocElem{Name: "wtimeout", Value: safe.WTimeout})
+	}
+	return doc
+}
+
+// Replayer replays oplogs onto a host.
+type Replayer struct {
+	// Controller controls the rate at which operations are applied.
+	Controller ratecontroller.Controller
+	// AlwaysUpsert converts all updates to upserts.
+	AlwaysUpsert bool
+	// Host is the Mongo host to replay onto.
+	Host string
+	// Dial, if set, connects to the host to replay onto instead of dialing Host.
+	Dial func() (*mgo.Session, error)
+	// WriteConcern, if set, is the write concern ops are applied with. Otherwise they're
+	// applied with the server's default.
+	WriteConcern *mgo.Safe
+	// MaxDrift fails the replay if any operation is released more than MaxDrift after the
+	// controller scheduled it, i.e. if the host can't keep up. Zero means no limit.
+	MaxDrift time.Duration
+	// ProgressInterval is how often progress is logged while replaying. Zero disables it.
+	ProgressInterval time.Duration
+	// ProgressJSON logs progress as JSON objects rather than text.
+	ProgressJSON bool
+	// InputSize is the size in bytes of the oplog being replayed, if known. It's used to estimate
+	// how long the replay has left.
+	InputSize int64
+	// Metrics, if set, is where the replay's metrics are registered. Use a new Registry for each Run.
+	Metrics *metrics.Registry
+	// Trace, if set, gets a record for every operation applied or failed.
+	Trace *trace.Writer
+	// Warmup is how long after the start of the replay operations are left out of the latency
+	// and lag statistics.
+	Warmup time.Duration
+	// Filter, if set, selects which operations are replayed. The rest are skipped.
+	Filter *filter.Filter
+	// Transform, if set, rewrites the operations that pass the Filter before they're replayed.
+	Transform transform.Stage
+	// Translate rewrites operations, after the Transform, for the version of the server they're
+	// replayed onto. See the translate package.
+	Translate bool
+	// Check, if set, is called with the session to Host before anything is replayed. The replay
+	// fails if it returns an error.
+	Check func(session *mgo.Session) error
+}
+
 // ReplayOplog replays an oplog onto the specified host. If there are any errors this function
 // terminates and returns the error immediately.
 func ReplayOplog(r io.Reader, controller ratecontroller.Controller, alwaysUpsert bool, host string) error {
+	replayer := &Replayer{Controller: controller, AlwaysUpsert: alwaysUpsert, Host: host}
+	_, err := replayer.Run(r)
+	return err
+}
+
+// Run replays the oplog read from r, and returns statistics about the replay. If there are any
+// errors it terminates and returns the error immediately, along with the statistics so far.
+func (replayer *Replayer) Run(r io.Reader) (Stats, error) {
 	done := make(chan struct{})
 	defer close(done)
 
-	session, err := mgo.Dial(host)
+	dial := replayer.Dial
+	if dial == nil {
+		dial = func() (*mgo.Session, error) { return mgo.Dial(replayer.Host) }
+	}
+	session, err := dial()
 	if err != nil {
-		return err
+		return Stats{}, err
 	}
 	defer session.Close()
+	if replayer.Check != nil {
+		if err := replayer.Check(session); err != nil {
+			return Stats{}, err
+		}
+	}
+	stage := replayer.Transform
+	if replayer.Translate {
+		buildInfo, err := session.BuildInfo()
+		if err != nil {
+			return Stats{}, fmt.Errorf("Couldn't get the server version: %s", err)
+		}
+		log.Printf("Translating operations for MongoDB %s", buildInfo.Version)
+		translator := translate.New(translate.Version(buildInfo.VersionArray))
+		if stage != nil {
+			stage = transform.Chain{stage, translator}
+		} else {
+			stage = translator
+		}
+	}
+
+	t := newTracker()
+	t.maxDrift = replayer.MaxDrift
+	t.inputSize = replayer.InputSize
+	t.trace = replayer.Trace
+	t.warmup = replayer.Warmup
+	if replayer.Metrics != nil {
+		t.metrics = newReplayMetrics(replayer.Metrics)
+	}
+	go logLag(done, t)
+	if replayer.ProgressInterval > 0 {
+		go replayer.logProgress(done, t)
+	}
+
+	if stopper, ok := replayer.Controller.(ratecontroller.Stopper); ok {
+		// Otherwise a paused controller would keep its goroutine waiting after the replay ends
+		defer stopper.Stop()
+	}
 
 	log.Println("Parsing BSON...")
-	ops, parseErrors := parseBSON(done, r)
-	timedOps := controlRate(done, ops, controller)
+	ops, parseErrors := parseBSON(done, r, replayer.Filter, stage, t)
+	timedOps := controlRate(done, ops, replayer.Controller, t)
 	batchedOps := batchOps(done, timedOps)
+	if replayer.Metrics != nil {
+		replayer.Metrics.OnScrape(func() {
+			t.metrics.queueDepth.Set(float64(len(ops)), "parsed")
+			t.metrics.queueDepth.Set(float64(len(timedOps)), "released")
+			t.metrics.queueDepth.Set(float64(len(batchedOps)), "batched")
+		})
+	}
 
-	applyOps := getApplyOpsFunc(session, alwaysUpsert)
+	applyOps := getApplyOpsFunc(session, replayer.AlwaysUpsert, replayer.WriteConcern)
 	log.Println("Begin replaying...")
 
-	if err := oplogReplay(batchedOps, applyOps); err != nil {
-		return err
+	err = oplogReplay(batchedOps, applyOps, t)
+	log.Println(t.summary())
+	if err != nil {
+		return t.stats(), err
 	}
 	if err := <-parseErrors; err != nil {
-		return err
+		t.replayFailed(err)
+		return t.stats(), err
+	}
+	logReport(replayer.Controller)
+	logReport(stage)
+	return t.stats(), nil
+}
+
+// lagReportInterval is how often the schedule lag is logged while replaying.
+const lagReportInterval = time.Minute
+
+// logLag logs the schedule lag every lagReportInterval until done is closed.
+func logLag(done <-chan struct{}, t *tracker) {
+	ticker := time.NewTicker(lagReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			log.Println(t.summary())
+		case <-done:
+			return
+		}
+	}
+}
+
+// logProgress logs the replay's progress every ProgressInterval until done is closed.
+func (replayer *Replayer) logProgress(done <-chan struct{}, t *tracker) {
+	ticker := time.NewTicker(replayer.ProgressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p := t.progress()
+			if !replayer.ProgressJSON {
+				log.Println(p)
+			} else if encoded, err := json.Marshal(p); err == nil {
+				log.Println(string(encoded))
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// logReport logs the controller's or transform stage's summary of the replay, if it has one.
+func logReport(v interface{}) {
+	if reporter, ok := v.(ratecontroller.Reporter); ok {
+		if report := reporter.Report(); report != "" {
+			log.Println(report)
+		}
 	}
-	return nil
 }
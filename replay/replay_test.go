@@ -1,14 +1,24 @@
 package replay
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
 	"testing"
 	"time"
 
+	"github.com/Clever/oplog-replay/filter"
+	"github.com/Clever/oplog-replay/metrics"
+	"github.com/Clever/oplog-replay/ratecontroller/fixed"
 	"github.com/Clever/oplog-replay/ratecontroller/relative"
+	"github.com/Clever/oplog-replay/trace"
+	"github.com/Clever/oplog-replay/transform/rename"
 	"github.com/stretchr/testify/assert"
 
 	"labix.org/v2/mgo"
@@ -45,17 +55,17 @@ func TestOplogReplay(t *testing.T) {
 	}
 
 	done := make(chan struct{})
-	opChannel := make(chan map[string]interface{})
+	opChannel := make(chan readOp)
 	go func() {
 		for _, op := range ops {
-			opChannel <- op
+			opChannel <- readOp{op: op}
 		}
 		close(opChannel)
 	}()
 
-	timedOps := controlRate(done, opChannel, relative.New(1))
+	timedOps := controlRate(done, opChannel, relative.New(1), newTracker())
 	batchedOps := batchOps(done, timedOps)
-	if err := oplogReplay(batchedOps, applyOps); err != nil {
+	if err := oplogReplay(batchedOps, applyOps, newTracker()); err != nil {
 		t.Fatal(err.Error())
 	}
 
@@ -64,6 +74,53 @@ func TestOplogReplay(t *testing.T) {
 	}
 }
 
+func TestParseBSONFilter(t *testing.T) {
+	f, err := filter.New([]string{"testdb.test"}, []filter.OpsRule{{Ops: []string{"i"}}}, 0, 0)
+	assert.Nil(t, err)
+	var buf bytes.Buffer
+	for _, op := range []bson.M{
+		{"ts": bson.MongoTimestamp(1 << 32), "op": "i", "ns": "testdb.test", "o": bson.M{"_id": 1}},
+		{"ts": bson.MongoTimestamp(2 << 32), "op": "d", "ns": "testdb.test", "o": bson.M{"_id": 1}},
+		{"ts": bson.MongoTimestamp(3 << 32), "op": "i", "ns": "testdb.other", "o": bson.M{"_id": 1}},
+	} {
+		raw, err := bson.Marshal(op)
+		assert.Nil(t, err)
+		buf.Write(raw)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	tracker := newTracker()
+	ops, errc := parseBSON(done, &buf, f, nil, tracker)
+	parsed := []map[string]interface{}{}
+	for read := range ops {
+		parsed = append(parsed, read.op)
+	}
+	assert.Nil(t, <-errc)
+	assert.Equal(t, 1, len(parsed))
+	assert.Equal(t, bson.MongoTimestamp(1<<32), parsed[0]["ts"])
+	stats := tracker.stats()
+	assert.Equal(t, 3, stats.Read)
+	assert.Equal(t, 2, stats.Skipped)
+}
+
+func TestParseBSONTransform(t *testing.T) {
+	renamer, err := rename.New([]string{"testdb=renamed"})
+	assert.Nil(t, err)
+	raw, err := bson.Marshal(bson.M{"ts": bson.MongoTimestamp(1 << 32), "op": "i", "ns": "testdb.test", "o": bson.M{"_id": 1}})
+	assert.Nil(t, err)
+
+	done := make(chan struct{})
+	defer close(done)
+	ops, errc := parseBSON(done, bytes.NewReader(raw), nil, renamer, newTracker())
+	read := <-ops
+	assert.Equal(t, "renamed.test", read.op["ns"])
+	assert.Equal(t, len(raw), read.size)
+	_, more := <-ops
+	assert.False(t, more)
+	assert.Nil(t, <-errc)
+}
+
 func TestOplogReplaySpeed(t *testing.T) {
 	ops := []map[string]interface{}{
 		map[string]interface{}{"ts": bson.MongoTimestamp(0 << 32), "h": 1000, "v": 2, "op": "i", "ns": "testdb.test", "o": map[string]interface{}{"some": "insert"}},
@@ -78,7 +135,7 @@ func TestOplogReplaySpeed(t *testing.T) {
 		for _ = range ops {
 			receivedTime := int(math.Floor(time.Now().Sub(startTime).Seconds() + 0.5))
 			if receivedTime != expectedTimes[nextExpectedOp] {
-				fmt.Errorf("Got correct op, but expected it after %v second(s). Got it after %v second(s).\n", expectedTimes[nextExpectedOp], receivedTime)
+				return fmt.Errorf("Got correct op, but expected it after %v second(s). Got it after %v second(s).\n", expectedTimes[nextExpectedOp], receivedTime)
 			}
 			nextExpectedOp++
 		}
@@ -86,17 +143,17 @@ func TestOplogReplaySpeed(t *testing.T) {
 	}
 
 	done := make(chan struct{})
-	opChannel := make(chan map[string]interface{})
+	opChannel := make(chan readOp)
 	go func() {
 		for _, op := range ops {
-			opChannel <- op
+			opChannel <- readOp{op: op}
 		}
 		close(opChannel)
 	}()
-	timedOps := controlRate(done, opChannel, relative.New(5))
+	timedOps := controlRate(done, opChannel, relative.New(5), newTracker())
 	batchedOps := batchOps(done, timedOps)
-	if err := oplogReplay(batchedOps, applyOps); err != nil {
-		t.Fatalf(err.Error())
+	if err := oplogReplay(batchedOps, applyOps, newTracker()); err != nil {
+		t.Fatal(err.Error())
 	}
 }
 
@@ -132,27 +189,150 @@ func TestWillApplyInBatch(t *testing.T) {
 	}
 
 	done := make(chan struct{})
-	opChannel := make(chan map[string]interface{})
+	opChannel := make(chan readOp)
 
 	go func() {
-		opChannel <- ops[0]
+		opChannel <- readOp{op: ops[0]}
 		// Wait for the applyOps function to process the first
 		<-opLogGeneratorWaiter
-		opChannel <- ops[1]
-		opChannel <- ops[2]
+		opChannel <- readOp{op: ops[1]}
+		opChannel <- readOp{op: ops[2]}
 		// Tell the applyOps function that it can finish the first apply now that there
 		// are two more operations in the channel.
 		applyOpsWaiter <- true
 		close(opChannel)
 	}()
 
-	timedOps := controlRate(done, opChannel, relative.New(100))
+	timedOps := controlRate(done, opChannel, relative.New(100), newTracker())
 	batchedOps := batchOps(done, timedOps)
-	if err := oplogReplay(batchedOps, applyOps); err != nil {
+	if err := oplogReplay(batchedOps, applyOps, newTracker()); err != nil {
 		t.Fatal(err.Error())
 	}
 }
 
+func TestDriftFailsReplay(t *testing.T) {
+	ops := []map[string]interface{}{}
+	for i := 0; i < 100; i++ {
+		ops = append(ops, map[string]interface{}{"ts": bson.MongoTimestamp(10 << 32), "h": 1000 + i, "v": 2, "op": "i", "ns": "testdb.test", "o": map[string]interface{}{"some": "insert"}})
+	}
+
+	// The target takes 100ms per batch, so a replay at 1000 ops/sec can't keep up
+	applyOps := func(ops []interface{}) error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	opChannel := make(chan readOp)
+	go func() {
+		for _, op := range ops {
+			select {
+			case opChannel <- readOp{op: op}:
+			case <-done:
+				return
+			}
+		}
+		close(opChannel)
+	}()
+
+	tracker := newTracker()
+	tracker.maxDrift = 50 * time.Millisecond
+	timedOps := controlRate(done, opChannel, fixed.New(1000), tracker)
+	batchedOps := batchOps(done, timedOps)
+	err := oplogReplay(batchedOps, applyOps, tracker)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "behind schedule")
+	assert.Contains(t, tracker.summary(), "Schedule lag")
+}
+
+func TestDriftCountsQueueTime(t *testing.T) {
+	// The op was scheduled a second ago but has been sitting in the queue behind a slow host, so
+	// it's released late even though the rate controller let it go on time
+	scheduled := time.Now().Add(-time.Second)
+	op := map[string]interface{}{"ts": bson.MongoTimestamp(10 << 32), "h": 1000, "v": 2, "op": "i", "ns": "testdb.test", "o": map[string]interface{}{"some": "insert"}}
+	batches := make(chan batch, 1)
+	batches <- batch{{op: op, scheduled: scheduled}}
+	close(batches)
+
+	tracker := newTracker()
+	tracker.maxDrift = 500 * time.Millisecond
+	err := oplogReplay(batches, func([]interface{}) error { return nil }, tracker)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "behind schedule")
+}
+
+func TestProgress(t *testing.T) {
+	tracker := newTracker()
+	tracker.inputSize = 4 * 1024 * 1024
+	op := map[string]interface{}{"ts": bson.MongoTimestamp(1445000000<<32 | 3), "h": 1000, "v": 2, "op": "i", "ns": "testdb.test", "o": map[string]interface{}{"some": "insert"}}
+	tracker.opRead(op, 1024*1024)
+	tracker.opRead(op, 1024*1024)
+	tracker.opSkipped(op)
+	// The op applied was scheduled a second into the replay, and half the input has been read,
+	// so the replay should take another second
+	scheduled := tracker.started.Add(time.Second)
+	assert.Nil(t, tracker.batchApplied(batch{{op: op, scheduled: scheduled, released: scheduled}}, scheduled, scheduled))
+
+	progress := tracker.progress()
+	assert.Equal(t, 1, progress.Applied)
+	assert.Equal(t, 1, progress.Skipped)
+	assert.Equal(t, "1445000000:3", progress.Timestamp)
+	assert.Equal(t, "2015-10-16T12:53:20Z", progress.OplogTime)
+	assert.True(t, progress.ETA > 0 && progress.ETA <= time.Second, "Unexpected ETA %v", progress.ETA)
+	assert.Contains(t, progress.String(), "read 2.0MB of 4.0MB (50.0%)")
+
+	encoded, err := json.Marshal(progress)
+	assert.Nil(t, err)
+	var decoded map[string]interface{}
+	assert.Nil(t, json.Unmarshal(encoded, &decoded))
+	assert.Equal(t, float64(1), decoded["applied"])
+	assert.Equal(t, float64(2*1024*1024), decoded["bytesRead"])
+	assert.Equal(t, "1445000000:3", decoded["ts"])
+	assert.Equal(t, float64(0), decoded["lagP99Seconds"])
+}
+
+func TestMetrics(t *testing.T) {
+	registry := metrics.NewRegistry()
+	tracker := newTracker()
+	tracker.metrics = newReplayMetrics(registry)
+
+	insert := map[string]interface{}{"ts": bson.MongoTimestamp(1445000000 << 32), "h": 1000, "v": 2, "op": "i", "ns": "testdb.test", "o": map[string]interface{}{"some": "insert"}}
+	update := map[string]interface{}{"ts": bson.MongoTimestamp(1445000001 << 32), "h": 1001, "v": 2, "op": "u", "ns": "testdb.other", "o": map[string]interface{}{"some": "update"}, "o2": map[string]interface{}{"_id": 1}}
+	nop := map[string]interface{}{"ts": bson.MongoTimestamp(1445000002 << 32), "h": 1002, "v": 2, "op": "n", "ns": "", "o": map[string]interface{}{"message": "nop"}}
+	for _, op := range []map[string]interface{}{insert, update, nop} {
+		tracker.opRead(op, 100)
+	}
+	tracker.opSkipped(nop)
+	started := time.Now()
+	scheduled := started.Add(-time.Second)
+	assert.Nil(t, tracker.batchApplied(batch{{op: insert, scheduled: scheduled, released: scheduled}}, started, started.Add(20*time.Millisecond)))
+	tracker.batchFailed(batch{{op: insert}, {op: update}}, NewFailedOperationError(update))
+
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/metrics")
+	assert.Nil(t, err)
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.Nil(t, err)
+
+	for _, line := range []string{
+		`oplog_replay_ops_read_total{ns="testdb.test",op="i"} 1`,
+		`oplog_replay_ops_read_total{ns="testdb.other",op="u"} 1`,
+		`oplog_replay_ops_skipped_total{ns="",op="n"} 1`,
+		`oplog_replay_ops_applied_total{ns="testdb.test",op="i"} 1`,
+		`oplog_replay_ops_failed_total{ns="testdb.other",op="u"} 1`,
+		`oplog_replay_batch_size_bucket{le="1"} 1`,
+		`oplog_replay_apply_ops_duration_seconds_bucket{le="0.025"} 1`,
+		`oplog_replay_apply_ops_duration_seconds_bucket{le="0.01"} 0`,
+		`oplog_replay_oplog_timestamp_seconds 1.445e+09`,
+		`oplog_replay_schedule_lag_seconds 1.02`,
+	} {
+		assert.Contains(t, string(body), line+"\n")
+	}
+}
+
 func setupTestDb(t *testing.T) (*mgo.Session, *mgo.Collection) {
 	mongoURL := os.Getenv("MONGO_URL")
 	if len(mongoURL) == 0 {
@@ -180,14 +360,14 @@ func TestUpdateNonExistentDocShouldFail(t *testing.T) {
 	session, replayTestDb := setupTestDb(t)
 	defer session.Close()
 	done := make(chan struct{})
-	opChannel := make(chan map[string]interface{}, 1)
-	opChannel <- getUpdateToNonExistentOp()
+	opChannel := make(chan readOp, 1)
+	opChannel <- readOp{op: getUpdateToNonExistentOp()}
 	close(opChannel)
 
-	timedOps := controlRate(done, opChannel, relative.New(100))
+	timedOps := controlRate(done, opChannel, relative.New(100), newTracker())
 	batchedOps := batchOps(done, timedOps)
 
-	err := oplogReplay(batchedOps, getApplyOpsFunc(session, false))
+	err := oplogReplay(batchedOps, getApplyOpsFunc(session, false, nil), newTracker())
 	assert.NotNil(t, err)
 	failedOpError, ok := err.(*FailedOperationError)
 	assert.True(t, ok, "Wrong error type returned")
@@ -203,14 +383,14 @@ func TestUpdateNonExistentDocShouldUpsertWithFlagSet(t *testing.T) {
 	session, replayTestDb := setupTestDb(t)
 	defer session.Close()
 	done := make(chan struct{})
-	opChannel := make(chan map[string]interface{}, 1)
-	opChannel <- getUpdateToNonExistentOp()
+	opChannel := make(chan readOp, 1)
+	opChannel <- readOp{op: getUpdateToNonExistentOp()}
 	close(opChannel)
 
-	timedOps := controlRate(done, opChannel, relative.New(100))
+	timedOps := controlRate(done, opChannel, relative.New(100), newTracker())
 	batchedOps := batchOps(done, timedOps)
 
-	err := oplogReplay(batchedOps, getApplyOpsFunc(session, true))
+	err := oplogReplay(batchedOps, getApplyOpsFunc(session, true, nil), newTracker())
 	assert.Nil(t, err)
 
 	// Check that the element is in the db
@@ -226,14 +406,14 @@ func TestOneBadOperationFailsReplay(t *testing.T) {
 
 	// Do two operations. One should fail, the other should succeed
 	done := make(chan struct{})
-	opChannel := make(chan map[string]interface{}, 2)
-	opChannel <- getSuccessfulUpsertOp()
-	opChannel <- getUpdateToNonExistentOp()
+	opChannel := make(chan readOp, 2)
+	opChannel <- readOp{op: getSuccessfulUpsertOp()}
+	opChannel <- readOp{op: getUpdateToNonExistentOp()}
 	close(opChannel)
 
-	timedOps := controlRate(done, opChannel, relative.New(100))
+	timedOps := controlRate(done, opChannel, relative.New(100), newTracker())
 	batchedOps := batchOps(done, timedOps)
-	err := oplogReplay(batchedOps, getApplyOpsFunc(session, false))
+	err := oplogReplay(batchedOps, getApplyOpsFunc(session, false, nil), newTracker())
 	assert.NotNil(t, err)
 	failedOpError, ok := err.(*FailedOperationError)
 	assert.True(t, ok, "Wrong error type returned")
@@ -253,14 +433,14 @@ func TestASuccessfulOplogOperation(t *testing.T) {
 	defer session.Close()
 
 	done := make(chan struct{})
-	opChannel := make(chan map[string]interface{}, 1)
-	opChannel <- getSuccessfulUpsertOp()
+	opChannel := make(chan readOp, 1)
+	opChannel <- readOp{op: getSuccessfulUpsertOp()}
 	close(opChannel)
 
-	timedOps := controlRate(done, opChannel, relative.New(100))
+	timedOps := controlRate(done, opChannel, relative.New(100), newTracker())
 	batchedOps := batchOps(done, timedOps)
 
-	err := oplogReplay(batchedOps, getApplyOpsFunc(session, false))
+	err := oplogReplay(batchedOps, getApplyOpsFunc(session, false, nil), newTracker())
 	assert.Nil(t, err)
 
 	var result map[string]interface{}
@@ -268,3 +448,96 @@ func TestASuccessfulOplogOperation(t *testing.T) {
 	assert.Nil(t, err)
 	assert.Equal(t, "value", result["insertKey"])
 }
+
+func TestWriteConcernDoc(t *testing.T) {
+	assert.Equal(t, bson.D{{Name: "w", Value: 2}}, writeConcernDoc(&mgo.Safe{W: 2}))
+	assert.Equal(t, bson.D{{Name: "w", Value: "majority"}, {Name: "j", Value: true}, {Name: "wtimeout", Value: 5000}},
+		writeConcernDoc(&mgo.Safe{WMode: "majority", J: true, WTimeout: 5000}))
+}
+
+func TestStats(t *testing.T) {
+	tracker := newTracker()
+	insert := map[string]interface{}{"ts": bson.MongoTimestamp(1445000000 << 32), "h": 1000, "v": 2, "op": "i", "ns": "testdb.test", "o": map[string]interface{}{"some": "insert"}}
+	update := map[string]interface{}{"ts": bson.MongoTimestamp(1445000010 << 32), "h": 1001, "v": 2, "op": "u", "ns": "testdb.test", "o": map[string]interface{}{"some": "update"}, "o2": map[string]interface{}{"_id": 1}}
+	tracker.opRead(insert, 100)
+	tracker.opRead(update, 100)
+	tracker.opRead(update, 100)
+	started := time.Now()
+	scheduled := started.Add(-time.Second)
+	assert.Nil(t, tracker.batchApplied(batch{
+		{op: insert, scheduled: scheduled, released: scheduled},
+		{op: update, scheduled: scheduled, released: scheduled},
+	}, started, started.Add(10*time.Millisecond)))
+	err := NewFailedOperationError(update)
+	tracker.batchFailed(batch{{op: update}}, err)
+
+	stats := tracker.stats()
+	assert.Equal(t, 3, stats.Read)
+	assert.Equal(t, 2, stats.Applied)
+	assert.Equal(t, 1, stats.Failed)
+	assert.Equal(t, 1, stats.Ops["testdb.test"]["i"].Applied)
+	assert.Equal(t, 2, stats.Ops["testdb.test"]["u"].Read)
+	assert.Equal(t, 1, stats.Ops["testdb.test"]["u"].Applied)
+	assert.Equal(t, 1, stats.Ops["testdb.test"]["u"].Failed)
+	assert.InEpsilon(t, 0.01, stats.Ops["testdb.test"]["u"].Latency.Max, 1.0/16)
+	latency, ok := stats.LatencyOf("testdb.test", "")
+	assert.True(t, ok)
+	assert.InEpsilon(t, 0.01, latency.P50, 1.0/16)
+	_, ok = stats.LatencyOf("testdb.missing", "")
+	assert.False(t, ok)
+	assert.Equal(t, "1445000000:0", stats.FirstTimestamp)
+	assert.Equal(t, "2015-10-16T12:53:30Z", stats.OplogEnd)
+	assert.Equal(t, float64(10), stats.OplogSpanSeconds)
+	assert.True(t, stats.SpeedFactor > 0)
+	assert.InEpsilon(t, 0.01, stats.Latency.P99, 1.0/16)
+	assert.InEpsilon(t, 1.01, stats.Lag.Max, 1.0/16)
+	assert.Equal(t, []string{err.Error()}, stats.Failures)
+}
+
+func TestWarmup(t *testing.T) {
+	tracker := newTracker()
+	tracker.warmup = time.Hour
+	insert := map[string]interface{}{"ts": bson.MongoTimestamp(1445000000 << 32), "h": 1000, "v": 2, "op": "i", "ns": "testdb.test", "o": map[string]interface{}{"some": "insert"}}
+	started := time.Now()
+	assert.Nil(t, tracker.batchApplied(batch{{op: insert, scheduled: started, released: started}}, started, started.Add(time.Second)))
+
+	// The op is counted, but its latency is left out
+	stats := tracker.stats()
+	assert.Equal(t, 1, stats.Applied)
+	assert.Equal(t, float64(0), stats.Latency.Max)
+	_, ok := stats.LatencyOf("", "")
+	assert.False(t, ok)
+}
+
+func TestTrace(t *testing.T) {
+	var buf bytes.Buffer
+	tracker := newTracker()
+	tracker.trace = trace.NewWriter(&buf, trace.JSONL, false)
+
+	id := bson.NewObjectId()
+	insert := map[string]interface{}{"ts": bson.MongoTimestamp(1445000000<<32 | 1), "h": int64(1000), "v": 2, "op": "i", "ns": "testdb.test", "o": map[string]interface{}{"_id": id}}
+	update := map[string]interface{}{"ts": bson.MongoTimestamp(1445000000<<32 | 2), "h": int64(1001), "v": 2, "op": "u", "ns": "testdb.test", "o": map[string]interface{}{"some": "update"}, "o2": map[string]interface{}{"_id": "missing"}}
+	started := time.Now()
+	assert.Nil(t, tracker.batchApplied(batch{{op: insert, scheduled: started, released: started}}, started, started.Add(time.Millisecond)))
+	tracker.batchFailed(batch{{op: insert}, {op: update}}, NewFailedOperationError(update))
+	assert.Nil(t, tracker.trace.Close())
+
+	reader, err := trace.NewReader(&buf, trace.JSONL, false)
+	assert.Nil(t, err)
+	r, err := reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, "1445000000:1", r.Ts)
+	assert.Equal(t, int64(1000), r.H)
+	assert.Equal(t, id.Hex(), r.ID)
+	assert.Equal(t, 1, r.Batch)
+	assert.Equal(t, time.Millisecond, r.Latency)
+	assert.Equal(t, "ok", r.Result)
+	r, err = reader.Read()
+	assert.Nil(t, err)
+	assert.Contains(t, r.Result, "batch failed")
+	r, err = reader.Read()
+	assert.Nil(t, err)
+	assert.Equal(t, "missing", r.ID)
+	assert.Equal(t, 2, r.Batch)
+	assert.Equal(t, "failed", r.Result)
+}
@@ -0,0 +1,89 @@
+package replay
+
+import (
+	"time"
+
+	"github.com/Clever/oplog-replay/histogram"
+)
+
+// Stats summarizes a replay.
+type Stats struct {
+	Read    int `json:"read"`
+	Applied int `json:"applied"`
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+	// Ops breaks the counts down by namespace and then op type.
+	Ops map[string]map[string]*OpCounts `json:"ops"`
+
+	// The oplog timestamps of the first and last ops applied, as "seconds:increment"
+	FirstTimestamp string `json:"firstTs,omitempty"`
+	LastTimestamp  string `json:"lastTs,omitempty"`
+	// The same timestamps as RFC3339 times
+	OplogStart string `json:"oplogStart,omitempty"`
+	OplogEnd   string `json:"oplogEnd,omitempty"`
+	// OplogSpanSeconds is how much oplog time the replay covered.
+	OplogSpanSeconds float64 `json:"oplogSpanSeconds"`
+	// DurationSeconds is how long the replay took.
+	DurationSeconds float64 `json:"durationSeconds"`
+	// SpeedFactor is how many times faster than the original the oplog was replayed.
+	SpeedFactor float64 `json:"speedFactor"`
+
+	// Latency is how long the applyOps batch each op was in took. Like Lag, it leaves out ops
+	// applied during the Replayer's Warmup.
+	Latency Percentiles `json:"latencySeconds"`
+	// Lag is how long after its scheduled time each op was applied.
+	Lag Percentiles `json:"lagSeconds"`
+	// MaxDriftSeconds is the furthest behind schedule any op was released.
+	MaxDriftSeconds float64 `json:"maxDriftSeconds"`
+
+	// Failures are the errors that stopped the replay.
+	Failures []string `json:"failures"`
+
+	// latencies are the latency histograms by namespace and op type
+	latencies map[[2]string]*histogram.Histogram
+}
+
+// LatencyOf returns the latency percentiles of ops in namespace ns of type op. An empty ns or op
+// matches any namespace or type. It returns false if no ops match.
+func (s Stats) LatencyOf(ns, op string) (Percentiles, bool) {
+	merged := histogram.New()
+	for key, h := range s.latencies {
+		if (ns == "" || key[0] == ns) && (op == "" || key[1] == op) {
+			merged.Merge(h)
+		}
+	}
+	if merged.Count() == 0 {
+		return Percentiles{}, false
+	}
+	return percentiles(merged), true
+}
+
+// OpCounts counts what happened to the ops of one type in one namespace.
+type OpCounts struct {
+	Read    int `json:"read"`
+	Applied int `json:"applied"`
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+	// Latency is how long the applyOps batches these ops were in took.
+	Latency *Percentiles `json:"latencySeconds,omitempty"`
+}
+
+// Percentiles summarizes a distribution of durations, in seconds.
+type Percentiles struct {
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+}
+
+func percentiles(h *histogram.Histogram) Percentiles {
+	seconds := func(v int64) float64 { return time.Duration(v).Seconds() }
+	return Percentiles{
+		P50:  seconds(h.Quantile(0.5)),
+		P90:  seconds(h.Quantile(0.9)),
+		P99:  seconds(h.Quantile(0.99)),
+		Max:  seconds(h.Max()),
+		Mean: h.Mean() / float64(time.Second),
+	}
+}
@@ -0,0 +1,387 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	bsonScanner "github.com/Clever/oplog-replay/bson"
+	"github.com/Clever/oplog-replay/histogram"
+	"github.com/Clever/oplog-replay/trace"
+	"github.com/Clever/oplog-replay/transform"
+	"labix.org/v2/mgo/bson"
+)
+
+// tracker keeps track of a replay's progress, and measures how closely it keeps to the rate
+// controller's schedule. For each op, drift is how long after its scheduled time it was released
+// to be applied, and lag is how long after its scheduled time it was actually applied. It's safe
+// for concurrent use.
+type tracker struct {
+	lock sync.Mutex
+	// maxDrift is the largest drift allowed before the replay fails. Zero means no limit.
+	maxDrift time.Duration
+	// inputSize is the size of the oplog in bytes, or 0 if it isn't known.
+	inputSize int64
+	// metrics are updated as the replay progresses, if they're set.
+	metrics *replayMetrics
+	// trace, if it's set, gets a record for every op applied or failed.
+	trace *trace.Writer
+	// warmup is how long after the start of the replay ops are left out of the latency and lag
+	// statistics.
+	warmup time.Duration
+
+	started       time.Time
+	read          int
+	bytesRead     int64
+	skipped       int
+	applied       int
+	failed        int
+	counts        map[string]map[string]*OpCounts
+	firstTs       bson.MongoTimestamp
+	lastTs        bson.MongoTimestamp
+	lastScheduled time.Time
+	latency       *histogram.Histogram
+	latencies     map[[2]string]*histogram.Histogram
+	lag           *histogram.Histogram
+	worstDrift    time.Duration
+	failures      []string
+	batches       int
+
+	// The number of ops applied and when, as of the last call to progress
+	lastProgressAt      time.Time
+	lastProgressApplied int
+}
+
+func newTracker() *tracker {
+	now := time.Now()
+	return &tracker{
+		counts:         map[string]map[string]*OpCounts{},
+		latency:        histogram.New(),
+		latencies:      map[[2]string]*histogram.Histogram{},
+		lag:            histogram.New(),
+		started:        now,
+		lastProgressAt: now,
+	}
+}
+
+// opCounts returns the counts for the op's namespace and type. The lock must be held.
+func (t *tracker) opCounts(op map[string]interface{}) *OpCounts {
+	ns, opType := opLabels(op)
+	if t.counts[ns] == nil {
+		t.counts[ns] = map[string]*OpCounts{}
+	}
+	if t.counts[ns][opType] == nil {
+		t.counts[ns][opType] = &OpCounts{}
+	}
+	return t.counts[ns][opType]
+}
+
+// opRead records that an op of the given size in bytes was read from the oplog.
+func (t *tracker) opRead(op map[string]interface{}, size int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.read++
+	t.bytesRead += int64(size)
+	t.opCounts(op).Read++
+	if t.metrics != nil {
+		ns, opType := opLabels(op)
+		t.metrics.read.Add(1, ns, opType)
+	}
+}
+
+// opSkipped records that an op was read but won't be applied.
+func (t *tracker) opSkipped(op map[string]interface{}) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.skipped++
+	t.opCounts(op).Skipped++
+	if t.metrics != nil {
+		ns, opType := opLabels(op)
+		t.metrics.skipped.Add(1, ns, opType)
+	}
+}
+
+// batchFailed records that applying a batch failed with err.
+func (t *tracker) batchFailed(b batch, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.failures = append(t.failures, err.Error())
+	t.batches++
+	// If we know which op failed, only count that one
+	failed := b.ops()
+	failedOpError, knowFailedOp := err.(*FailedOperationError)
+	if knowFailedOp {
+		failed = []interface{}{failedOpError.op}
+	}
+	if t.trace != nil {
+		now := time.Now()
+		for _, op := range b {
+			result := "batch failed: " + err.Error()
+			if knowFailedOp && reflect.DeepEqual(op.op, failedOpError.op) {
+				result = "failed"
+			}
+			// The replay is already failing, so there's no point reporting that the trace failed too
+			t.trace.Write(t.traceRecord(op, time.Time{}, now, result))
+		}
+	}
+	for _, op := range failed {
+		op := op.(map[string]interface{})
+		t.failed++
+		t.opCounts(op).Failed++
+		if t.metrics != nil {
+			ns, opType := opLabels(op)
+			t.metrics.failed.Add(1, ns, opType)
+		}
+	}
+}
+
+// replayFailed records an error that stopped the replay other than a failed batch.
+func (t *tracker) replayFailed(err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.failures = append(t.failures, err.Error())
+}
+
+// batchApplied records the timing of a batch that started being applied at started, and finished
+// at appliedAt. It returns an error if any op in the batch drifted further than maxDrift.
+func (t *tracker) batchApplied(b batch, started, appliedAt time.Time) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.batches++
+	if t.metrics != nil {
+		t.metrics.batchSize.Observe(float64(len(b)))
+		t.metrics.applyLatency.Observe(appliedAt.Sub(started).Seconds())
+	}
+	warmedUp := appliedAt.Sub(t.started) >= t.warmup
+	for _, op := range b {
+		t.applied++
+		t.opCounts(op.op).Applied++
+		if warmedUp {
+			t.recordLatency(op.op, appliedAt.Sub(started))
+			t.lag.Record(int64(appliedAt.Sub(op.scheduled)))
+		}
+		if t.metrics != nil {
+			ns, opType := opLabels(op.op)
+			t.metrics.applied.Add(1, ns, opType)
+			t.metrics.lag.Set(appliedAt.Sub(op.scheduled).Seconds())
+			if ts, ok := op.op["ts"].(bson.MongoTimestamp); ok {
+				t.metrics.timestamp.Set(float64(ts >> 32))
+			}
+		}
+		if ts, ok := op.op["ts"].(bson.MongoTimestamp); ok {
+			if t.firstTs == 0 {
+				t.firstTs = ts
+			}
+			t.lastTs = ts
+		}
+		if op.scheduled.After(t.lastScheduled) {
+			t.lastScheduled = op.scheduled
+		}
+		if t.trace != nil {
+			if err := t.trace.Write(t.traceRecord(op, started, appliedAt, "ok")); err != nil {
+				return err
+			}
+		}
+		drift := op.released.Sub(op.scheduled)
+		if drift > t.worstDrift {
+			t.worstDrift = drift
+		}
+		if t.maxDrift > 0 && drift > t.maxDrift {
+			return fmt.Errorf("Operation %v was released %v behind schedule, more than the maximum drift of %v",
+				op.op, drift, t.maxDrift)
+		}
+	}
+	return nil
+}
+
+// summary describes the lag and drift so far.
+func (t *tracker) summary() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return fmt.Sprintf("Applied %d ops. Schedule lag p50: %v, p90: %v, p99: %v, max: %v. Max drift: %v",
+		t.applied, time.Duration(t.lag.Quantile(0.5)), time.Duration(t.lag.Quantile(0.9)),
+		time.Duration(t.lag.Quantile(0.99)), time.Duration(t.lag.Max()), t.worstDrift)
+}
+
+// recordLatency records the latency of an op, overall and for its namespace and type. The lock
+// must be held.
+func (t *tracker) recordLatency(op map[string]interface{}, latency time.Duration) {
+	t.latency.Record(int64(latency))
+	ns, opType := opLabels(op)
+	key := [2]string{ns, opType}
+	if t.latencies[key] == nil {
+		t.latencies[key] = histogram.New()
+	}
+	t.latencies[key].Record(int64(latency))
+}
+
+// traceRecord returns the trace record for an op in the current batch. The lock must be held.
+func (t *tracker) traceRecord(op timedOp, started, appliedAt time.Time, result string) trace.Record {
+	r := trace.Record{
+		Ns:        fmt.Sprint(op.op["ns"]),
+		Op:        fmt.Sprint(op.op["op"]),
+		ID:        formatID(op.op),
+		Batch:     t.batches,
+		Scheduled: op.scheduled,
+		Applied:   appliedAt,
+		Result:    result,
+	}
+	if !started.IsZero() {
+		r.Latency = appliedAt.Sub(started)
+	}
+	if ts, ok := op.op["ts"].(bson.MongoTimestamp); ok {
+		r.Ts = bsonScanner.FormatTimestamp(ts)
+	}
+	switch h := op.op["h"].(type) {
+	case int64:
+		r.H = h
+	case int:
+		r.H = int64(h)
+	}
+	return r
+}
+
+// formatID returns the _id of the document an op affects, or "" if it doesn't have one.
+func formatID(op map[string]interface{}) string {
+	doc := op["o"]
+	if op["op"] == "u" {
+		doc = op["o2"]
+	}
+	id, ok := transform.Lookup(doc, "_id")
+	if !ok {
+		return ""
+	}
+	if objectID, ok := id.(bson.ObjectId); ok {
+		return objectID.Hex()
+	}
+	return fmt.Sprint(id)
+}
+
+// stats summarizes the replay so far.
+func (t *tracker) stats() Stats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	stats := Stats{
+		Read:            t.read,
+		Applied:         t.applied,
+		Skipped:         t.skipped,
+		Failed:          t.failed,
+		Ops:             map[string]map[string]*OpCounts{},
+		DurationSeconds: time.Now().Sub(t.started).Seconds(),
+		Latency:         percentiles(t.latency),
+		Lag:             percentiles(t.lag),
+		MaxDriftSeconds: t.worstDrift.Seconds(),
+		Failures:        append([]string{}, t.failures...),
+		latencies:       map[[2]string]*histogram.Histogram{},
+	}
+	for ns, counts := range t.counts {
+		stats.Ops[ns] = map[string]*OpCounts{}
+		for opType, c := range counts {
+			copied := *c
+			if h, ok := t.latencies[[2]string{ns, opType}]; ok {
+				latency := percentiles(h)
+				copied.Latency = &latency
+				copiedHistogram := histogram.New()
+				copiedHistogram.Merge(h)
+				stats.latencies[[2]string{ns, opType}] = copiedHistogram
+			}
+			stats.Ops[ns][opType] = &copied
+		}
+	}
+	if t.firstTs != 0 {
+		stats.FirstTimestamp, stats.LastTimestamp = bsonScanner.FormatTimestamp(t.firstTs), bsonScanner.FormatTimestamp(t.lastTs)
+		stats.OplogStart = time.Unix(int64(t.firstTs>>32), 0).UTC().Format(time.RFC3339)
+		stats.OplogEnd = time.Unix(int64(t.lastTs>>32), 0).UTC().Format(time.RFC3339)
+		stats.OplogSpanSeconds = float64(t.lastTs>>32 - t.firstTs>>32)
+	}
+	if stats.DurationSeconds > 0 {
+		stats.SpeedFactor = stats.OplogSpanSeconds / stats.DurationSeconds
+	}
+	return stats
+}
+
+// progress is a snapshot of how far along a replay is.
+type progress struct {
+	Applied   int     `json:"applied"`
+	Skipped   int     `json:"skipped"`
+	Timestamp string  `json:"ts,omitempty"`
+	OplogTime string  `json:"oplogTime,omitempty"`
+	BytesRead int64   `json:"bytesRead"`
+	InputSize int64   `json:"inputSize,omitempty"`
+	OpsPerSec float64 `json:"opsPerSec"`
+	// ETA is how much longer the replay is expected to take, or 0 if it can't be estimated
+	ETA        time.Duration `json:"-"`
+	LagP99     time.Duration `json:"-"`
+	WorstDrift time.Duration `json:"-"`
+}
+
+// MarshalJSON encodes the progress with its durations in seconds.
+func (p progress) MarshalJSON() ([]byte, error) {
+	type fields progress
+	return json.Marshal(struct {
+		fields
+		ETA        float64 `json:"etaSeconds,omitempty"`
+		LagP99     float64 `json:"lagP99Seconds"`
+		WorstDrift float64 `json:"maxDriftSeconds"`
+	}{fields(p), p.ETA.Seconds(), p.LagP99.Seconds(), p.WorstDrift.Seconds()})
+}
+
+func (p progress) String() string {
+	s := fmt.Sprintf("Applied %d ops (%d skipped)", p.Applied, p.Skipped)
+	if p.Timestamp != "" {
+		s += fmt.Sprintf(", at ts %s (%s)", p.Timestamp, p.OplogTime)
+	}
+	s += fmt.Sprintf(", read %s", FormatBytes(p.BytesRead))
+	if p.InputSize > 0 {
+		s += fmt.Sprintf(" of %s (%.1f%%)", FormatBytes(p.InputSize), 100*float64(p.BytesRead)/float64(p.InputSize))
+	}
+	s += fmt.Sprintf(", %.1f ops/sec", p.OpsPerSec)
+	if p.ETA > 0 {
+		s += fmt.Sprintf(", ETA %v", p.ETA)
+	}
+	return s + fmt.Sprintf(". Schedule lag p99: %v, max drift: %v", p.LagP99, p.WorstDrift)
+}
+
+// progress returns a snapshot of the replay's progress. The ops per second are measured since
+// the last call to progress.
+func (t *tracker) progress() progress {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := time.Now()
+	p := progress{
+		Applied:    t.applied,
+		Skipped:    t.skipped,
+		BytesRead:  t.bytesRead,
+		InputSize:  t.inputSize,
+		LagP99:     time.Duration(t.lag.Quantile(0.99)),
+		WorstDrift: t.worstDrift,
+	}
+	if t.lastTs != 0 {
+		p.Timestamp = bsonScanner.FormatTimestamp(t.lastTs)
+		p.OplogTime = time.Unix(int64(t.lastTs>>32), 0).UTC().Format(time.RFC3339)
+	}
+	if interval := now.Sub(t.lastProgressAt).Seconds(); interval > 0 {
+		p.OpsPerSec = float64(t.applied-t.lastProgressApplied) / interval
+	}
+	t.lastProgressAt, t.lastProgressApplied = now, t.applied
+
+	// Assume the rest of the input will take as long to get through on the controller's schedule
+	// as what's been read so far did. Going by the schedule rather than how long it's actually
+	// taken means the ETA isn't thrown off by lag.
+	if t.inputSize > 0 && t.bytesRead > 0 && !t.lastScheduled.IsZero() {
+		fractionRead := float64(t.bytesRead) / float64(t.inputSize)
+		scheduledSoFar := t.lastScheduled.Sub(t.started)
+		end := t.started.Add(time.Duration(float64(scheduledSoFar) / fractionRead))
+		if eta := end.Sub(now); eta > 0 {
+			p.ETA = eta - eta%time.Second
+		}
+	}
+	return p
+}
+
+// FormatBytes formats a byte count in megabytes, e.g. "12.5MB".
+func FormatBytes(n int64) string {
+	return fmt.Sprintf("%.1fMB", float64(n)/(1024*1024))
+}
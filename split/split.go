@@ -0,0 +1,419 @@
+// Package split partitions an oplog dump into several dumps, by time, size or namespace.
+package split
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	bsonScanner "github.com/Clever/oplog-replay/bson"
+	"github.com/Clever/oplog-replay/filter"
+	"github.com/Clever/pathio"
+	"labix.org/v2/mgo/bson"
+)
+
+// maxOpenFiles is the most spool files kept open at once. Splitting by namespace can have a part
+// open for every collection, so the least recently written ones are closed, and reopened if more
+// ops come for them.
+var maxOpenFiles = 64
+
+// Options configure how a dump is split.
+type Options struct {
+	// Path is the template for the path (local or s3://) of each part. It can contain these
+	// placeholders, and ops are split into a part for each value they take:
+	//
+	//	{ns}      the namespace, e.g. "app.users"
+	//	{db}      the database, e.g. "app"
+	//	{coll}    the collection, e.g. "users"
+	//	{group}   the Name of the first of the Groups that matches the namespace
+	//	{date}    the day of the op's ts, e.g. "2015-10-16"
+	//	{hour}    the hour of the op's ts, e.g. "2015-10-16T12"
+	//	{window}  the start of the op's Window, e.g. "20151016T125000Z"
+	//	{part}    a counter that goes up each time a part reaches MaxBytes or MaxOps
+	//
+	// "/", "\" and "%" in the names are escaped as "%2F", "%5C" and "%25", and the dots of a name
+	// that's just "." or ".." as "%2E", so a part can't be written outside the directory it's meant
+	// for.
+	Path string
+	// Window splits the ops into windows of oplog time of this length. Path must use {window}.
+	Window time.Duration
+	// MaxBytes and MaxOps start a new part when one would get bigger. Path must use {part}.
+	MaxBytes int64
+	MaxOps   int
+	// Filter, if set, selects which ops are written. The rest are skipped.
+	Filter *filter.Filter
+	// Groups split the ops by namespace pattern. Path must use {group}. Ops in namespaces that
+	// none of them match are skipped.
+	Groups []Group
+}
+
+// Group names the ops in the namespaces that match any of its patterns.
+type Group struct {
+	Name string
+	// Patterns use path.Match syntax, e.g. "app.*".
+	Patterns []string
+}
+
+// ParseGroups parses semicolon separated groups given as "<name>=<pattern>[,<pattern>...]", e.g.
+// "users=app.users,app.profiles;logs=logs.*".
+func ParseGroups(spec string) ([]Group, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	groups := []Group{}
+	for _, group := range strings.Split(spec, ";") {
+		parts := strings.SplitN(group, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid group %q: expected <name>=<pattern>[,<pattern>...]", group)
+		}
+		groups = append(groups, Group{Name: parts[0], Patterns: strings.Split(parts[1], ",")})
+	}
+	return groups, nil
+}
+
+// group returns the name of the first group that matches ns, and false if none do.
+func (o Options) group(ns string) (string, bool) {
+	for _, group := range o.Groups {
+		for _, pattern := range group.Patterns {
+			if matched, _ := path.Match(pattern, ns); matched {
+				return group.Name, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (o Options) validate() error {
+	if (o.MaxBytes > 0 || o.MaxOps > 0) && !strings.Contains(o.Path, "{part}") {
+		return fmt.Errorf("The path must contain {part} to split by size")
+	}
+	if (o.Window > 0) != strings.Contains(o.Path, "{window}") {
+		return fmt.Errorf("The path must contain {window} if and only if a window is set")
+	}
+	if o.Window > 0 && o.Window%time.Second != 0 {
+		return fmt.Errorf("The window must be a whole number of seconds")
+	}
+	if (len(o.Groups) > 0) != strings.Contains(o.Path, "{group}") {
+		return fmt.Errorf("The path must contain {group} if and only if there are groups")
+	}
+	for _, group := range o.Groups {
+		for _, pattern := range group.Patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("Invalid pattern %q in group %s: %s", pattern, group.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Manifest lists the parts a dump was split into.
+type Manifest struct {
+	Parts []Part `json:"parts"`
+	// Ops is how many ops were written, and Skipped how many didn't match the Filter or any of
+	// the Groups.
+	Ops     int `json:"ops"`
+	Skipped int `json:"skipped"`
+}
+
+// Part is one of the dumps written.
+type Part struct {
+	Path string `json:"path"`
+	// The oplog timestamps of the first and last ops in the part, as "seconds:increment"
+	FirstTimestamp string `json:"firstTs"`
+	LastTimestamp  string `json:"lastTs"`
+	// The same timestamps as RFC3339 times
+	OplogStart string `json:"oplogStart"`
+	OplogEnd   string `json:"oplogEnd"`
+	Ops        int    `json:"ops"`
+	Bytes      int64  `json:"bytes"`
+}
+
+// part is a part being written. Parts are spooled to a local file until they're finished, since
+// writing to S3 needs the length up front.
+type part struct {
+	Part
+	// file is the spool file, or nil if it's been closed to make room for others
+	file            *os.File
+	spool           string
+	firstTs, lastTs bson.MongoTimestamp
+	key             string
+	// started orders the parts by when they were started, and written by when they were last
+	// written to
+	started int
+	written int
+}
+
+// byStarted sorts parts by when they were started.
+type byStarted []*part
+
+func (p byStarted) Len() int           { return len(p) }
+func (p byStarted) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+func (p byStarted) Less(i, j int) bool { return p[i].started < p[j].started }
+
+// splitter holds the state of a Split.
+type splitter struct {
+	options Options
+	// open are the parts being written, by their path before {part} is filled in
+	open map[string]*part
+	// counts are the number of parts started for each key
+	counts map[string]int
+	// written are the paths already written, to catch parts that would be overwritten
+	written map[string]bool
+	// timeBucket is the values of the time placeholders for the last op
+	timeBucket string
+	started    int
+	writes     int
+	// files is the number of open spool files
+	files    int
+	manifest Manifest
+}
+
+// Split writes the ops in r to parts as described by the options. The manifest lists the parts in
+// the order they were finished.
+func Split(r io.Reader, options Options) (Manifest, error) {
+	if err := options.validate(); err != nil {
+		return Manifest{}, err
+	}
+	s := &splitter{
+		options:  options,
+		open:     map[string]*part{},
+		counts:   map[string]int{},
+		written:  map[string]bool{},
+		manifest: Manifest{Parts: []Part{}},
+	}
+	defer s.cleanUp()
+
+	scanner := bsonScanner.New(r)
+	for scanner.Scan() {
+		raw := scanner.Bytes()
+		op := map[string]interface{}{}
+		if err := bson.Unmarshal(raw, &op); err != nil {
+			return s.manifest, err
+		}
+		if !options.Filter.Match(op) {
+			s.manifest.Skipped++
+			continue
+		}
+		if ns, _ := op["ns"].(string); len(options.Groups) > 0 {
+			if _, ok := options.group(ns); !ok {
+				s.manifest.Skipped++
+				continue
+			}
+		}
+		if err := s.add(op, raw); err != nil {
+			return s.manifest, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return s.manifest, err
+	}
+	return s.manifest, s.finishAll()
+}
+
+// add writes an op to the part it belongs in.
+func (s *splitter) add(op map[string]interface{}, raw []byte) error {
+	ts, _ := op["ts"].(bson.MongoTimestamp)
+	fields := s.fields(op, ts)
+	// Oplogs are in ts order, so once ops are in a new day, hour or window, the parts for the
+	// previous ones can be finished
+	if bucket := fields["{date}"] + fields["{hour}"] + fields["{window}"]; bucket != s.timeBucket {
+		if err := s.finishAll(); err != nil {
+			return err
+		}
+		s.timeBucket = bucket
+	}
+
+	key := s.options.Path
+	for placeholder, value := range fields {
+		key = strings.Replace(key, placeholder, value, -1)
+	}
+	p := s.open[key]
+	if p != nil && ((s.options.MaxOps > 0 && p.Ops+1 > s.options.MaxOps) ||
+		(s.options.MaxBytes > 0 && p.Bytes+int64(len(raw)) > s.options.MaxBytes)) {
+		if err := s.finish(p); err != nil {
+			return err
+		}
+		p = nil
+	}
+	if p == nil {
+		var err error
+		if p, err = s.start(key); err != nil {
+			return err
+		}
+	}
+
+	if err := s.write(p, raw); err != nil {
+		return err
+	}
+	if p.Ops == 0 {
+		p.firstTs = ts
+	}
+	p.lastTs = ts
+	p.Ops++
+	p.Bytes += int64(len(raw))
+	s.manifest.Ops++
+	return nil
+}
+
+// fields returns the values of the placeholders other than {part} for an op.
+func (s *splitter) fields(op map[string]interface{}, ts bson.MongoTimestamp) map[string]string {
+	ns, _ := op["ns"].(string)
+	db, coll := ns, ""
+	if i := strings.Index(ns, "."); i >= 0 {
+		db, coll = ns[:i], ns[i+1:]
+	}
+	t := time.Unix(int64(ts>>32), 0).UTC()
+	fields := map[string]string{"{ns}": escape(ns), "{db}": escape(db), "{coll}": escape(coll)}
+	if group, ok := s.options.group(ns); ok {
+		fields["{group}"] = escape(group)
+	}
+	if strings.Contains(s.options.Path, "{date}") {
+		fields["{date}"] = t.Format("2006-01-02")
+	}
+	if strings.Contains(s.options.Path, "{hour}") {
+		fields["{hour}"] = t.Format("2006-01-02T15")
+	}
+	if s.options.Window > 0 {
+		window := int64(s.options.Window / time.Second)
+		fields["{window}"] = time.Unix(t.Unix()/window*window, 0).UTC().Format("20060102T150405Z")
+	}
+	return fields
+}
+
+// start starts a new part for a key.
+func (s *splitter) start(key string) (*part, error) {
+	path := strings.Replace(key, "{part}", strconv.Itoa(s.counts[key]), -1)
+	if s.written[path] {
+		return nil, fmt.Errorf("%s would be written twice. Is the oplog out of order?", path)
+	}
+	s.written[path] = true
+	s.counts[key]++
+
+	if err := s.makeRoom(); err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile("", "oplog-replay-split")
+	if err != nil {
+		return nil, err
+	}
+	s.files++
+	s.started++
+	p := &part{Part: Part{Path: path}, file: file, spool: file.Name(), key: key, started: s.started}
+	s.open[key] = p
+	return p, nil
+}
+
+// write appends an op to a part's spool file, reopening it if it was closed.
+func (s *splitter) write(p *part, raw []byte) error {
+	if p.file == nil {
+		if err := s.makeRoom(); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(p.spool, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			return err
+		}
+		p.file = file
+		s.files++
+	}
+	s.writes++
+	p.written = s.writes
+	_, err := p.file.Write(raw)
+	return err
+}
+
+// makeRoom closes the spool file of the least recently written part if another can't be opened.
+func (s *splitter) makeRoom() error {
+	if s.files < maxOpenFiles {
+		return nil
+	}
+	var oldest *part
+	for _, p := range s.open {
+		if p.file != nil && (oldest == nil || p.written < oldest.written) {
+			oldest = p
+		}
+	}
+	if oldest == nil {
+		return nil
+	}
+	return s.closeFile(oldest)
+}
+
+// closeFile closes a part's spool file, if it's open.
+func (s *splitter) closeFile(p *part) error {
+	if p.file == nil {
+		return nil
+	}
+	err := p.file.Close()
+	p.file = nil
+	s.files--
+	return err
+}
+
+// finish writes a part to its path and adds it to the manifest.
+func (s *splitter) finish(p *part) error {
+	delete(s.open, p.key)
+	defer os.Remove(p.spool)
+	if err := s.closeFile(p); err != nil {
+		return err
+	}
+	spool, err := os.Open(p.spool)
+	if err != nil {
+		return err
+	}
+	defer spool.Close()
+
+	if !strings.HasPrefix(p.Path, "s3://") {
+		if err := os.MkdirAll(filepath.Dir(p.Path), 0755); err != nil {
+			return err
+		}
+	}
+	if err := pathio.WriteReader(p.Path, spool, p.Bytes); err != nil {
+		return err
+	}
+
+	p.FirstTimestamp, p.LastTimestamp = bsonScanner.FormatTimestamp(p.firstTs), bsonScanner.FormatTimestamp(p.lastTs)
+	p.OplogStart = time.Unix(int64(p.firstTs>>32), 0).UTC().Format(time.RFC3339)
+	p.OplogEnd = time.Unix(int64(p.lastTs>>32), 0).UTC().Format(time.RFC3339)
+	s.manifest.Parts = append(s.manifest.Parts, p.Part)
+	return nil
+}
+
+// finishAll finishes every open part, in the order they were started.
+func (s *splitter) finishAll() error {
+	open := []*part{}
+	for _, p := range s.open {
+		open = append(open, p)
+	}
+	sort.Sort(byStarted(open))
+	for _, p := range open {
+		if err := s.finish(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cleanUp removes the spool files of any parts left open by an error.
+func (s *splitter) cleanUp() {
+	for _, p := range s.open {
+		s.closeFile(p)
+		os.Remove(p.spool)
+	}
+}
+
+// escape escapes a namespace, database or collection name for use in a path.
+func escape(name string) string {
+	name = strings.NewReplacer("%", "%25", "/", "%2F", "\\", "%5C").Replace(name)
+	if name == "." || name == ".." {
+		name = strings.Replace(name, ".", "%2E", -1)
+	}
+	return name
+}
@@ -0,0 +1,217 @@
+package split
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	bsonScanner "github.com/Clever/oplog-replay/bson"
+	"github.com/Clever/oplog-replay/filter"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+// 2015-10-16T12:53:20Z
+const start = 1445000000
+
+func oplog(t *testing.T, ops ...bson.M) *bytes.Buffer {
+	var buf bytes.Buffer
+	for _, op := range ops {
+		raw, err := bson.Marshal(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf.Write(raw)
+	}
+	return &buf
+}
+
+func insert(ns string, seconds int64) bson.M {
+	return bson.M{"ts": bson.MongoTimestamp(seconds << 32), "op": "i", "ns": ns, "o": bson.M{"_id": seconds}}
+}
+
+// count returns the number of ops in the dump at path.
+func count(t *testing.T, path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	scanner := bsonScanner.New(f)
+	for scanner.Scan() {
+		n++
+	}
+	assert.Nil(t, scanner.Err())
+	return n
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "split-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestSplitByNamespaceAndHour(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	r := oplog(t,
+		insert("app.users", start),
+		insert("logs.requests", start+1),
+		insert("app.orders", start+2),
+		insert("app.users", start+3600),
+	)
+	manifest, err := Split(r, Options{Path: filepath.Join(dir, "{db}", "{hour}.bson")})
+	assert.Nil(t, err)
+
+	assert.Equal(t, 4, manifest.Ops)
+	assert.Equal(t, []Part{
+		{Path: filepath.Join(dir, "app", "2015-10-16T12.bson"), FirstTimestamp: "1445000000:0", LastTimestamp: "1445000002:0",
+			OplogStart: "2015-10-16T12:53:20Z", OplogEnd: "2015-10-16T12:53:22Z", Ops: 2, Bytes: manifest.Parts[0].Bytes},
+		{Path: filepath.Join(dir, "logs", "2015-10-16T12.bson"), FirstTimestamp: "1445000001:0", LastTimestamp: "1445000001:0",
+			OplogStart: "2015-10-16T12:53:21Z", OplogEnd: "2015-10-16T12:53:21Z", Ops: 1, Bytes: manifest.Parts[1].Bytes},
+		{Path: filepath.Join(dir, "app", "2015-10-16T13.bson"), FirstTimestamp: "1445003600:0", LastTimestamp: "1445003600:0",
+			OplogStart: "2015-10-16T13:53:20Z", OplogEnd: "2015-10-16T13:53:20Z", Ops: 1, Bytes: manifest.Parts[2].Bytes},
+	}, manifest.Parts)
+	for _, part := range manifest.Parts {
+		assert.Equal(t, part.Ops, count(t, part.Path))
+		info, err := os.Stat(part.Path)
+		assert.Nil(t, err)
+		assert.Equal(t, part.Bytes, info.Size())
+	}
+}
+
+func TestSplitBySize(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ops := []bson.M{}
+	for i := int64(0); i < 5; i++ {
+		ops = append(ops, insert("app.users", start+i))
+	}
+	manifest, err := Split(oplog(t, ops...), Options{Path: filepath.Join(dir, "{part}.bson"), MaxOps: 2})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(manifest.Parts))
+	for i, expected := range []int{2, 2, 1} {
+		assert.Equal(t, filepath.Join(dir, []string{"0", "1", "2"}[i]+".bson"), manifest.Parts[i].Path)
+		assert.Equal(t, expected, count(t, manifest.Parts[i].Path))
+	}
+
+	// Each op is the same size, so a limit of just under 2 ops puts one in each part
+	size := int64(oplog(t, ops[0]).Len())
+	manifest, err = Split(oplog(t, ops...), Options{Path: filepath.Join(dir, "bytes-{part}.bson"), MaxBytes: 2*size - 1})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(manifest.Parts))
+}
+
+func TestSplitByWindow(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	r := oplog(t, insert("app.users", start), insert("app.users", start+39), insert("app.users", start+40))
+	manifest, err := Split(r, Options{Path: filepath.Join(dir, "{window}.bson"), Window: time.Minute})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(manifest.Parts))
+	assert.Equal(t, filepath.Join(dir, "20151016T125300Z.bson"), manifest.Parts[0].Path)
+	assert.Equal(t, 2, manifest.Parts[0].Ops)
+	assert.Equal(t, filepath.Join(dir, "20151016T125400Z.bson"), manifest.Parts[1].Path)
+}
+
+func TestSplitFilter(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	f, err := filter.New([]string{"app.*"}, nil, 0, 0)
+	assert.Nil(t, err)
+	r := oplog(t, insert("app.users", start), insert("logs.requests", start+1))
+	manifest, err := Split(r, Options{Path: filepath.Join(dir, "{ns}.bson"), Filter: f})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, manifest.Ops)
+	assert.Equal(t, 1, manifest.Skipped)
+	assert.Equal(t, 1, len(manifest.Parts))
+}
+
+func TestSplitByGroup(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	groups, err := ParseGroups("people=app.users,app.profiles;logs=logs.*")
+	assert.Nil(t, err)
+	r := oplog(t, insert("app.users", start), insert("logs.requests", start+1), insert("app.profiles", start+2),
+		insert("app.orders", start+3))
+	manifest, err := Split(r, Options{Path: filepath.Join(dir, "{group}.bson"), Groups: groups})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, manifest.Ops)
+	// No group matches app.orders
+	assert.Equal(t, 1, manifest.Skipped)
+	if assert.Equal(t, 2, len(manifest.Parts)) {
+		assert.Equal(t, filepath.Join(dir, "people.bson"), manifest.Parts[0].Path)
+		assert.Equal(t, 2, count(t, manifest.Parts[0].Path))
+		assert.Equal(t, filepath.Join(dir, "logs.bson"), manifest.Parts[1].Path)
+	}
+
+	for _, spec := range []string{"people", "=app.*", "people="} {
+		_, err := ParseGroups(spec)
+		assert.NotNil(t, err, spec)
+	}
+	_, err = Split(oplog(t), Options{Path: filepath.Join(dir, "{ns}.bson"), Groups: groups})
+	assert.NotNil(t, err)
+	_, err = Split(oplog(t), Options{Path: filepath.Join(dir, "{group}.bson"), Groups: []Group{{Name: "bad", Patterns: []string{"app.["}}}})
+	assert.NotNil(t, err)
+}
+
+func TestSplitOutOfOrder(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	r := oplog(t, insert("app.users", start), insert("app.users", start+3600), insert("app.users", start))
+	_, err := Split(r, Options{Path: filepath.Join(dir, "{hour}.bson")})
+	assert.NotNil(t, err)
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []Options{
+		{Path: "out.bson", MaxOps: 10},
+		{Path: "out.bson", Window: time.Hour},
+		{Path: "{window}.bson"},
+		{Path: "{window}.bson", Window: time.Millisecond},
+	} {
+		_, err := Split(&bytes.Buffer{}, options)
+		assert.NotNil(t, err, "%#v", options)
+	}
+}
+
+func TestSplitEscapesNames(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	r := oplog(t, insert("app.../../escaped", start), insert("app...", start+1), insert("app.100%", start+2))
+	manifest, err := Split(r, Options{Path: filepath.Join(dir, "{coll}.bson")})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(manifest.Parts))
+	assert.Equal(t, filepath.Join(dir, "..%2F..%2Fescaped.bson"), manifest.Parts[0].Path)
+	assert.Equal(t, filepath.Join(dir, "%2E%2E.bson"), manifest.Parts[1].Path)
+	assert.Equal(t, filepath.Join(dir, "100%25.bson"), manifest.Parts[2].Path)
+
+	manifest, err = Split(oplog(t, insert("app...", start)), Options{Path: filepath.Join(dir, "{coll}", "part.bson")})
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(dir, "%2E%2E", "part.bson"), manifest.Parts[0].Path)
+	assert.Equal(t, 1, count(t, manifest.Parts[0].Path))
+}
+
+func TestSplitLimitsOpenFiles(t *testing.T) {
+	defer func(max int) { maxOpenFiles = max }(maxOpenFiles)
+	maxOpenFiles = 2
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	ops := []bson.M{}
+	for i := int64(0); i < 20; i++ {
+		ops = append(ops, insert([]string{"app.a", "app.b", "app.c", "app.d", "app.e"}[i%5], start+i))
+	}
+	manifest, err := Split(oplog(t, ops...), Options{Path: filepath.Join(dir, "{ns}.bson")})
+	assert.Nil(t, err)
+	assert.Equal(t, 5, len(manifest.Parts))
+	for _, part := range manifest.Parts {
+		assert.Equal(t, 4, part.Ops)
+		assert.Equal(t, 4, count(t, part.Path))
+	}
+}
@@ -0,0 +1,187 @@
+package trace
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/Clever/oplog-replay/histogram"
+)
+
+// Comparison is an op that's in both of the traces being compared.
+type Comparison struct {
+	Base, Other Record
+}
+
+// Delta is how much slower the op was in the other trace.
+func (c Comparison) Delta() time.Duration {
+	return c.Other.Latency - c.Base.Latency
+}
+
+// NamespaceDiff compares the latency of one type of op in one namespace across two traces.
+type NamespaceDiff struct {
+	Ns, Op       string
+	Matched      int
+	Slower       int
+	BaseLatency  *histogram.Histogram
+	OtherLatency *histogram.Histogram
+}
+
+// Diff summarizes how a trace compares to a base trace.
+type Diff struct {
+	Matched     int
+	OnlyInBase  int
+	OnlyInOther int
+	// ResultChanged counts ops that were applied in one trace but not the other.
+	ResultChanged int
+	// Slower counts ops that took longer in the other trace.
+	Slower       int
+	BaseLatency  *histogram.Histogram
+	OtherLatency *histogram.Histogram
+	// Regressions are the ops that slowed down the most, slowest first.
+	Regressions []Comparison
+	// Namespaces breaks the comparison down by namespace and op type.
+	Namespaces []*NamespaceDiff
+}
+
+// key identifies an op across traces. Ops are matched on their ts and h. If more than one op has
+// the same ts and h, e.g. because the replay amplified them, they're matched in order.
+type key struct {
+	ts         string
+	h          int64
+	occurrence int
+}
+
+type keyer map[key]int
+
+func (k keyer) next(r Record) key {
+	base := key{ts: r.Ts, h: r.H}
+	occurrence := k[base]
+	k[base]++
+	base.occurrence = occurrence
+	return base
+}
+
+// Compare reads two traces and compares them, keeping the top slowest regressions. The base
+// trace is held in memory.
+func Compare(base, other *Reader, top int) (*Diff, error) {
+	baseRecords := map[key]Record{}
+	baseKeys := keyer{}
+	for {
+		r, err := base.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		baseRecords[baseKeys.next(r)] = r
+	}
+
+	diff := &Diff{BaseLatency: histogram.New(), OtherLatency: histogram.New()}
+	namespaces := map[[2]string]*NamespaceDiff{}
+	otherKeys := keyer{}
+	for {
+		r, err := other.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		k := otherKeys.next(r)
+		baseRecord, ok := baseRecords[k]
+		if !ok {
+			diff.OnlyInOther++
+			continue
+		}
+		delete(baseRecords, k)
+		diff.add(Comparison{Base: baseRecord, Other: r}, top, namespaces)
+	}
+	diff.OnlyInBase = len(baseRecords)
+
+	for _, n := range namespaces {
+		diff.Namespaces = append(diff.Namespaces, n)
+	}
+	sort.Sort(byNamespace(diff.Namespaces))
+	return diff, nil
+}
+
+func (d *Diff) add(c Comparison, top int, namespaces map[[2]string]*NamespaceDiff) {
+	d.Matched++
+	if c.Base.Result != c.Other.Result {
+		d.ResultChanged++
+	}
+	d.BaseLatency.Record(int64(c.Base.Latency))
+	d.OtherLatency.Record(int64(c.Other.Latency))
+
+	nsKey := [2]string{c.Base.Ns, c.Base.Op}
+	n, ok := namespaces[nsKey]
+	if !ok {
+		n = &NamespaceDiff{Ns: c.Base.Ns, Op: c.Base.Op, BaseLatency: histogram.New(), OtherLatency: histogram.New()}
+		namespaces[nsKey] = n
+	}
+	n.Matched++
+	n.BaseLatency.Record(int64(c.Base.Latency))
+	n.OtherLatency.Record(int64(c.Other.Latency))
+
+	if c.Delta() <= 0 {
+		return
+	}
+	d.Slower++
+	n.Slower++
+	// Insert into the regressions, which are kept sorted slowest first
+	i := sort.Search(len(d.Regressions), func(i int) bool { return d.Regressions[i].Delta() < c.Delta() })
+	if i >= top {
+		return
+	}
+	d.Regressions = append(d.Regressions, Comparison{})
+	copy(d.Regressions[i+1:], d.Regressions[i:])
+	d.Regressions[i] = c
+	if len(d.Regressions) > top {
+		d.Regressions = d.Regressions[:top]
+	}
+}
+
+type byNamespace []*NamespaceDiff
+
+func (n byNamespace) Len() int      { return len(n) }
+func (n byNamespace) Swap(i, j int) { n[i], n[j] = n[j], n[i] }
+func (n byNamespace) Less(i, j int) bool {
+	if n[i].Ns != n[j].Ns {
+		return n[i].Ns < n[j].Ns
+	}
+	return n[i].Op < n[j].Op
+}
+
+func quantile(h *histogram.Histogram, q float64) time.Duration {
+	return time.Duration(h.Quantile(q))
+}
+
+// WriteSummary writes a human readable summary of the diff.
+func (d *Diff) WriteSummary(w io.Writer) {
+	fmt.Fprintf(w, "Matched %d ops (%d only in base, %d only in other, %d with a different result)\n",
+		d.Matched, d.OnlyInBase, d.OnlyInOther, d.ResultChanged)
+	fmt.Fprintf(w, "%d ops were slower\n", d.Slower)
+	fmt.Fprintf(w, "Latency p50: %v -> %v, p99: %v -> %v, max: %v -> %v\n\n",
+		quantile(d.BaseLatency, 0.5), quantile(d.OtherLatency, 0.5),
+		quantile(d.BaseLatency, 0.99), quantile(d.OtherLatency, 0.99),
+		time.Duration(d.BaseLatency.Max()), time.Duration(d.OtherLatency.Max()))
+
+	fmt.Fprintf(w, "%-40s %-3s %8s %8s %12s %12s %12s %12s\n", "ns", "op", "matched", "slower",
+		"base p50", "other p50", "base p99", "other p99")
+	for _, n := range d.Namespaces {
+		fmt.Fprintf(w, "%-40s %-3s %8d %8d %12v %12v %12v %12v\n", n.Ns, n.Op, n.Matched, n.Slower,
+			quantile(n.BaseLatency, 0.5), quantile(n.OtherLatency, 0.5),
+			quantile(n.BaseLatency, 0.99), quantile(n.OtherLatency, 0.99))
+	}
+
+	if len(d.Regressions) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\nLargest regressions:\n")
+	fmt.Fprintf(w, "%-22s %-30s %-3s %-26s %12s %12s %12s\n", "ts", "ns", "op", "_id", "base", "other", "delta")
+	for _, c := range d.Regressions {
+		fmt.Fprintf(w, "%-22s %-30s %-3s %-26s %12v %12v %12v\n", c.Other.Ts, c.Other.Ns, c.Other.Op,
+			c.Other.ID, c.Base.Latency, c.Other.Latency, c.Delta())
+	}
+}
@@ -0,0 +1,232 @@
+// Package trace reads and writes per-operation traces of replays, so that runs against
+// different targets can be compared op by op.
+package trace
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Record is what happened to a single op in a replay.
+type Record struct {
+	// Ts is the op's oplog timestamp, as "seconds:increment".
+	Ts string `json:"ts"`
+	// H is the op's unique id in the oplog, if it has one.
+	H  int64  `json:"h"`
+	Ns string `json:"ns"`
+	Op string `json:"op"`
+	// ID is the _id of the document the op affects, if there is one.
+	ID string `json:"_id,omitempty"`
+	// Batch identifies the applyOps batch the op was in.
+	Batch     int       `json:"batch"`
+	Scheduled time.Time `json:"scheduled"`
+	Applied   time.Time `json:"applied"`
+	// Latency is how long the op's applyOps batch took.
+	Latency time.Duration `json:"latencyNs"`
+	// Result is "ok" if the op was applied, or why it wasn't.
+	Result string `json:"result"`
+}
+
+var csvHeader = []string{"ts", "h", "ns", "op", "_id", "batch", "scheduled", "applied", "latency_ns", "result"}
+
+func (r Record) csvRow() []string {
+	return []string{r.Ts, strconv.FormatInt(r.H, 10), r.Ns, r.Op, r.ID, strconv.Itoa(r.Batch),
+		r.Scheduled.Format(time.RFC3339Nano), r.Applied.Format(time.RFC3339Nano),
+		strconv.FormatInt(int64(r.Latency), 10), r.Result}
+}
+
+func parseCSVRow(row []string) (Record, error) {
+	if len(row) != len(csvHeader) {
+		return Record{}, fmt.Errorf("Expected %d columns, got %d", len(csvHeader), len(row))
+	}
+	r := Record{Ts: row[0], Ns: row[2], Op: row[3], ID: row[4], Result: row[9]}
+	var err error
+	if r.H, err = strconv.ParseInt(row[1], 10, 64); err != nil {
+		return r, err
+	}
+	if r.Batch, err = strconv.Atoi(row[5]); err != nil {
+		return r, err
+	}
+	if r.Scheduled, err = time.Parse(time.RFC3339Nano, row[6]); err != nil {
+		return r, err
+	}
+	if r.Applied, err = time.Parse(time.RFC3339Nano, row[7]); err != nil {
+		return r, err
+	}
+	latency, err := strconv.ParseInt(row[8], 10, 64)
+	r.Latency = time.Duration(latency)
+	return r, err
+}
+
+// Format is how a trace is encoded.
+type Format int
+
+const (
+	// JSONL writes one JSON object per line.
+	JSONL Format = iota
+	// CSV writes a header row followed by one row per record.
+	CSV
+)
+
+// FormatFromPath works out a trace's format from its file name: CSV if it ends in ".csv" or
+// ".csv.gz", and JSONL otherwise. It's gzipped if the name ends in ".gz".
+func FormatFromPath(path string) (format Format, gzipped bool) {
+	gzipped = strings.HasSuffix(path, ".gz")
+	if strings.HasSuffix(strings.TrimSuffix(path, ".gz"), ".csv") {
+		return CSV, gzipped
+	}
+	return JSONL, gzipped
+}
+
+// Writer writes trace records.
+type Writer struct {
+	format  Format
+	closers []io.Closer
+	buf     *bufio.Writer
+	gz      *gzip.Writer
+	csv     *csv.Writer
+	json    *json.Encoder
+}
+
+// NewWriter returns a Writer that writes records to w in the given format, optionally gzipped.
+func NewWriter(w io.Writer, format Format, gzipped bool) *Writer {
+	writer := &Writer{format: format, buf: bufio.NewWriter(w)}
+	out := io.Writer(writer.buf)
+	if gzipped {
+		writer.gz = gzip.NewWriter(out)
+		out = writer.gz
+	}
+	if format == CSV {
+		writer.csv = csv.NewWriter(out)
+		writer.csv.Write(csvHeader)
+	} else {
+		writer.json = json.NewEncoder(out)
+	}
+	return writer
+}
+
+// Create creates a trace file at path, with the format given by FormatFromPath.
+func Create(path string) (*Writer, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	format, gzipped := FormatFromPath(path)
+	writer := NewWriter(file, format, gzipped)
+	writer.closers = append(writer.closers, file)
+	return writer, nil
+}
+
+// Write writes a record.
+func (w *Writer) Write(r Record) error {
+	if w.format == CSV {
+		w.csv.Write(r.csvRow())
+		return w.csv.Error()
+	}
+	return w.json.Encode(r)
+}
+
+// Close flushes any buffered records, and closes the file if the Writer was created by Create.
+func (w *Writer) Close() error {
+	if w.csv != nil {
+		w.csv.Flush()
+		if err := w.csv.Error(); err != nil {
+			return err
+		}
+	}
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			return err
+		}
+	}
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	for _, closer := range w.closers {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reader reads trace records.
+type Reader struct {
+	closers []io.Closer
+	csv     *csv.Reader
+	json    *json.Decoder
+}
+
+// NewReader returns a Reader that reads records from r in the given format, optionally gzipped.
+func NewReader(r io.Reader, format Format, gzipped bool) (*Reader, error) {
+	reader := &Reader{}
+	if gzipped {
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		reader.closers = append(reader.closers, gz)
+		r = gz
+	}
+	if format == CSV {
+		reader.csv = csv.NewReader(r)
+		header, err := reader.csv.Read()
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if err == nil && strings.Join(header, ",") != strings.Join(csvHeader, ",") {
+			return nil, fmt.Errorf("Unexpected trace header %v", header)
+		}
+	} else {
+		reader.json = json.NewDecoder(r)
+	}
+	return reader, nil
+}
+
+// Open opens the trace file at path, with the format given by FormatFromPath.
+func Open(path string) (*Reader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	format, gzipped := FormatFromPath(path)
+	reader, err := NewReader(bufio.NewReader(file), format, gzipped)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	reader.closers = append(reader.closers, file)
+	return reader, nil
+}
+
+// Read returns the next record, or io.EOF when there are none left.
+func (r *Reader) Read() (Record, error) {
+	var record Record
+	if r.csv != nil {
+		row, err := r.csv.Read()
+		if err != nil {
+			return record, err
+		}
+		return parseCSVRow(row)
+	}
+	err := r.json.Decode(&record)
+	return record, err
+}
+
+// Close closes the underlying file if the Reader was created by Open.
+func (r *Reader) Close() error {
+	for _, closer := range r.closers {
+		if err := closer.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package trace
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func records(latencies ...time.Duration) []Record {
+	applied := time.Date(2015, 10, 16, 12, 53, 20, 0, time.UTC)
+	rs := []Record{}
+	for i, latency := range latencies {
+		rs = append(rs, Record{
+			Ts:        "1445000000:" + string('0'+rune(i)),
+			H:         int64(1000 + i),
+			Ns:        "testdb.test",
+			Op:        "i",
+			ID:        "ObjectIdHex(\"5620f2a0c2a5d4a3b8000001\")",
+			Batch:     i / 2,
+			Scheduled: applied.Add(-time.Second),
+			Applied:   applied,
+			Latency:   latency,
+			Result:    "ok",
+		})
+	}
+	return rs
+}
+
+func roundTrip(t *testing.T, rs []Record, format Format, gzipped bool) *Reader {
+	var buf bytes.Buffer
+	w := NewWriter(&buf, format, gzipped)
+	for _, r := range rs {
+		assert.Nil(t, w.Write(r))
+	}
+	assert.Nil(t, w.Close())
+	reader, err := NewReader(&buf, format, gzipped)
+	assert.Nil(t, err)
+	return reader
+}
+
+func TestRoundTrip(t *testing.T) {
+	rs := records(time.Millisecond, 2*time.Millisecond)
+	for _, format := range []Format{JSONL, CSV} {
+		for _, gzipped := range []bool{false, true} {
+			reader := roundTrip(t, rs, format, gzipped)
+			for _, expected := range rs {
+				r, err := reader.Read()
+				assert.Nil(t, err)
+				assert.True(t, expected.Scheduled.Equal(r.Scheduled))
+				assert.True(t, expected.Applied.Equal(r.Applied))
+				r.Scheduled, r.Applied = expected.Scheduled, expected.Applied
+				assert.Equal(t, expected, r)
+			}
+			_, err := reader.Read()
+			assert.Equal(t, io.EOF, err)
+		}
+	}
+}
+
+func TestFormatFromPath(t *testing.T) {
+	format, gzipped := FormatFromPath("trace.csv.gz")
+	assert.Equal(t, CSV, format)
+	assert.True(t, gzipped)
+	format, gzipped = FormatFromPath("trace.jsonl")
+	assert.Equal(t, JSONL, format)
+	assert.False(t, gzipped)
+}
+
+func TestCompare(t *testing.T) {
+	base := records(time.Millisecond, time.Millisecond, time.Millisecond, time.Millisecond)
+	other := records(time.Millisecond, 5*time.Millisecond, 3*time.Millisecond, time.Millisecond)
+	other[3].Result = "failed"
+	// An op that's only in one of the traces
+	base = append(base, records(0, 0, 0, 0, 0)[4])
+
+	diff, err := Compare(roundTrip(t, base, JSONL, false), roundTrip(t, other, CSV, true), 1)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, diff.Matched)
+	assert.Equal(t, 1, diff.OnlyInBase)
+	assert.Equal(t, 0, diff.OnlyInOther)
+	assert.Equal(t, 1, diff.ResultChanged)
+	assert.Equal(t, 2, diff.Slower)
+	assert.Equal(t, 1, len(diff.Regressions))
+	assert.Equal(t, "1445000000:1", diff.Regressions[0].Other.Ts)
+	assert.Equal(t, 4*time.Millisecond, diff.Regressions[0].Delta())
+	assert.Equal(t, 1, len(diff.Namespaces))
+	assert.Equal(t, 2, diff.Namespaces[0].Slower)
+
+	var summary bytes.Buffer
+	diff.WriteSummary(&summary)
+	assert.Contains(t, summary.String(), "Matched 4 ops (1 only in base, 0 only in other, 1 with a different result)")
+	assert.Contains(t, summary.String(), "Largest regressions")
+}
@@ -0,0 +1,148 @@
+// Package amplify is a transform stage that fans each op out into copies with their own
+// identities, to simulate a bigger workload than the one recorded.
+package amplify
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/Clever/oplog-replay/transform"
+	"labix.org/v2/mgo/bson"
+)
+
+// Field is a field holding ids that have to be rewritten like _ids, e.g. a foreign key.
+type Field struct {
+	// Ns is the namespace the field is in. Patterns like "app.*" are allowed.
+	Ns string
+	// Field is the path of the field, e.g. "userId".
+	Field string
+}
+
+// ParseField parses a field given as "<ns>:<field>".
+func ParseField(field string) (Field, error) {
+	parts := strings.SplitN(field, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return Field{}, fmt.Errorf("Invalid id field %q: expected <ns>:<field>", field)
+	}
+	if _, err := path.Match(parts[0], ""); err != nil {
+		return Field{}, fmt.Errorf("Invalid id field %q: bad namespace", field)
+	}
+	return Field{Ns: parts[0], Field: parts[1]}, nil
+}
+
+// Modes are the ways ids can be rewritten for each copy. Ids of a type a mode doesn't handle are
+// prefixed.
+var Modes = map[string]func(id interface{}, copy int) interface{}{
+	// prefix turns the id into a string prefixed with the copy index, e.g. "2-5392478b53a5b29c16f834f2"
+	"prefix": prefix,
+	// xor XORs integer ids with the copy index shifted into the top bits, and ObjectIds'
+	// machine id bytes with the copy index
+	"xor": xor,
+	// objectid replaces ObjectIds with new ones with the same timestamp and the rest derived
+	// from a hash of the original and the copy index
+	"objectid": remapObjectID,
+}
+
+// Amplifier emits each insert, update and delete as several copies. The first copy is the
+// original op, and the others have their _ids, and any other id Fields, rewritten the same way
+// wherever they appear, so updates and deletes hit the copies the inserts created. Commands and
+// no-ops aren't copied.
+type Amplifier struct {
+	copies   int
+	rewrite  func(id interface{}, copy int) interface{}
+	fields   []Field
+	suffixNs bool
+}
+
+// New returns an Amplifier that makes copies copies of each op, rewriting ids with the mode. If
+// suffixNs is set the copies also go to their own collections, with the copy index as a suffix,
+// e.g. "app.users_2".
+func New(copies int, mode string, fields []Field, suffixNs bool) (*Amplifier, error) {
+	if copies < 1 {
+		return nil, fmt.Errorf("Can't make %d copies", copies)
+	}
+	rewrite, ok := Modes[mode]
+	if !ok {
+		return nil, fmt.Errorf("Unknown id mode: %s", mode)
+	}
+	return &Amplifier{copies: copies, rewrite: rewrite, fields: fields, suffixNs: suffixNs}, nil
+}
+
+// Apply implements transform.Stage.
+func (a *Amplifier) Apply(op map[string]interface{}) ([]map[string]interface{}, error) {
+	if op["op"] != "i" && op["op"] != "u" && op["op"] != "d" {
+		return []map[string]interface{}{op}, nil
+	}
+	ns, _ := op["ns"].(string)
+	fields := []string{"_id"}
+	for _, f := range a.fields {
+		if matched, _ := path.Match(f.Ns, ns); matched {
+			fields = append(fields, f.Field)
+		}
+	}
+
+	out := []map[string]interface{}{op}
+	for i := 1; i < a.copies; i++ {
+		copied := transform.Copy(op).(map[string]interface{})
+		for _, field := range fields {
+			transform.ReplaceField(copied, field, func(value interface{}) (interface{}, bool) {
+				return a.rewriteAll(value, i), true
+			})
+		}
+		if a.suffixNs {
+			copied["ns"] = ns + "_" + strconv.Itoa(i)
+		}
+		out = append(out, copied)
+	}
+	return out, nil
+}
+
+// rewriteAll rewrites an id, or each id in an array of them.
+func (a *Amplifier) rewriteAll(value interface{}, copy int) interface{} {
+	if ids, ok := value.([]interface{}); ok {
+		for i, id := range ids {
+			ids[i] = a.rewriteAll(id, copy)
+		}
+		return ids
+	}
+	if value == nil {
+		return nil
+	}
+	return a.rewrite(value, copy)
+}
+
+func prefix(id interface{}, copy int) interface{} {
+	if objectID, ok := id.(bson.ObjectId); ok {
+		id = objectID.Hex()
+	}
+	return fmt.Sprintf("%d-%v", copy, id)
+}
+
+func xor(id interface{}, copy int) interface{} {
+	switch id := id.(type) {
+	case int:
+		return int64(id) ^ int64(copy)<<48
+	case int64:
+		return id ^ int64(copy)<<48
+	case bson.ObjectId:
+		if id.Valid() {
+			b := []byte(string(id))
+			binary.BigEndian.PutUint16(b[4:6], binary.BigEndian.Uint16(b[4:6])^uint16(copy))
+			return bson.ObjectId(b)
+		}
+	}
+	return prefix(id, copy)
+}
+
+func remapObjectID(id interface{}, copy int) interface{} {
+	objectID, ok := id.(bson.ObjectId)
+	if !ok || !objectID.Valid() {
+		return prefix(id, copy)
+	}
+	sum := sha256.Sum256([]byte(strconv.Itoa(copy) + ":" + string(objectID)))
+	return bson.ObjectId(string(objectID)[:4] + string(sum[:8]))
+}
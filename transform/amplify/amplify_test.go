@@ -0,0 +1,114 @@
+package amplify
+
+import (
+	"testing"
+
+	"github.com/Clever/oplog-replay/transform"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+var id = bson.ObjectIdHex("5392478b53a5b29c16f834f2")
+
+func lookup(doc interface{}, name string) interface{} {
+	value, _ := transform.Lookup(doc, name)
+	return value
+}
+
+func TestAmplify(t *testing.T) {
+	field, err := ParseField("app.orders:userId")
+	assert.Nil(t, err)
+	a, err := New(3, "objectid", []Field{field}, false)
+	assert.Nil(t, err)
+
+	insert := map[string]interface{}{"op": "i", "ns": "app.users", "o": bson.D{{Name: "_id", Value: id}, {Name: "name", Value: "Ann"}}}
+	inserts, err := a.Apply(insert)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(inserts))
+	assert.Equal(t, id, lookup(inserts[0]["o"], "_id"))
+	ids := map[bson.ObjectId]bool{}
+	for _, op := range inserts {
+		copiedID := lookup(op["o"], "_id").(bson.ObjectId)
+		ids[copiedID] = true
+		assert.Equal(t, id.Time(), copiedID.Time())
+		assert.Equal(t, "Ann", lookup(op["o"], "name"))
+	}
+	assert.Equal(t, 3, len(ids))
+
+	// Updates and deletes hit the same copies
+	updates, err := a.Apply(map[string]interface{}{"op": "u", "ns": "app.users",
+		"o2": bson.D{{Name: "_id", Value: id}}, "o": bson.D{{Name: "$set", Value: bson.D{{Name: "name", Value: "Bo"}}}}})
+	assert.Nil(t, err)
+	deletes, err := a.Apply(map[string]interface{}{"op": "d", "ns": "app.users", "o": bson.D{{Name: "_id", Value: id}}})
+	assert.Nil(t, err)
+	for i := range inserts {
+		insertedID := lookup(inserts[i]["o"], "_id")
+		assert.Equal(t, insertedID, lookup(updates[i]["o2"], "_id"))
+		assert.Equal(t, insertedID, lookup(deletes[i]["o"], "_id"))
+	}
+
+	// Foreign keys are rewritten the same way
+	orders, err := a.Apply(map[string]interface{}{"op": "i", "ns": "app.orders",
+		"o": bson.D{{Name: "_id", Value: 1}, {Name: "userId", Value: id}}})
+	assert.Nil(t, err)
+	for i := range inserts {
+		assert.Equal(t, lookup(inserts[i]["o"], "_id"), lookup(orders[i]["o"], "userId"))
+	}
+}
+
+func TestModes(t *testing.T) {
+	assert.Equal(t, "2-5392478b53a5b29c16f834f2", prefix(id, 2))
+	assert.Equal(t, "2-abc", prefix("abc", 2))
+
+	assert.Equal(t, int64(5)^int64(2)<<48, xor(5, 2))
+	assert.Equal(t, int64(5)^int64(2)<<48, xor(int64(5), 2))
+	assert.Equal(t, "2-abc", xor("abc", 2))
+	xored := xor(id, 2).(bson.ObjectId)
+	assert.Equal(t, id.Time(), xored.Time())
+	assert.Equal(t, id.Counter(), xored.Counter())
+	assert.NotEqual(t, id, xored)
+
+	assert.Equal(t, remapObjectID(id, 1), remapObjectID(id, 1))
+	assert.NotEqual(t, remapObjectID(id, 1), remapObjectID(id, 2))
+	assert.Equal(t, "1-7", remapObjectID(7, 1))
+}
+
+func TestSuffixNs(t *testing.T) {
+	a, err := New(3, "prefix", nil, true)
+	assert.Nil(t, err)
+	out, err := a.Apply(map[string]interface{}{"op": "i", "ns": "app.users", "o": bson.D{{Name: "_id", Value: "a"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, "app.users", out[0]["ns"])
+	assert.Equal(t, "app.users_1", out[1]["ns"])
+	assert.Equal(t, "app.users_2", out[2]["ns"])
+	assert.Equal(t, "2-a", lookup(out[2]["o"], "_id"))
+}
+
+func TestCommandsArentCopied(t *testing.T) {
+	a, err := New(3, "prefix", nil, false)
+	assert.Nil(t, err)
+	out, err := a.Apply(map[string]interface{}{"op": "c", "ns": "app.$cmd", "o": bson.D{{Name: "create", Value: "users"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(out))
+}
+
+func TestCopiesAreIndependent(t *testing.T) {
+	a, err := New(2, "prefix", nil, false)
+	assert.Nil(t, err)
+	out, err := a.Apply(map[string]interface{}{"op": "i", "ns": "app.users",
+		"o": bson.D{{Name: "_id", Value: "a"}, {Name: "tags", Value: []interface{}{"x"}}}})
+	assert.Nil(t, err)
+	lookup(out[1]["o"], "tags").([]interface{})[0] = "y"
+	assert.Equal(t, []interface{}{"x"}, lookup(out[0]["o"], "tags"))
+}
+
+func TestInvalid(t *testing.T) {
+	_, err := New(0, "prefix", nil, false)
+	assert.NotNil(t, err)
+	_, err = New(2, "random", nil, false)
+	assert.NotNil(t, err)
+	for _, field := range []string{"userId", "app.orders:", ":userId", "app.[:userId"} {
+		_, err := ParseField(field)
+		assert.NotNil(t, err, field)
+	}
+}
@@ -0,0 +1,160 @@
+// Package commands is a transform stage that keeps destructive commands from being replayed.
+package commands
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Destructive are the commands that drop data, indexes or settings. renameCollection is also
+// destructive when it has dropTarget set: to true by clients, or to the UUID of the dropped
+// collection in the oplogs of 4.2 and later.
+var Destructive = map[string]bool{
+	"dropDatabase": true, "drop": true, "emptycapped": true, "collMod": true,
+	"dropIndexes": true, "deleteIndexes": true,
+}
+
+// Modes are the commands a Guard lets through:
+//
+//	all   every command
+//	safe  commands that aren't Destructive
+//	none  no commands
+var Modes = []string{"all", "safe", "none"}
+
+// Guard skips command ops according to its mode, logging and counting the ones it blocks. Ops
+// that aren't commands are always let through.
+type Guard struct {
+	mode    string
+	allowed map[string]bool
+
+	lock    sync.Mutex
+	blocked map[string]int
+}
+
+// New returns a Guard for one of the Modes that also lets through the allowed commands, e.g.
+// "drop".
+func New(mode string, allowed []string) (*Guard, error) {
+	valid := false
+	for _, m := range Modes {
+		valid = valid || m == mode
+	}
+	if !valid {
+		return nil, fmt.Errorf("Unknown command mode: %s", mode)
+	}
+	g := &Guard{mode: mode, allowed: map[string]bool{}, blocked: map[string]int{}}
+	for _, name := range allowed {
+		g.allowed[name] = true
+	}
+	return g, nil
+}
+
+// Apply implements transform.Stage.
+func (g *Guard) Apply(op map[string]interface{}) ([]map[string]interface{}, error) {
+	if op["op"] != "c" {
+		return []map[string]interface{}{op}, nil
+	}
+	if name := g.block(op); name != "" {
+		log.Printf("Blocked %s command in %v: %v", name, op["ns"], op["o"])
+		g.lock.Lock()
+		defer g.lock.Unlock()
+		g.blocked[name]++
+		return nil, nil
+	}
+	return []map[string]interface{}{op}, nil
+}
+
+// Report implements transform.Reporter.
+func (g *Guard) Report() string {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if len(g.blocked) == 0 {
+		return ""
+	}
+	counts := []string{}
+	for name, count := range g.blocked {
+		counts = append(counts, fmt.Sprintf("%s %d", name, count))
+	}
+	sort.Strings(counts)
+	return "Blocked commands: " + strings.Join(counts, ", ")
+}
+
+// block returns the name of the command that keeps a command op from being replayed, or "" if
+// it can be.
+func (g *Guard) block(op map[string]interface{}) string {
+	command := fields(op["o"])
+	if len(command) == 0 {
+		return ""
+	}
+	name := command[0].Name
+	if g.allowed[name] || g.mode == "all" {
+		return ""
+	}
+	if g.mode == "none" || destructive(name, command) {
+		return name
+	}
+	// Transactions are applied as an applyOps command, which can hold commands of its own
+	if name == "applyOps" {
+		ops, _ := command[0].Value.([]interface{})
+		for _, nested := range ops {
+			nestedOp, ok := nested.(map[string]interface{})
+			if !ok {
+				nestedOp = fields(nested).Map()
+			}
+			if nestedOp["op"] == "c" {
+				if blocked := g.block(nestedOp); blocked != "" {
+					return blocked
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func destructive(name string, command bson.D) bool {
+	if name == "renameCollection" {
+		for _, field := range command {
+			if field.Name == "dropTarget" && !isFalse(field.Value) {
+				return true
+			}
+		}
+	}
+	return Destructive[name]
+}
+
+// isFalse returns whether a value is false, 0 or null, which mongod treats as false.
+func isFalse(value interface{}) bool {
+	switch value := value.(type) {
+	case nil:
+		return true
+	case bool:
+		return !value
+	case int:
+		return value == 0
+	case int64:
+		return value == 0
+	case float64:
+		return value == 0
+	}
+	return false
+}
+
+// fields returns a command's fields in order. Commands are decoded as bson.D to keep the command
+// name first, but a map with a single key is also understood.
+func fields(o interface{}) bson.D {
+	switch o := o.(type) {
+	case bson.D:
+		return o
+	case map[string]interface{}:
+		if len(o) == 1 {
+			for name, value := range o {
+				return bson.D{{Name: name, Value: value}}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package commands
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func command(o bson.D) map[string]interface{} {
+	return map[string]interface{}{"op": "c", "ns": "app.$cmd", "o": o}
+}
+
+var (
+	create     = command(bson.D{{Name: "create", Value: "users"}})
+	drop       = command(bson.D{{Name: "drop", Value: "users"}})
+	dropDB     = command(bson.D{{Name: "dropDatabase", Value: 1}})
+	dropIndex  = command(bson.D{{Name: "dropIndexes", Value: "users"}, {Name: "index", Value: "a_1"}})
+	rename     = command(bson.D{{Name: "renameCollection", Value: "app.a"}, {Name: "to", Value: "app.b"}})
+	renameDrop = command(bson.D{{Name: "renameCollection", Value: "app.a"}, {Name: "to", Value: "app.b"}, {Name: "dropTarget", Value: true}})
+	// Since 4.2, the oplog has the UUID of the dropped collection instead of true
+	renameUUID = command(bson.D{{Name: "renameCollection", Value: "app.a"}, {Name: "to", Value: "app.b"},
+		{Name: "dropTarget", Value: bson.Binary{Kind: 4, Data: []byte("0123456789abcdef")}}})
+	renameKeep = command(bson.D{{Name: "renameCollection", Value: "app.a"}, {Name: "to", Value: "app.b"}, {Name: "dropTarget", Value: false}})
+	insert     = map[string]interface{}{"op": "i", "ns": "app.users", "o": map[string]interface{}{"_id": 1}}
+	txn        = command(bson.D{{Name: "applyOps", Value: []interface{}{
+		map[string]interface{}{"op": "i", "ns": "app.users", "o": map[string]interface{}{"_id": 1}},
+		bson.D{{Name: "op", Value: "c"}, {Name: "ns", Value: "app.$cmd"}, {Name: "o", Value: bson.D{{Name: "drop", Value: "users"}}}},
+	}}})
+)
+
+func TestModes(t *testing.T) {
+	for _, test := range []struct {
+		mode    string
+		allowed []string
+		kept    []map[string]interface{}
+		blocked []map[string]interface{}
+	}{
+		{"all", nil, []map[string]interface{}{create, drop, dropDB, dropIndex, renameDrop, renameUUID, txn, insert}, nil},
+		{"safe", nil,
+			[]map[string]interface{}{create, rename, renameKeep, insert},
+			[]map[string]interface{}{drop, dropDB, dropIndex, renameDrop, renameUUID, txn}},
+		{"safe", []string{"drop"},
+			[]map[string]interface{}{create, drop, txn, insert},
+			[]map[string]interface{}{dropDB, dropIndex, renameDrop, renameUUID}},
+		{"none", nil, []map[string]interface{}{insert}, []map[string]interface{}{create, rename, drop}},
+		{"none", []string{"create"}, []map[string]interface{}{create, insert}, []map[string]interface{}{rename, drop}},
+	} {
+		g, err := New(test.mode, test.allowed)
+		assert.Nil(t, err)
+		for _, op := range test.kept {
+			out, err := g.Apply(op)
+			assert.Nil(t, err)
+			assert.Equal(t, []map[string]interface{}{op}, out, test.mode)
+		}
+		for _, op := range test.blocked {
+			out, err := g.Apply(op)
+			assert.Nil(t, err)
+			assert.Equal(t, 0, len(out), test.mode)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	g, err := New("safe", nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", g.Report())
+	for _, op := range []map[string]interface{}{drop, drop, dropDB, create} {
+		_, err := g.Apply(op)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, "Blocked commands: drop 2, dropDatabase 1", g.Report())
+}
+
+func TestMapCommands(t *testing.T) {
+	g, err := New("safe", nil)
+	assert.Nil(t, err)
+	out, err := g.Apply(map[string]interface{}{"op": "c", "ns": "app.$cmd", "o": map[string]interface{}{"dropDatabase": 1}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(out))
+}
+
+func TestUnknownMode(t *testing.T) {
+	_, err := New("some", nil)
+	assert.NotNil(t, err)
+}
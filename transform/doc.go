@@ -0,0 +1,70 @@
+package transform
+
+import "labix.org/v2/mgo/bson"
+
+// Lookup returns the value of a field of a document: a bson.D, like the documents Decode returns,
+// or a map.
+func Lookup(doc interface{}, name string) (interface{}, bool) {
+	switch doc := doc.(type) {
+	case bson.D:
+		for _, field := range doc {
+			if field.Name == name {
+				return field.Value, true
+			}
+		}
+	case map[string]interface{}:
+		value, ok := doc[name]
+		return value, ok
+	case bson.M:
+		value, ok := doc[name]
+		return value, ok
+	}
+	return nil, false
+}
+
+// Set returns doc with a field set to value. The field keeps its place if it's already there, and
+// is added to the end if it isn't.
+func Set(doc bson.D, name string, value interface{}) bson.D {
+	for i := range doc {
+		if doc[i].Name == name {
+			doc[i].Value = value
+			return doc
+		}
+	}
+	return append(doc, bson.DocElem{Name: name, Value: value})
+}
+
+// Copy returns a deep copy of the documents and arrays in value.
+func Copy(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, elem := range v {
+			copied[key] = Copy(elem)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, elem := range v {
+			copied[i] = Copy(elem)
+		}
+		return copied
+	case bson.D:
+		copied := make(bson.D, len(v))
+		for i, elem := range v {
+			copied[i] = bson.DocElem{Name: elem.Name, Value: Copy(elem.Value)}
+		}
+		return copied
+	}
+	return value
+}
+
+// Remove returns doc without a field.
+func Remove(doc bson.D, name string) bson.D {
+	for i := range doc {
+		if doc[i].Name == name {
+			return append(doc[:i:i], doc[i+1:]...)
+		}
+	}
+	return doc
+}
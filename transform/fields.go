@@ -0,0 +1,181 @@
+package transform
+
+import (
+	"strconv"
+	"strings"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// ReplaceField replaces the values of a field in the documents of an insert, update or delete: the
+// inserted document, the fields of update operators like $set (but not $unset) or the replacement
+// document of an update, and the selectors of updates and deletes. Documents are searched the way
+// mongod would, so "profile.name" matches a $set of "profile", "profile.name" or "profile.0.name".
+// Fields inside arrays are found in every element.
+//
+// replace returns the new value, or false to remove the field. Array elements can't be removed
+// without shifting the rest, so they're set to null instead. Update operators left empty are
+// removed. The fields of $v: 2 diff updates aren't replaced, so they should be turned into
+// modifiers first. ReplaceField returns how many values were replaced.
+func ReplaceField(op map[string]interface{}, field string, replace func(interface{}) (interface{}, bool)) int {
+	r := &fieldReplacer{field: field, path: strings.Split(field, "."), replace: replace}
+	o, ok := op["o"].(bson.D)
+	if !ok {
+		return 0
+	}
+	switch op["op"] {
+	case "i":
+		op["o"] = r.replacePath(o, r.path)
+	case "d":
+		op["o"] = r.replaceDotted(o)
+	case "u":
+		if o2, ok := op["o2"].(bson.D); ok {
+			op["o2"] = r.replaceDotted(o2)
+		}
+		if !IsModifier(o) {
+			op["o"] = r.replacePath(o, r.path)
+			break
+		}
+		modifiers := bson.D{}
+		for _, modifier := range o {
+			fields, ok := modifier.Value.(bson.D)
+			if ok && strings.HasPrefix(modifier.Name, "$") && modifier.Name != "$unset" {
+				if modifier.Value = r.replaceDotted(fields); len(modifier.Value.(bson.D)) == 0 {
+					continue
+				}
+			}
+			modifiers = append(modifiers, modifier)
+		}
+		op["o"] = modifiers
+	}
+	return r.count
+}
+
+// IsModifier returns whether an update document uses operators like $set, or is a $v: 2 diff,
+// rather than replacing the whole document. Every field of a modifier is an operator, or $v and
+// the diff.
+func IsModifier(o bson.D) bool {
+	if len(o) == 0 {
+		return false
+	}
+	diff := IsDiff(o)
+	for _, field := range o {
+		if !strings.HasPrefix(field.Name, "$") && !(diff && field.Name == "diff") {
+			return false
+		}
+	}
+	return true
+}
+
+// IsDiff returns whether an update document is a $v: 2 diff, which servers since 5.0 write
+// instead of operators: {$v: 2, diff: {u: {...}, d: {...}, s<field>: {...}}}.
+func IsDiff(o bson.D) bool {
+	v, _ := Lookup(o, "$v")
+	diff, _ := Lookup(o, "diff")
+	_, ok := diff.(bson.D)
+	switch v {
+	case 2, int64(2), float64(2):
+		return ok
+	}
+	return false
+}
+
+type fieldReplacer struct {
+	field   string
+	path    []string
+	replace func(interface{}) (interface{}, bool)
+	count   int
+}
+
+// replaceKey replaces field i of doc, returning the document without it if it's removed.
+func (r *fieldReplacer) replaceKey(doc bson.D, i int) bson.D {
+	r.count++
+	value, keep := r.replace(doc[i].Value)
+	if !keep {
+		return append(doc[:i:i], doc[i+1:]...)
+	}
+	doc[i].Value = value
+	return doc
+}
+
+// replacePath replaces the field at path in doc, descending through subdocuments and arrays.
+func (r *fieldReplacer) replacePath(doc bson.D, path []string) bson.D {
+	for i := range doc {
+		if doc[i].Name != path[0] {
+			continue
+		}
+		if len(path) == 1 {
+			return r.replaceKey(doc, i)
+		}
+		doc[i].Value = r.replaceIn(doc[i].Value, path[1:])
+		break
+	}
+	return doc
+}
+
+// replaceIn replaces the field at path in value, if it's a subdocument or an array.
+func (r *fieldReplacer) replaceIn(value interface{}, path []string) interface{} {
+	switch value := value.(type) {
+	case bson.D:
+		return r.replacePath(value, path)
+	case []interface{}:
+		if i, err := strconv.Atoi(path[0]); err == nil {
+			if i >= 0 && i < len(value) {
+				r.replaceIndex(value, i, path[1:])
+			}
+			return value
+		}
+		for i := range value {
+			r.replaceIndex(value, i, path)
+		}
+	}
+	return value
+}
+
+// replaceIndex replaces the field at path in element i of an array, or the element itself if
+// path is empty.
+func (r *fieldReplacer) replaceIndex(array []interface{}, i int, path []string) {
+	if len(path) > 0 {
+		array[i] = r.replaceIn(array[i], path)
+		return
+	}
+	r.count++
+	if value, keep := r.replace(array[i]); keep {
+		array[i] = value
+	} else {
+		array[i] = nil
+	}
+}
+
+// replaceDotted replaces the field in a document whose keys are dotted paths, like the fields of
+// a $set or a selector.
+func (r *fieldReplacer) replaceDotted(doc bson.D) bson.D {
+	replaced := bson.D{}
+	for _, value := range doc {
+		field := withoutIndexes(value.Name)
+		switch {
+		case field == r.field || strings.HasPrefix(field, r.field+"."):
+			// The value is the field, or inside it
+			replaced = append(replaced, value)
+			replaced = r.replaceKey(replaced, len(replaced)-1)
+			continue
+		case strings.HasPrefix(r.field, field+"."):
+			// The field is inside the value
+			value.Value = r.replaceIn(value.Value, strings.Split(r.field[len(field)+1:], "."))
+		}
+		replaced = append(replaced, value)
+	}
+	return replaced
+}
+
+// withoutIndexes removes array indexes from a dotted path, e.g. "emails.1.address" becomes
+// "emails.address".
+func withoutIndexes(key string) string {
+	parts := []string{}
+	for _, part := range strings.Split(key, ".") {
+		if _, err := strconv.Atoi(part); err != nil {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, ".")
+}
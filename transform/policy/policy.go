@@ -0,0 +1,192 @@
+// Package policy is a transform stage that skips or converts deletes and inserts, per namespace.
+package policy
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Clever/oplog-replay/transform"
+	"labix.org/v2/mgo/bson"
+)
+
+// Rule sets a policy for the namespaces matching a pattern.
+type Rule struct {
+	// Ns is the namespace the rule applies to. Patterns like "app.*" are allowed, and an empty Ns
+	// applies to every namespace. Commands are in "<db>.$cmd".
+	Ns string
+	// Value is the policy, e.g. "soft" for deletes.
+	Value string
+}
+
+// ParseRules parses semicolon separated rules given as "[<ns>=]<value>", e.g.
+// "logs.*=skip;soft".
+func ParseRules(spec string) ([]Rule, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	rules := []Rule{}
+	for _, rule := range strings.Split(spec, ";") {
+		parts := strings.SplitN(rule, "=", 2)
+		if len(parts) == 1 {
+			parts = []string{"", parts[0]}
+		}
+		if parts[1] == "" {
+			return nil, fmt.Errorf("Invalid policy %q: expected [<ns>=]<value>", rule)
+		}
+		if _, err := path.Match(parts[0], ""); err != nil {
+			return nil, fmt.Errorf("Invalid policy %q: bad namespace", rule)
+		}
+		rules = append(rules, Rule{Ns: parts[0], Value: parts[1]})
+	}
+	return rules, nil
+}
+
+// Options are the policies for each op type. Each namespace gets the Value of the first Rule
+// that matches it.
+type Options struct {
+	// DeleteAs is what to do with deletes:
+	//
+	//	delete  apply them (the default)
+	//	skip    skip them
+	//	soft    update the document instead, setting SoftDeleteField to the time of the delete
+	DeleteAs []Rule
+	// InsertAs is what to do with inserts:
+	//
+	//	insert  apply them (the default)
+	//	upsert  replace the document with the same _id, or insert it if there isn't one
+	InsertAs []Rule
+	// SoftDeleteField is the field soft deletes set.
+	SoftDeleteField string
+}
+
+var (
+	deleteAs = map[string]bool{"delete": true, "skip": true, "soft": true}
+	insertAs = map[string]bool{"insert": true, "upsert": true}
+)
+
+// Policy skips and converts ops according to its Options.
+type Policy struct {
+	deleteAs        []Rule
+	insertAs        []Rule
+	softDeleteField string
+
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+// New returns a Policy for the options.
+func New(options Options) (*Policy, error) {
+	p := &Policy{
+		deleteAs:        options.DeleteAs,
+		insertAs:        options.InsertAs,
+		softDeleteField: options.SoftDeleteField,
+		counts:          map[string]int{},
+	}
+	for _, rule := range options.DeleteAs {
+		if !deleteAs[rule.Value] {
+			return nil, fmt.Errorf("Unknown delete policy: %s", rule.Value)
+		}
+		if rule.Value == "soft" && p.softDeleteField == "" {
+			return nil, fmt.Errorf("Soft deletes need a field to set")
+		}
+	}
+	for _, rule := range options.InsertAs {
+		if !insertAs[rule.Value] {
+			return nil, fmt.Errorf("Unknown insert policy: %s", rule.Value)
+		}
+	}
+	return p, nil
+}
+
+// Apply implements transform.Stage.
+func (p *Policy) Apply(op map[string]interface{}) ([]map[string]interface{}, error) {
+	ns, _ := op["ns"].(string)
+	opType, _ := op["op"].(string)
+	switch {
+	case opType == "d":
+		switch value(p.deleteAs, ns) {
+		case "skip":
+			p.count("skipped")
+			return nil, nil
+		case "soft":
+			if softDelete(op, p.softDeleteField) {
+				p.count("soft deleted")
+			}
+		}
+	case opType == "i" && !strings.HasSuffix(ns, ".system.indexes"):
+		if value(p.insertAs, ns) == "upsert" && upsert(op) {
+			p.count("upserted")
+		}
+	}
+	return []map[string]interface{}{op}, nil
+}
+
+// Report implements transform.Reporter.
+func (p *Policy) Report() string {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if len(p.counts) == 0 {
+		return ""
+	}
+	counts := []string{}
+	for name, count := range p.counts {
+		counts = append(counts, fmt.Sprintf("%s %d", name, count))
+	}
+	sort.Strings(counts)
+	return "Op policies: " + strings.Join(counts, ", ")
+}
+
+func (p *Policy) count(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.counts[name]++
+}
+
+// softDelete turns a delete into an update that sets field to the time of the delete.
+func softDelete(op map[string]interface{}, field string) bool {
+	selector, ok := op["o"].(bson.D)
+	if !ok {
+		return false
+	}
+	ts, _ := op["ts"].(bson.MongoTimestamp)
+	op["op"] = "u"
+	op["o2"] = selector
+	op["o"] = bson.D{{Name: "$set", Value: bson.D{{Name: field, Value: time.Unix(int64(ts>>32), 0)}}}}
+	delete(op, "b")
+	return true
+}
+
+// upsert turns an insert into an update that replaces the document with the same _id, upserting
+// it if it doesn't exist.
+func upsert(op map[string]interface{}) bool {
+	id, ok := transform.Lookup(op["o"], "_id")
+	if !ok {
+		return false
+	}
+	op["op"] = "u"
+	op["o2"] = bson.D{{Name: "_id", Value: id}}
+	op["b"] = true
+	return true
+}
+
+// value returns the value of the first rule that matches ns, or "" if none do.
+func value(rules []Rule, ns string) string {
+	for _, rule := range rules {
+		if matches(rule.Ns, ns) {
+			return rule.Value
+		}
+	}
+	return ""
+}
+
+func matches(pattern, ns string) bool {
+	if pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(pattern, ns)
+	return matched
+}
@@ -0,0 +1,75 @@
+package policy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func mustParse(t *testing.T, spec string) []Rule {
+	rules, err := ParseRules(spec)
+	assert.Nil(t, err)
+	return rules
+}
+
+func TestParseRules(t *testing.T) {
+	assert.Equal(t, []Rule{{Ns: "logs.*", Value: "skip"}, {Ns: "", Value: "soft"}}, mustParse(t, "logs.*=skip;soft"))
+	assert.Equal(t, []Rule(nil), mustParse(t, ""))
+	for _, spec := range []string{"app.users=", "skip;", "app.[=skip"} {
+		_, err := ParseRules(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestDeleteAs(t *testing.T) {
+	p, err := New(Options{DeleteAs: mustParse(t, "logs.*=skip;soft"), SoftDeleteField: "_deleted"})
+	assert.Nil(t, err)
+
+	ts := bson.MongoTimestamp(1400000000<<32 | 1)
+	out, err := p.Apply(map[string]interface{}{"op": "d", "ns": "app.users", "ts": ts, "b": true,
+		"o": bson.D{{Name: "_id", Value: 1}}})
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{{"op": "u", "ns": "app.users", "ts": ts,
+		"o2": bson.D{{Name: "_id", Value: 1}},
+		"o":  bson.D{{Name: "$set", Value: bson.D{{Name: "_deleted", Value: time.Unix(1400000000, 0)}}}}}}, out)
+
+	out, err = p.Apply(map[string]interface{}{"op": "d", "ns": "logs.requests", "o": bson.D{{Name: "_id", Value: 1}}})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(out))
+	assert.Equal(t, "Op policies: skipped 1, soft deleted 1", p.Report())
+}
+
+func TestInsertAs(t *testing.T) {
+	p, err := New(Options{InsertAs: mustParse(t, "app.*=upsert")})
+	assert.Nil(t, err)
+
+	out, err := p.Apply(map[string]interface{}{"op": "i", "ns": "app.users", "o": bson.D{{Name: "_id", Value: 1}, {Name: "a", Value: 2}}})
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{{"op": "u", "ns": "app.users", "b": true,
+		"o2": bson.D{{Name: "_id", Value: 1}}, "o": bson.D{{Name: "_id", Value: 1}, {Name: "a", Value: 2}}}}, out)
+
+	// Other namespaces, index builds and inserts without an _id stay inserts
+	for _, op := range []map[string]interface{}{
+		{"op": "i", "ns": "logs.requests", "o": bson.D{{Name: "_id", Value: 1}}},
+		{"op": "i", "ns": "app.system.indexes", "o": bson.D{{Name: "ns", Value: "app.users"}, {Name: "key", Value: bson.D{{Name: "a", Value: 1}}}}},
+		{"op": "i", "ns": "app.users", "o": bson.D{{Name: "a", Value: 1}}},
+	} {
+		out, err := p.Apply(op)
+		assert.Nil(t, err)
+		assert.Equal(t, "i", out[0]["op"])
+	}
+	assert.Equal(t, "Op policies: upserted 1", p.Report())
+}
+
+func TestInvalidOptions(t *testing.T) {
+	for _, options := range []Options{
+		{DeleteAs: []Rule{{Value: "hard"}}},
+		{DeleteAs: []Rule{{Value: "soft"}}},
+		{InsertAs: []Rule{{Value: "replace"}}},
+	} {
+		_, err := New(options)
+		assert.NotNil(t, err)
+	}
+}
@@ -0,0 +1,104 @@
+// Package rename is a transform stage that moves ops to other databases or namespaces.
+package rename
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Clever/oplog-replay/transform"
+	"labix.org/v2/mgo/bson"
+)
+
+// commandsOnCollection are commands whose value is the name of the collection they apply to.
+var commandsOnCollection = map[string]bool{
+	"create": true, "drop": true, "createIndexes": true, "dropIndexes": true, "deleteIndexes": true,
+	"collMod": true, "emptycapped": true, "convertToCapped": true,
+}
+
+// Renamer renames databases and namespaces.
+type Renamer struct {
+	databases  map[string]string
+	namespaces map[string]string
+}
+
+// New returns a Renamer for renames like "app=app_copy", which renames a database, or
+// "app.users=app.people", which renames a single namespace. Namespace renames take precedence.
+func New(renames []string) (*Renamer, error) {
+	r := &Renamer{databases: map[string]string{}, namespaces: map[string]string{}}
+	for _, rename := range renames {
+		parts := strings.SplitN(rename, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid rename %q: expected <old>=<new>", rename)
+		}
+		if strings.Contains(parts[0], ".") != strings.Contains(parts[1], ".") {
+			return nil, fmt.Errorf("Invalid rename %q: can't rename a database to a namespace or vice versa", rename)
+		}
+		if strings.Contains(parts[0], ".") {
+			r.namespaces[parts[0]] = parts[1]
+		} else {
+			r.databases[parts[0]] = parts[1]
+		}
+	}
+	return r, nil
+}
+
+// Namespace returns the new name of a namespace.
+func (r *Renamer) Namespace(ns string) string {
+	if renamed, ok := r.namespaces[ns]; ok {
+		return renamed
+	}
+	parts := strings.SplitN(ns, ".", 2)
+	if renamed, ok := r.databases[parts[0]]; ok {
+		parts[0] = renamed
+	}
+	return strings.Join(parts, ".")
+}
+
+// Apply implements transform.Stage.
+func (r *Renamer) Apply(op map[string]interface{}) ([]map[string]interface{}, error) {
+	ns, _ := op["ns"].(string)
+	if ns == "" {
+		return []map[string]interface{}{op}, nil
+	}
+	db := strings.SplitN(ns, ".", 2)[0]
+	switch {
+	case op["op"] == "c":
+		r.renameCommand(op, db)
+	case strings.HasSuffix(ns, ".system.indexes"):
+		// Old servers build indexes by inserting them into system.indexes, naming the collection
+		o, _ := op["o"].(bson.D)
+		if value, _ := transform.Lookup(o, "ns"); value != nil {
+			if indexNs, ok := value.(string); ok {
+				op["o"] = transform.Set(o, "ns", r.Namespace(indexNs))
+			}
+		}
+		op["ns"] = r.Namespace(db) + ".system.indexes"
+	default:
+		op["ns"] = r.Namespace(ns)
+	}
+	return []map[string]interface{}{op}, nil
+}
+
+// renameCommand renames the namespaces a command in database db applies to.
+func (r *Renamer) renameCommand(op map[string]interface{}, db string) {
+	command, _ := op["o"].(bson.D)
+	if len(command) > 0 {
+		switch name := command[0].Name; {
+		case commandsOnCollection[name]:
+			if coll, ok := command[0].Value.(string); ok {
+				// A renamed namespace can move the collection to another database
+				renamed := strings.SplitN(r.Namespace(db+"."+coll), ".", 2)
+				db, command[0].Value = renamed[0], renamed[1]
+				op["ns"] = db + ".$cmd"
+				return
+			}
+		case name == "renameCollection":
+			for i := range command {
+				if ns, ok := command[i].Value.(string); ok && (command[i].Name == "renameCollection" || command[i].Name == "to") {
+					command[i].Value = r.Namespace(ns)
+				}
+			}
+		}
+	}
+	op["ns"] = r.Namespace(db) + ".$cmd"
+}
@@ -0,0 +1,67 @@
+package rename
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func apply(t *testing.T, r *Renamer, op map[string]interface{}) map[string]interface{} {
+	out, err := r.Apply(op)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(out))
+	return out[0]
+}
+
+func TestRename(t *testing.T) {
+	r, err := New([]string{"app=staging", "app.users=people.users"})
+	assert.Nil(t, err)
+
+	assert.Equal(t, "staging.orders", r.Namespace("app.orders"))
+	assert.Equal(t, "people.users", r.Namespace("app.users"))
+	assert.Equal(t, "logs.requests", r.Namespace("logs.requests"))
+	assert.Equal(t, "staging", r.Namespace("app"))
+
+	op := apply(t, r, map[string]interface{}{"op": "i", "ns": "app.orders", "o": bson.D{{Name: "_id", Value: 1}}})
+	assert.Equal(t, "staging.orders", op["ns"])
+	op = apply(t, r, map[string]interface{}{"op": "n", "ns": ""})
+	assert.Equal(t, "", op["ns"])
+}
+
+func TestRenameCommands(t *testing.T) {
+	r, err := New([]string{"app=staging", "app.users=people.users"})
+	assert.Nil(t, err)
+
+	op := apply(t, r, map[string]interface{}{"op": "c", "ns": "app.$cmd", "o": bson.D{{Name: "create", Value: "orders"}}})
+	assert.Equal(t, "staging.$cmd", op["ns"])
+	assert.Equal(t, bson.D{{Name: "create", Value: "orders"}}, op["o"])
+
+	op = apply(t, r, map[string]interface{}{"op": "c", "ns": "app.$cmd", "o": bson.D{{Name: "drop", Value: "users"}}})
+	assert.Equal(t, "people.$cmd", op["ns"])
+	assert.Equal(t, bson.D{{Name: "drop", Value: "users"}}, op["o"])
+
+	op = apply(t, r, map[string]interface{}{"op": "c", "ns": "app.$cmd", "o": bson.D{{Name: "dropDatabase", Value: 1}}})
+	assert.Equal(t, "staging.$cmd", op["ns"])
+
+	op = apply(t, r, map[string]interface{}{"op": "c", "ns": "admin.$cmd", "o": bson.D{
+		{Name: "renameCollection", Value: "app.orders"}, {Name: "to", Value: "app.users"}, {Name: "dropTarget", Value: false}}})
+	assert.Equal(t, "admin.$cmd", op["ns"])
+	assert.Equal(t, bson.D{{Name: "renameCollection", Value: "staging.orders"}, {Name: "to", Value: "people.users"}, {Name: "dropTarget", Value: false}}, op["o"])
+}
+
+func TestRenameSystemIndexes(t *testing.T) {
+	r, err := New([]string{"app=staging"})
+	assert.Nil(t, err)
+	op := apply(t, r, map[string]interface{}{"op": "i", "ns": "app.system.indexes",
+		"o": bson.D{{Name: "ns", Value: "app.users"}, {Name: "key", Value: bson.D{{Name: "a", Value: 1}}}, {Name: "name", Value: "a_1"}}})
+	assert.Equal(t, "staging.system.indexes", op["ns"])
+	assert.Equal(t, bson.D{{Name: "ns", Value: "staging.users"}, {Name: "key", Value: bson.D{{Name: "a", Value: 1}}}, {Name: "name", Value: "a_1"}}, op["o"])
+}
+
+func TestInvalidRenames(t *testing.T) {
+	for _, rename := range []string{"app", "app=", "=app", "app=staging.users", "app.users=staging"} {
+		_, err := New([]string{rename})
+		assert.NotNil(t, err, rename)
+	}
+}
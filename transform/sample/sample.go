@@ -0,0 +1,123 @@
+// Package sample is a transform stage that keeps the ops for a consistent fraction of documents.
+package sample
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"sync"
+
+	"github.com/Clever/oplog-replay/transform"
+	"labix.org/v2/mgo/bson"
+)
+
+// Sampler keeps the inserts, updates and deletes for a fraction of the documents in each
+// namespace, chosen by a hash of the namespace and _id, so every op for a kept document is kept
+// and every op for a dropped one is dropped. Commands, no-ops and ops without an _id are always
+// kept.
+type Sampler struct {
+	fraction float64
+
+	lock          sync.Mutex
+	kept, dropped int
+}
+
+// New returns a Sampler that keeps the given fraction of documents, between 0 and 1.
+func New(fraction float64) (*Sampler, error) {
+	if fraction < 0 || fraction > 1 || math.IsNaN(fraction) {
+		return nil, fmt.Errorf("Sample fraction must be between 0 and 1, got %v", fraction)
+	}
+	return &Sampler{fraction: fraction}, nil
+}
+
+// Apply implements transform.Stage.
+func (s *Sampler) Apply(op map[string]interface{}) ([]map[string]interface{}, error) {
+	id, ok := documentID(op)
+	if !ok {
+		return []map[string]interface{}{op}, nil
+	}
+	keep, err := s.keep(op["ns"], id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !keep {
+		s.dropped++
+		return nil, nil
+	}
+	s.kept++
+	return []map[string]interface{}{op}, nil
+}
+
+// Report implements transform.Reporter.
+func (s *Sampler) Report() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.kept+s.dropped == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Sampled ops: kept %d, dropped %d", s.kept, s.dropped)
+}
+
+// keep returns whether the document with the id in the namespace is in the sample.
+func (s *Sampler) keep(ns, id interface{}) (bool, error) {
+	// Marshal the id so equal ids of any type hash the same, and ids of different types don't
+	raw, err := bson.Marshal(bson.D{{Name: "ns", Value: ns}, {Name: "_id", Value: canonical(id)}})
+	if err != nil {
+		return false, fmt.Errorf("Couldn't hash _id %v: %s", id, err)
+	}
+	hash := fnv.New64a()
+	hash.Write(raw)
+	return s.fraction == 1 || float64(hash.Sum64())/(1<<64) < s.fraction, nil
+}
+
+// canonical returns value with the maps in it turned into documents sorted by key, since maps
+// are marshalled in a random order. Documents decoded from the oplog are bson.Ds in the order
+// they were written, which is part of what makes compound _ids equal.
+func canonical(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return canonical(bson.M(v))
+	case bson.M:
+		keys := []string{}
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		doc := bson.D{}
+		for _, key := range keys {
+			doc = append(doc, bson.DocElem{Name: key, Value: canonical(v[key])})
+		}
+		return doc
+	case bson.D:
+		doc := make(bson.D, len(v))
+		for i, elem := range v {
+			doc[i] = bson.DocElem{Name: elem.Name, Value: canonical(elem.Value)}
+		}
+		return doc
+	case []interface{}:
+		array := make([]interface{}, len(v))
+		for i, elem := range v {
+			array[i] = canonical(elem)
+		}
+		return array
+	}
+	return value
+}
+
+// documentID returns the _id of the document an insert, update or delete is for.
+func documentID(op map[string]interface{}) (interface{}, bool) {
+	var doc interface{}
+	switch op["op"] {
+	case "i", "d":
+		doc = op["o"]
+	case "u":
+		doc = op["o2"]
+	default:
+		return nil, false
+	}
+	return transform.Lookup(doc, "_id")
+}
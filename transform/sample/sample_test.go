@@ -0,0 +1,133 @@
+package sample
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func insert(ns string, id interface{}) map[string]interface{} {
+	return map[string]interface{}{"op": "i", "ns": ns, "o": bson.D{{Name: "_id", Value: id}, {Name: "a", Value: 1}}}
+}
+
+func update(ns string, id interface{}) map[string]interface{} {
+	return map[string]interface{}{"op": "u", "ns": ns, "o2": bson.D{{Name: "_id", Value: id}},
+		"o": bson.D{{Name: "$set", Value: bson.D{{Name: "a", Value: 2}}}}}
+}
+
+func remove(ns string, id interface{}) map[string]interface{} {
+	return map[string]interface{}{"op": "d", "ns": ns, "o": bson.D{{Name: "_id", Value: id}}}
+}
+
+func TestSampleKeepsDocumentsTogether(t *testing.T) {
+	s, err := New(0.3)
+	assert.Nil(t, err)
+	kept := 0
+	for i := 0; i < 1000; i++ {
+		id := fmt.Sprintf("doc%d", i)
+		inserted, err := s.Apply(insert("app.users", id))
+		assert.Nil(t, err)
+		updated, err := s.Apply(update("app.users", id))
+		assert.Nil(t, err)
+		removed, err := s.Apply(remove("app.users", id))
+		assert.Nil(t, err)
+		assert.Equal(t, len(inserted), len(updated))
+		assert.Equal(t, len(inserted), len(removed))
+		kept += len(inserted)
+	}
+	assert.True(t, kept > 250 && kept < 350, fmt.Sprintf("kept %d of 1000", kept))
+	assert.Equal(t, fmt.Sprintf("Sampled ops: kept %d, dropped %d", kept*3, (1000-kept)*3), s.Report())
+}
+
+func TestSampleIsDeterministic(t *testing.T) {
+	a, err := New(0.5)
+	assert.Nil(t, err)
+	b, err := New(0.5)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		id := bson.NewObjectId()
+		fromA, err := a.Apply(insert("app.users", id))
+		assert.Nil(t, err)
+		fromB, err := b.Apply(insert("app.users", id))
+		assert.Nil(t, err)
+		assert.Equal(t, len(fromA), len(fromB))
+	}
+}
+
+func TestSampleCompoundIDs(t *testing.T) {
+	s, err := New(0.5)
+	assert.Nil(t, err)
+	kept := map[bool]int{}
+	for i := 0; i < 100; i++ {
+		// Maps are marshalled in a random order, so the same id has to hash the same every time
+		id := map[string]interface{}{"user": i, "day": "2015-10-16", "shard": map[string]interface{}{"region": "us", "n": i % 3}}
+		first, err := s.keep("app.visits", id)
+		assert.Nil(t, err)
+		for j := 0; j < 10; j++ {
+			again, err := s.keep("app.visits", id)
+			assert.Nil(t, err)
+			assert.Equal(t, first, again)
+		}
+		sorted, err := s.keep("app.visits", bson.D{{Name: "day", Value: "2015-10-16"},
+			{Name: "shard", Value: bson.D{{Name: "n", Value: i % 3}, {Name: "region", Value: "us"}}}, {Name: "user", Value: i}})
+		assert.Nil(t, err)
+		assert.Equal(t, first, sorted)
+		kept[first]++
+	}
+	assert.True(t, kept[true] > 0 && kept[false] > 0)
+
+	// The order of a decoded _id is part of it, like it is to mongod
+	assert.NotEqual(t, canonical(bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 2}}),
+		canonical(bson.D{{Name: "b", Value: 2}, {Name: "a", Value: 1}}))
+}
+
+func TestSampleHashesNamespace(t *testing.T) {
+	s, err := New(0.5)
+	assert.Nil(t, err)
+	differ := false
+	for i := 0; i < 100 && !differ; i++ {
+		users, _ := s.Apply(insert("app.users", i))
+		orders, _ := s.Apply(insert("app.orders", i))
+		differ = len(users) != len(orders)
+	}
+	assert.True(t, differ)
+}
+
+func TestSampleExtremes(t *testing.T) {
+	none, err := New(0)
+	assert.Nil(t, err)
+	all, err := New(1)
+	assert.Nil(t, err)
+	for i := 0; i < 100; i++ {
+		out, err := none.Apply(insert("app.users", i))
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(out))
+		out, err = all.Apply(insert("app.users", i))
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(out))
+	}
+}
+
+func TestSamplePassesThrough(t *testing.T) {
+	s, err := New(0)
+	assert.Nil(t, err)
+	for _, op := range []map[string]interface{}{
+		{"op": "c", "ns": "app.$cmd", "o": bson.D{{Name: "create", Value: "users"}}},
+		{"op": "n", "ns": "", "o": bson.D{{Name: "msg", Value: "periodic noop"}}},
+		{"op": "u", "ns": "app.users", "o2": bson.D{{Name: "name", Value: "Ann"}}, "o": bson.D{{Name: "a", Value: 1}}},
+	} {
+		out, err := s.Apply(op)
+		assert.Nil(t, err)
+		assert.Equal(t, []map[string]interface{}{op}, out)
+	}
+	assert.Equal(t, "", s.Report())
+}
+
+func TestInvalidFraction(t *testing.T) {
+	for _, fraction := range []float64{-0.1, 1.5} {
+		_, err := New(fraction)
+		assert.NotNil(t, err)
+	}
+}
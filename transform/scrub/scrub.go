@@ -0,0 +1,210 @@
+// Package scrub is a transform stage that removes or anonymizes fields, so production oplogs can
+// be replayed elsewhere.
+package scrub
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/Clever/oplog-replay/transform"
+	"labix.org/v2/mgo/bson"
+)
+
+// Rule scrubs a field in the documents of matching namespaces.
+type Rule struct {
+	// Ns is the namespace the rule applies to. Patterns like "app.*" are allowed.
+	Ns string `json:"ns"`
+	// Field is the path of the field, e.g. "email" or "profile.name".
+	Field string `json:"field"`
+	// Action is one of:
+	//
+	//	drop  remove the field
+	//	null  set the field to null
+	//	hash  replace the field with an HMAC of its value
+	//	fake  replace the field with a fake value in the same Format, derived from an HMAC of its value
+	Action string `json:"action"`
+	// Format is "email" or "name", for "fake" rules.
+	Format string `json:"format,omitempty"`
+}
+
+// ParseRules reads rules from a JSON array.
+func ParseRules(r io.Reader) ([]Rule, error) {
+	var rules []Rule
+	if err := json.NewDecoder(r).Decode(&rules); err != nil {
+		return nil, fmt.Errorf("Invalid scrub rules: %s", err)
+	}
+	return rules, nil
+}
+
+// Scrubber applies scrub rules to inserts, updates and deletes. Values are hashed and faked
+// deterministically, so a document inserted with a scrubbed field is still matched by later
+// updates that select on it.
+type Scrubber struct {
+	rules  []Rule
+	secret []byte
+
+	lock     sync.Mutex
+	scrubbed map[string]int
+}
+
+// New returns a Scrubber for the rules. The secret keys the HMAC used by "hash" and "fake" rules.
+func New(rules []Rule, secret []byte) (*Scrubber, error) {
+	s := &Scrubber{secret: secret, scrubbed: map[string]int{}}
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Ns, ""); err != nil || rule.Ns == "" {
+			return nil, fmt.Errorf("Invalid namespace %q in scrub rule", rule.Ns)
+		}
+		if rule.Field == "" {
+			return nil, fmt.Errorf("Scrub rule for %s has no field", rule.Ns)
+		}
+		switch rule.Action {
+		case "drop", "null":
+		case "hash", "fake":
+			if len(secret) == 0 {
+				return nil, fmt.Errorf("Scrub rule for %s %s needs a secret to %s", rule.Ns, rule.Field, rule.Action)
+			}
+			if rule.Action == "fake" && rule.Format != "email" && rule.Format != "name" {
+				return nil, fmt.Errorf("Invalid format %q in scrub rule for %s %s", rule.Format, rule.Ns, rule.Field)
+			}
+		default:
+			return nil, fmt.Errorf("Invalid action %q in scrub rule for %s %s", rule.Action, rule.Ns, rule.Field)
+		}
+		s.rules = append(s.rules, rule)
+	}
+	return s, nil
+}
+
+// Apply implements transform.Stage. An update that's left with nothing to do once its fields are
+// dropped is dropped too. Fields can't be found in $v: 2 diff updates, so they're an error, and
+// should be converted to modifiers with translate.NewDiffConverter first.
+func (s *Scrubber) Apply(op map[string]interface{}) ([]map[string]interface{}, error) {
+	ns, _ := op["ns"].(string)
+	for i := range s.rules {
+		rule := &s.rules[i]
+		if matched, _ := path.Match(rule.Ns, ns); !matched {
+			continue
+		}
+		if o, _ := op["o"].(bson.D); op["op"] == "u" && transform.IsDiff(o) {
+			return nil, fmt.Errorf("Can't scrub a diff update of %v in %s", op["o2"], ns)
+		}
+		scrubbed := transform.ReplaceField(op, rule.Field, func(value interface{}) (interface{}, bool) {
+			return s.scrub(value, rule)
+		})
+		s.lock.Lock()
+		s.scrubbed[rule.Action] += scrubbed
+		s.lock.Unlock()
+	}
+	if o, _ := op["o"].(bson.D); op["op"] == "u" && len(o) == 0 {
+		return nil, nil
+	}
+	return []map[string]interface{}{op}, nil
+}
+
+// Report implements transform.Reporter.
+func (s *Scrubber) Report() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.scrubbed) == 0 {
+		return ""
+	}
+	counts := []string{}
+	for _, action := range []string{"drop", "null", "hash", "fake"} {
+		if s.scrubbed[action] > 0 {
+			counts = append(counts, fmt.Sprintf("%s %d", action, s.scrubbed[action]))
+		}
+	}
+	return "Scrubbed fields: " + strings.Join(counts, ", ")
+}
+
+// scrub returns the scrubbed value, or false if it should be dropped.
+func (s *Scrubber) scrub(value interface{}, rule *Rule) (interface{}, bool) {
+	switch rule.Action {
+	case "drop":
+		return nil, false
+	case "null":
+		return nil, true
+	case "hash":
+		return s.hashValue(value, ""), true
+	}
+	return s.hashValue(value, rule.Format), true
+}
+
+// hashValue replaces every value in v with its hash, or a fake value in format if it's set.
+func (s *Scrubber) hashValue(v interface{}, format string) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case bson.D:
+		for i := range v {
+			v[i].Value = s.hashValue(v[i].Value, format)
+		}
+		return v
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = s.hashValue(value, format)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = s.hashValue(value, format)
+		}
+		return v
+	case string:
+		sum := s.hmac(v)
+		switch format {
+		case "email":
+			return fakeEmail(sum)
+		case "name":
+			return fakeName(sum, len(strings.Fields(v)))
+		}
+		return hex.EncodeToString(sum)
+	}
+	// Include the type, so e.g. 1 and "1" hash differently
+	return hex.EncodeToString(s.hmac(fmt.Sprintf("%T:%v", v, v)))
+}
+
+func (s *Scrubber) hmac(value string) []byte {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(value))
+	return mac.Sum(nil)
+}
+
+// fakeEmail returns an email address derived from a hash.
+func fakeEmail(sum []byte) string {
+	return "user" + hex.EncodeToString(sum[:6]) + "@example.com"
+}
+
+var firstNames = []string{"Alex", "Blake", "Casey", "Dana", "Eli", "Frankie", "Gray", "Harper",
+	"Indy", "Jordan", "Kai", "Logan", "Morgan", "Noel", "Parker", "Quinn", "Reese", "Sage",
+	"Taylor", "Val"}
+
+var lastNames = []string{"Adams", "Brooks", "Carter", "Diaz", "Evans", "Foster", "Garcia", "Hayes",
+	"Ito", "Jensen", "Khan", "Lopez", "Moreno", "Nguyen", "Okafor", "Patel", "Reyes", "Silva",
+	"Tanaka", "Walker"}
+
+// fakeName returns a name with the given number of words derived from a hash. One word is a
+// first name, and more are a first name followed by last names.
+func fakeName(sum []byte, words int) string {
+	if words < 1 {
+		words = 1
+	}
+	name := []string{}
+	for i := 0; i < words; i++ {
+		// Each word uses two bytes of the hash, which has enough for 16 words
+		n := int(binary.BigEndian.Uint16(sum[(2*i)%len(sum):]))
+		if i == 0 {
+			name = append(name, firstNames[n%len(firstNames)])
+		} else {
+			name = append(name, lastNames[n%len(lastNames)])
+		}
+	}
+	return strings.Join(name, " ")
+}
@@ -0,0 +1,189 @@
+package scrub
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Clever/oplog-replay/transform"
+	"github.com/Clever/oplog-replay/transform/translate"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+var secret = []byte("secret")
+
+func newScrubber(t *testing.T, rules ...Rule) *Scrubber {
+	s, err := New(rules, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func apply(t *testing.T, s *Scrubber, op map[string]interface{}) map[string]interface{} {
+	out, err := s.Apply(op)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(out))
+	return out[0]
+}
+
+// d builds a document from alternating names and values.
+func d(pairs ...interface{}) bson.D {
+	doc := bson.D{}
+	for i := 0; i < len(pairs); i += 2 {
+		doc = append(doc, bson.DocElem{Name: pairs[i].(string), Value: pairs[i+1]})
+	}
+	return doc
+}
+
+func lookup(doc interface{}, name string) interface{} {
+	value, _ := transform.Lookup(doc, name)
+	return value
+}
+
+func TestHashIsConsistent(t *testing.T) {
+	s := newScrubber(t, Rule{Ns: "app.users", Field: "email", Action: "hash"})
+
+	insert := apply(t, s, map[string]interface{}{"op": "i", "ns": "app.users", "o": d("_id", 1, "email", "a@b.com")})
+	hashed := lookup(insert["o"], "email")
+	assert.NotEqual(t, "a@b.com", hashed)
+	assert.Equal(t, 64, len(hashed.(string)))
+
+	update := apply(t, s, map[string]interface{}{"op": "u", "ns": "app.users",
+		"o2": d("email", "a@b.com"),
+		"o":  d("$set", d("email", "a@b.com", "age", 5))})
+	assert.Equal(t, hashed, lookup(update["o2"], "email"))
+	assert.Equal(t, d("$set", d("email", hashed, "age", 5)), update["o"])
+
+	remove := apply(t, s, map[string]interface{}{"op": "d", "ns": "app.users", "o": d("email", "a@b.com")})
+	assert.Equal(t, hashed, lookup(remove["o"], "email"))
+
+	// Other namespaces aren't touched
+	other := apply(t, s, map[string]interface{}{"op": "i", "ns": "app.orders", "o": d("email", "a@b.com")})
+	assert.Equal(t, "a@b.com", lookup(other["o"], "email"))
+
+	// A different secret hashes differently
+	s2, err := New([]Rule{{Ns: "app.users", Field: "email", Action: "hash"}}, []byte("other"))
+	assert.Nil(t, err)
+	insert = apply(t, s2, map[string]interface{}{"op": "i", "ns": "app.users", "o": d("email", "a@b.com")})
+	assert.NotEqual(t, hashed, lookup(insert["o"], "email"))
+}
+
+func TestNestedFields(t *testing.T) {
+	s := newScrubber(t, Rule{Ns: "app.*", Field: "profile.name", Action: "null"})
+
+	insert := apply(t, s, map[string]interface{}{"op": "i", "ns": "app.users", "o": d(
+		"profile", d("name", "Ann", "age", 5),
+		"contacts", []interface{}{d("profile", d("name", "Bo"))},
+	)})
+	assert.Equal(t, d("name", nil, "age", 5), lookup(insert["o"], "profile"))
+
+	// Dotted $set keys, both above and at the field
+	update := apply(t, s, map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+		"o": d("$set", d(
+			"profile", d("name", "Ann"),
+			"profile.name", "Ann",
+		))})
+	assert.Equal(t, d("$set", d(
+		"profile", d("name", nil),
+		"profile.name", nil,
+	)), update["o"])
+
+	// Replacement updates are scrubbed like inserts
+	update = apply(t, s, map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+		"o": d("_id", 1, "profile", d("name", "Ann"))})
+	assert.Equal(t, d("_id", 1, "profile", d("name", nil)), update["o"])
+}
+
+func TestArrays(t *testing.T) {
+	s := newScrubber(t, Rule{Ns: "app.users", Field: "emails.address", Action: "hash"})
+	insert := apply(t, s, map[string]interface{}{"op": "i", "ns": "app.users", "o": d(
+		"emails", []interface{}{d("address", "a@b.com"), d("address", "c@d.com")},
+	)})
+	emails := lookup(insert["o"], "emails").([]interface{})
+	for _, email := range emails {
+		assert.Equal(t, 64, len(lookup(email, "address").(string)))
+	}
+
+	update := apply(t, s, map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+		"o": d("$set", d("emails.1.address", "c@d.com"))})
+	assert.Equal(t, lookup(emails[1], "address"), lookup(lookup(update["o"], "$set"), "emails.1.address"))
+}
+
+func TestDrop(t *testing.T) {
+	s := newScrubber(t, Rule{Ns: "app.users", Field: "ssn", Action: "drop"})
+	insert := apply(t, s, map[string]interface{}{"op": "i", "ns": "app.users", "o": d("_id", 1, "ssn", "123")})
+	assert.Equal(t, d("_id", 1), insert["o"])
+
+	update := apply(t, s, map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+		"o": d("$set", d("ssn", "123"), "$inc", d("n", 1))})
+	assert.Equal(t, d("$inc", d("n", 1)), update["o"])
+
+	// An update with nothing left to do is dropped
+	out, err := s.Apply(map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+		"o": d("$set", d("ssn", "123"))})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(out))
+	assert.Equal(t, "Scrubbed fields: drop 3", s.Report())
+}
+
+func TestDiffUpdates(t *testing.T) {
+	s := newScrubber(t, Rule{Ns: "app.users", Field: "email", Action: "hash"})
+	diff := func() map[string]interface{} {
+		return map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+			"o": d("$v", 2, "diff", d("u", d("email", "a@b.com"), "sprofile", d("i", d("email", "c@d.com"))))}
+	}
+	_, err := s.Apply(diff())
+	assert.NotNil(t, err)
+
+	out, err := transform.Chain{translate.NewDiffConverter(), s}.Apply(diff())
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(out))
+	set := lookup(out[0]["o"], "$set").(bson.D)
+	assert.Equal(t, []string{"email", "profile.email"}, []string{set[0].Name, set[1].Name})
+	assert.Equal(t, s.hashValue("a@b.com", ""), set[0].Value)
+	assert.Equal(t, "c@d.com", set[1].Value)
+}
+
+func TestFake(t *testing.T) {
+	s := newScrubber(t,
+		Rule{Ns: "app.users", Field: "email", Action: "fake", Format: "email"},
+		Rule{Ns: "app.users", Field: "name", Action: "fake", Format: "name"},
+	)
+	doc := func() bson.D {
+		return d("email", "ann@corp.com", "name", "Ann Marie Smith")
+	}
+	first := apply(t, s, map[string]interface{}{"op": "i", "ns": "app.users", "o": doc()})["o"]
+	second := apply(t, s, map[string]interface{}{"op": "i", "ns": "app.users", "o": doc()})["o"]
+	assert.Equal(t, first, second)
+
+	email := lookup(first, "email").(string)
+	assert.True(t, strings.HasSuffix(email, "@example.com"), email)
+	assert.Equal(t, 3, len(strings.Fields(lookup(first, "name").(string))))
+	assert.NotEqual(t, "Ann Marie Smith", lookup(first, "name"))
+}
+
+func TestInvalidRules(t *testing.T) {
+	for _, rule := range []Rule{
+		{Field: "email", Action: "hash"},
+		{Ns: "app.[", Field: "email", Action: "hash"},
+		{Ns: "app.users", Action: "hash"},
+		{Ns: "app.users", Field: "email", Action: "encrypt"},
+		{Ns: "app.users", Field: "email", Action: "fake", Format: "phone"},
+	} {
+		_, err := New([]Rule{rule}, secret)
+		assert.NotNil(t, err, "%#v", rule)
+	}
+	_, err := New([]Rule{{Ns: "app.users", Field: "email", Action: "hash"}}, nil)
+	assert.NotNil(t, err)
+	_, err = New([]Rule{{Ns: "app.users", Field: "email", Action: "drop"}}, nil)
+	assert.Nil(t, err)
+}
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(strings.NewReader(`[{"ns": "app.users", "field": "email", "action": "fake", "format": "email"}]`))
+	assert.Nil(t, err)
+	assert.Equal(t, []Rule{{Ns: "app.users", Field: "email", Action: "fake", Format: "email"}}, rules)
+	_, err = ParseRules(strings.NewReader(`{"ns": "app.users"}`))
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,165 @@
+// Package timeshift is a transform stage that moves dates and ObjectId timestamps forward, so
+// replayed data looks current to TTL indexes and time-based queries.
+package timeshift
+
+import (
+	"encoding/binary"
+	"fmt"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Clever/oplog-replay/transform"
+	"labix.org/v2/mgo/bson"
+)
+
+// Rule selects the fields to shift.
+type Rule struct {
+	// Ns is the namespace the rule applies to. Patterns like "app.*" are allowed.
+	Ns string
+	// Field is the path of the field to shift, e.g. "createdAt". If it's empty every field is.
+	Field string
+}
+
+// ParseRule parses a rule given as "<ns>" or "<ns>:<field>".
+func ParseRule(rule string) (Rule, error) {
+	parts := strings.SplitN(rule, ":", 2)
+	r := Rule{Ns: parts[0]}
+	if len(parts) == 2 {
+		if parts[1] == "" {
+			return Rule{}, fmt.Errorf("Invalid time shift rule %q: the field is empty", rule)
+		}
+		r.Field = parts[1]
+	}
+	if _, err := path.Match(r.Ns, ""); err != nil || r.Ns == "" {
+		return Rule{}, fmt.Errorf("Invalid time shift rule %q: bad namespace", rule)
+	}
+	return r, nil
+}
+
+// Shifter shifts every Date, and the timestamp of every ObjectId, in the fields its rules select.
+// Values are shifted the same way in inserts, update operators and selectors, so that they still
+// match.
+type Shifter struct {
+	rules     []Rule
+	dates     bool
+	objectIDs bool
+
+	lock sync.Mutex
+	// offset is how far to shift, in whole seconds since ObjectIds can't shift any less
+	offset  time.Duration
+	pending bool
+	now     func() time.Time
+}
+
+// New returns a Shifter that shifts dates if dates is set and ObjectIds if objectIDs is set, by
+// offset rounded down to a whole second. With no rules, every field in every namespace is
+// shifted.
+func New(offset time.Duration, rules []Rule, dates, objectIDs bool) *Shifter {
+	if len(rules) == 0 {
+		rules = []Rule{{Ns: "*"}}
+	}
+	return &Shifter{rules: rules, dates: dates, objectIDs: objectIDs, offset: offset / time.Second * time.Second}
+}
+
+// NewSinceStart returns a Shifter that shifts by how long ago the first op it's given was, so
+// that the oplog looks like it started now.
+func NewSinceStart(rules []Rule, dates, objectIDs bool) *Shifter {
+	s := New(0, rules, dates, objectIDs)
+	s.pending = true
+	s.now = time.Now
+	return s
+}
+
+// Offset returns how far values are shifted. For a Shifter from NewSinceStart it's 0 until the
+// first op.
+func (s *Shifter) Offset() time.Duration {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.offset
+}
+
+// Apply implements transform.Stage.
+func (s *Shifter) Apply(op map[string]interface{}) ([]map[string]interface{}, error) {
+	s.lock.Lock()
+	if s.pending {
+		if ts, ok := op["ts"].(bson.MongoTimestamp); ok {
+			s.offset = s.now().Sub(time.Unix(int64(ts>>32), 0)) / time.Second * time.Second
+			s.pending = false
+		}
+	}
+	s.lock.Unlock()
+
+	ns, _ := op["ns"].(string)
+	if op["op"] == "c" || op["op"] == "n" {
+		return []map[string]interface{}{op}, nil
+	}
+	fields := []string{}
+	for _, rule := range s.rules {
+		if matched, _ := path.Match(rule.Ns, ns); !matched {
+			continue
+		}
+		if rule.Field == "" {
+			// Shift every field, and only once even if other rules match too
+			for _, field := range []string{"o", "o2"} {
+				if value, ok := op[field]; ok {
+					op[field] = s.shift(value)
+				}
+			}
+			return []map[string]interface{}{op}, nil
+		}
+		fields = append(fields, rule.Field)
+	}
+	for _, field := range fields {
+		transform.ReplaceField(op, field, func(value interface{}) (interface{}, bool) {
+			return s.shift(value), true
+		})
+	}
+	return []map[string]interface{}{op}, nil
+}
+
+// Report implements transform.Reporter.
+func (s *Shifter) Report() string {
+	return fmt.Sprintf("Shifted times by %v", s.Offset())
+}
+
+// shift returns value with every date and ObjectId in it shifted.
+func (s *Shifter) shift(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		if s.dates {
+			return v.Add(s.Offset())
+		}
+	case bson.ObjectId:
+		if s.objectIDs && v.Valid() {
+			return shiftObjectID(v, s.Offset())
+		}
+	case bson.D:
+		for i := range v {
+			v[i].Value = s.shift(v[i].Value)
+		}
+	case map[string]interface{}:
+		for key, elem := range v {
+			v[key] = s.shift(elem)
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = s.shift(elem)
+		}
+	}
+	return value
+}
+
+// shiftObjectID returns the ObjectId with its timestamp shifted by offset, and the rest unchanged.
+func shiftObjectID(id bson.ObjectId, offset time.Duration) bson.ObjectId {
+	b := []byte(string(id))
+	seconds := int64(binary.BigEndian.Uint32(b[:4])) + int64(offset/time.Second)
+	if seconds < 0 {
+		seconds = 0
+	} else if seconds > 1<<32-1 {
+		seconds = 1<<32 - 1
+	}
+	binary.BigEndian.PutUint32(b[:4], uint32(seconds))
+	return bson.ObjectId(b)
+}
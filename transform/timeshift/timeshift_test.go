@@ -0,0 +1,98 @@
+package timeshift
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+var (
+	day     = 24 * time.Hour
+	created = time.Date(2015, 10, 16, 12, 0, 0, 0, time.UTC)
+	id      = bson.ObjectIdHex("5392478b53a5b29c16f834f2")
+)
+
+func apply(t *testing.T, s *Shifter, op map[string]interface{}) map[string]interface{} {
+	out, err := s.Apply(op)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(out))
+	return out[0]
+}
+
+func TestShiftEverything(t *testing.T) {
+	s := New(10*day, nil, true, true)
+	op := apply(t, s, map[string]interface{}{"op": "i", "ns": "app.users", "o": bson.D{
+		{Name: "_id", Value: id}, {Name: "createdAt", Value: created}, {Name: "logins", Value: []interface{}{created}}, {Name: "name", Value: "Ann"},
+	}})
+	o := op["o"].(bson.D)
+	assert.Equal(t, created.Add(10*day), o[1].Value)
+	assert.Equal(t, []interface{}{created.Add(10 * day)}, o[2].Value)
+	assert.Equal(t, "Ann", o[3].Value)
+
+	shiftedID := o[0].Value.(bson.ObjectId)
+	assert.Equal(t, id.Time().Add(10*day), shiftedID.Time())
+	assert.Equal(t, id[4:], shiftedID[4:])
+
+	// Selectors are shifted the same way, so they still match
+	op = apply(t, s, map[string]interface{}{"op": "u", "ns": "app.users", "o2": bson.D{{Name: "_id", Value: id}},
+		"o": bson.D{{Name: "$set", Value: bson.D{{Name: "updatedAt", Value: created}}}}})
+	assert.Equal(t, bson.D{{Name: "_id", Value: shiftedID}}, op["o2"])
+	assert.Equal(t, bson.D{{Name: "$set", Value: bson.D{{Name: "updatedAt", Value: created.Add(10 * day)}}}}, op["o"])
+}
+
+func TestShiftFields(t *testing.T) {
+	rule, err := ParseRule("app.sessions:createdAt")
+	assert.Nil(t, err)
+	s := New(day, []Rule{rule}, true, true)
+
+	op := apply(t, s, map[string]interface{}{"op": "i", "ns": "app.sessions", "o": bson.D{
+		{Name: "_id", Value: id}, {Name: "createdAt", Value: created}, {Name: "expiresAt", Value: created},
+	}})
+	assert.Equal(t, bson.D{
+		{Name: "_id", Value: id}, {Name: "createdAt", Value: created.Add(day)}, {Name: "expiresAt", Value: created},
+	}, op["o"])
+
+	op = apply(t, s, map[string]interface{}{"op": "i", "ns": "app.users", "o": bson.D{{Name: "createdAt", Value: created}}})
+	assert.Equal(t, bson.D{{Name: "createdAt", Value: created}}, op["o"])
+}
+
+func TestShiftTypes(t *testing.T) {
+	s := New(day, nil, false, true)
+	op := apply(t, s, map[string]interface{}{"op": "i", "ns": "app.users", "o": bson.D{{Name: "_id", Value: id}, {Name: "createdAt", Value: created}}})
+	o := op["o"].(bson.D)
+	assert.Equal(t, created, o[1].Value)
+	assert.NotEqual(t, id, o[0].Value)
+}
+
+func TestSinceStart(t *testing.T) {
+	s := NewSinceStart(nil, true, true)
+	now := created.Add(100*day + 1500*time.Millisecond)
+	s.now = func() time.Time { return now }
+
+	start := bson.MongoTimestamp(created.Unix() << 32)
+	op := apply(t, s, map[string]interface{}{"ts": start, "op": "i", "ns": "app.users", "o": bson.D{{Name: "createdAt", Value: created}}})
+	assert.Equal(t, 100*day+time.Second, s.Offset())
+	assert.Equal(t, bson.D{{Name: "createdAt", Value: created.Add(100*day + time.Second)}}, op["o"])
+
+	// The offset is fixed by the first op
+	now = now.Add(time.Hour)
+	apply(t, s, map[string]interface{}{"ts": start + 1<<32, "op": "n", "ns": ""})
+	assert.Equal(t, 100*day+time.Second, s.Offset())
+}
+
+func TestShiftObjectIDClamps(t *testing.T) {
+	shifted := shiftObjectID(id, -100*365*day)
+	assert.Equal(t, int64(0), shifted.Time().Unix())
+}
+
+func TestParseRule(t *testing.T) {
+	rule, err := ParseRule("app.*")
+	assert.Nil(t, err)
+	assert.Equal(t, Rule{Ns: "app.*"}, rule)
+	for _, invalid := range []string{"", ":createdAt", "app.users:", "app.[:createdAt"} {
+		_, err := ParseRule(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
@@ -0,0 +1,114 @@
+// Package transform rewrites oplog entries on their way to being replayed or written out.
+package transform
+
+import (
+	"sort"
+	"strings"
+
+	"labix.org/v2/mgo/bson"
+)
+
+// Stage is an interface for a step that rewrites oplog entries.
+type Stage interface {
+	// Apply returns the entries op should be replaced with: op itself, possibly modified, none to
+	// drop it, or several to fan it out.
+	Apply(op map[string]interface{}) ([]map[string]interface{}, error)
+}
+
+// Reporter is an optional interface for Stages that can summarize what they did.
+type Reporter interface {
+	// Report returns a human readable summary, or an empty string if there is nothing to report.
+	Report() string
+}
+
+// Chain is a Stage that applies each of its stages in turn to the output of the one before.
+type Chain []Stage
+
+// Apply implements Stage.
+func (c Chain) Apply(op map[string]interface{}) ([]map[string]interface{}, error) {
+	ops := []map[string]interface{}{op}
+	for _, stage := range c {
+		next := []map[string]interface{}{}
+		for _, op := range ops {
+			out, err := stage.Apply(op)
+			if err != nil {
+				return nil, err
+			}
+			next = append(next, out...)
+		}
+		ops = next
+	}
+	return ops, nil
+}
+
+// Report implements Reporter by joining the reports of the stages that have one.
+func (c Chain) Report() string {
+	reports := []string{}
+	for _, stage := range c {
+		if reporter, ok := stage.(Reporter); ok {
+			if report := reporter.Report(); report != "" {
+				reports = append(reports, report)
+			}
+		}
+	}
+	return strings.Join(reports, "\n")
+}
+
+// Decode unmarshals an oplog entry. Its documents, like 'o' and 'o2', are kept as bson.Ds, since
+// the order of their fields matters: it's the name of a command, the order of an index's fields,
+// and part of whether a compound _id matches.
+func Decode(raw []byte) (map[string]interface{}, error) {
+	op, _, err := DecodeDoc(raw)
+	return op, err
+}
+
+// DecodeDoc is Decode, also returning the entry as a bson.D in the order of its fields. The two
+// share their values.
+func DecodeDoc(raw []byte) (map[string]interface{}, bson.D, error) {
+	var doc bson.D
+	if err := bson.Unmarshal(raw, &doc); err != nil {
+		return nil, nil, err
+	}
+	op := make(map[string]interface{}, len(doc))
+	for _, field := range doc {
+		op[field.Name] = field.Value
+	}
+	return op, doc, nil
+}
+
+// fieldOrder is the order mongod writes the fields of an oplog entry in.
+var fieldOrder = []string{"ts", "t", "h", "v", "op", "ns", "ui", "wall", "o2", "o"}
+
+// Encode marshals an oplog entry back to BSON. Its fields are written in the order they have in
+// template, the encoded entry op was decoded from, so an entry that wasn't changed is encoded
+// exactly as it was. Fields that aren't in template, or all of them if it's nil, follow in the
+// order mongod writes them, and then in alphabetical order.
+func Encode(op map[string]interface{}, template []byte) ([]byte, error) {
+	order := []string{}
+	if template != nil {
+		var fields bson.RawD
+		if err := bson.Unmarshal(template, &fields); err != nil {
+			return nil, err
+		}
+		for _, field := range fields {
+			order = append(order, field.Name)
+		}
+	}
+	order = append(order, fieldOrder...)
+	others := []string{}
+	for field := range op {
+		others = append(others, field)
+	}
+	sort.Strings(others)
+	order = append(order, others...)
+
+	doc := bson.D{}
+	written := map[string]bool{}
+	for _, field := range order {
+		if value, ok := op[field]; ok && !written[field] {
+			doc = append(doc, bson.DocElem{Name: field, Value: value})
+			written[field] = true
+		}
+	}
+	return bson.Marshal(doc)
+}
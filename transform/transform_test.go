@@ -0,0 +1,219 @@
+package transform
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	bsonScanner "github.com/Clever/oplog-replay/bson"
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+// stageFunc lets a function be used as a Stage.
+type stageFunc func(op map[string]interface{}) ([]map[string]interface{}, error)
+
+func (f stageFunc) Apply(op map[string]interface{}) ([]map[string]interface{}, error) { return f(op) }
+
+type reportingStage struct {
+	stageFunc
+	report string
+}
+
+func (r reportingStage) Report() string { return r.report }
+
+func TestChain(t *testing.T) {
+	double := stageFunc(func(op map[string]interface{}) ([]map[string]interface{}, error) {
+		copied := map[string]interface{}{"n": op["n"].(int) * 10}
+		return []map[string]interface{}{op, copied}, nil
+	})
+	dropOdd := stageFunc(func(op map[string]interface{}) ([]map[string]interface{}, error) {
+		if op["n"].(int)%2 == 1 {
+			return nil, nil
+		}
+		return []map[string]interface{}{op}, nil
+	})
+
+	out, err := Chain{double, dropOdd}.Apply(map[string]interface{}{"n": 1})
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{{"n": 10}}, out)
+
+	out, err = Chain{}.Apply(map[string]interface{}{"n": 1})
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{{"n": 1}}, out)
+
+	failing := stageFunc(func(op map[string]interface{}) ([]map[string]interface{}, error) {
+		return nil, fmt.Errorf("failed")
+	})
+	_, err = Chain{double, failing}.Apply(map[string]interface{}{"n": 1})
+	assert.NotNil(t, err)
+}
+
+func TestChainReport(t *testing.T) {
+	noop := stageFunc(func(op map[string]interface{}) ([]map[string]interface{}, error) { return nil, nil })
+	chain := Chain{reportingStage{noop, "first"}, noop, reportingStage{noop, ""}, reportingStage{noop, "second"}}
+	assert.Equal(t, "first\nsecond", chain.Report())
+}
+
+func TestDecode(t *testing.T) {
+	raw, err := bson.Marshal(bson.D{
+		{Name: "op", Value: "c"},
+		{Name: "ns", Value: "app.$cmd"},
+		{Name: "o", Value: bson.D{{Name: "create", Value: "users"}, {Name: "capped", Value: true}, {Name: "size", Value: 100}}},
+	})
+	assert.Nil(t, err)
+	op, err := Decode(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, "app.$cmd", op["ns"])
+	assert.Equal(t, bson.D{{Name: "create", Value: "users"}, {Name: "capped", Value: true}, {Name: "size", Value: 100}}, op["o"])
+
+	raw, err = bson.Marshal(bson.M{"op": "i", "ns": "app.users", "o": bson.D{
+		{Name: "_id", Value: bson.D{{Name: "b", Value: 1}, {Name: "a", Value: 2}}}, {Name: "list", Value: []interface{}{bson.D{{Name: "z", Value: 1}}}}}})
+	assert.Nil(t, err)
+	op, err = Decode(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, bson.D{
+		{Name: "_id", Value: bson.D{{Name: "b", Value: 1}, {Name: "a", Value: 2}}}, {Name: "list", Value: []interface{}{bson.D{{Name: "z", Value: 1}}}}}, op["o"])
+
+	_, err = Decode([]byte{5, 0, 0, 0})
+	assert.NotNil(t, err)
+}
+
+func TestDecodeDoc(t *testing.T) {
+	raw, err := bson.Marshal(bson.D{{Name: "ts", Value: bson.MongoTimestamp(1 << 32)}, {Name: "op", Value: "n"}, {Name: "ns", Value: ""}})
+	assert.Nil(t, err)
+	op, doc, err := DecodeDoc(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, "n", op["op"])
+	assert.Equal(t, bson.D{{Name: "ts", Value: bson.MongoTimestamp(1 << 32)}, {Name: "op", Value: "n"}, {Name: "ns", Value: ""}}, doc)
+}
+
+func TestEncode(t *testing.T) {
+	op := map[string]interface{}{
+		"o": bson.D{{Name: "_id", Value: 1}}, "ns": "app.users", "op": "i", "b": true,
+		"ts": bson.MongoTimestamp(1 << 32), "h": int64(5), "a": 1,
+	}
+	raw, err := Encode(op, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"ts", "h", "op", "ns", "o", "a", "b"}, fieldNames(t, raw))
+
+	// Encoding round trips through Decode
+	decoded, err := Decode(raw)
+	assert.Nil(t, err)
+	assert.Equal(t, op, decoded)
+
+	// Fields are written in the template's order, with new ones after them
+	template, err := bson.Marshal(bson.D{{Name: "op", Value: "i"}, {Name: "ns", Value: "app.users"}, {Name: "b", Value: true},
+		{Name: "o", Value: 1}, {Name: "ts", Value: 1}, {Name: "gone", Value: 1}})
+	assert.Nil(t, err)
+	raw, err = Encode(op, template)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"op", "ns", "b", "o", "ts", "h", "a"}, fieldNames(t, raw))
+}
+
+func fieldNames(t *testing.T, raw []byte) []string {
+	var doc bson.D
+	assert.Nil(t, bson.Unmarshal(raw, &doc))
+	names := []string{}
+	for _, elem := range doc {
+		names = append(names, elem.Name)
+	}
+	return names
+}
+
+func TestRoundTrip(t *testing.T) {
+	f, err := os.Open("../bson/testdata.bson")
+	assert.Nil(t, err)
+	defer f.Close()
+	scanner := bsonScanner.New(f)
+	entries := 0
+	for scanner.Scan() {
+		op, err := Decode(scanner.Bytes())
+		assert.Nil(t, err)
+		raw, err := Encode(op, scanner.Bytes())
+		assert.Nil(t, err)
+		assert.Equal(t, scanner.Bytes(), raw)
+		entries++
+	}
+	assert.Nil(t, scanner.Err())
+	assert.True(t, entries > 0)
+}
+
+func TestReplaceField(t *testing.T) {
+	double := func(value interface{}) (interface{}, bool) { return value.(int) * 2, true }
+	remove := func(value interface{}) (interface{}, bool) { return nil, false }
+
+	insert := map[string]interface{}{"op": "i", "o": bson.D{
+		{Name: "a", Value: bson.D{{Name: "b", Value: 1}}}, {Name: "list", Value: []interface{}{bson.D{{Name: "b", Value: 2}}, 3}},
+	}}
+	assert.Equal(t, 1, ReplaceField(insert, "a.b", double))
+	assert.Equal(t, 1, ReplaceField(insert, "list.b", double))
+	assert.Equal(t, bson.D{
+		{Name: "a", Value: bson.D{{Name: "b", Value: 2}}}, {Name: "list", Value: []interface{}{bson.D{{Name: "b", Value: 4}}, 3}},
+	}, insert["o"])
+
+	update := map[string]interface{}{"op": "u",
+		"o2": bson.D{{Name: "a.b", Value: 1}},
+		"o": bson.D{
+			{Name: "$set", Value: bson.D{{Name: "a", Value: bson.D{{Name: "b", Value: 1}}}}},
+			{Name: "$inc", Value: bson.D{{Name: "a.b", Value: 1}}},
+			{Name: "$unset", Value: bson.D{{Name: "a.b", Value: 1}}},
+		}}
+	assert.Equal(t, 3, ReplaceField(update, "a.b", double))
+	assert.Equal(t, bson.D{{Name: "a.b", Value: 2}}, update["o2"])
+	assert.Equal(t, bson.D{
+		{Name: "$set", Value: bson.D{{Name: "a", Value: bson.D{{Name: "b", Value: 2}}}}},
+		{Name: "$inc", Value: bson.D{{Name: "a.b", Value: 2}}},
+		{Name: "$unset", Value: bson.D{{Name: "a.b", Value: 1}}},
+	}, update["o"])
+
+	// Removing every field of an operator removes the operator
+	assert.Equal(t, 3, ReplaceField(update, "a", remove))
+	assert.Equal(t, bson.D{{Name: "$unset", Value: bson.D{{Name: "a.b", Value: 1}}}}, update["o"])
+	assert.Equal(t, bson.D{}, update["o2"])
+
+	remove2 := map[string]interface{}{"op": "d", "o": bson.D{{Name: "_id", Value: 1}, {Name: "x", Value: 1}}}
+	assert.Equal(t, 1, ReplaceField(remove2, "_id", remove))
+	assert.Equal(t, bson.D{{Name: "x", Value: 1}}, remove2["o"])
+}
+
+func TestIsModifier(t *testing.T) {
+	for _, test := range []struct {
+		o        bson.D
+		modifier bool
+	}{
+		{bson.D{{Name: "$set", Value: bson.D{{Name: "a", Value: 1}}}}, true},
+		{bson.D{{Name: "$v", Value: 1}, {Name: "$set", Value: bson.D{{Name: "a", Value: 1}}}}, true},
+		{bson.D{{Name: "$v", Value: 2}, {Name: "diff", Value: bson.D{{Name: "u", Value: bson.D{{Name: "a", Value: 1}}}}}}, true},
+		{bson.D{{Name: "$v", Value: 1}, {Name: "diff", Value: bson.D{}}}, false},
+		{bson.D{{Name: "$set", Value: bson.D{}}, {Name: "a", Value: 1}}, false},
+		{bson.D{{Name: "_id", Value: 1}, {Name: "a", Value: 1}}, false},
+		{bson.D{}, false},
+	} {
+		assert.Equal(t, test.modifier, IsModifier(test.o), fmt.Sprint(test.o))
+	}
+
+	// Diffs are left alone
+	diff := bson.D{{Name: "$v", Value: 2}, {Name: "diff", Value: bson.D{{Name: "u", Value: bson.D{{Name: "a", Value: 1}}}}}}
+	update := map[string]interface{}{"op": "u", "o2": bson.D{{Name: "_id", Value: 1}}, "o": diff}
+	assert.Equal(t, 0, ReplaceField(update, "a", func(interface{}) (interface{}, bool) { return 2, true }))
+	assert.Equal(t, diff, update["o"])
+}
+
+func TestDocHelpers(t *testing.T) {
+	doc := bson.D{{Name: "a", Value: 1}, {Name: "b", Value: 2}}
+	value, ok := Lookup(doc, "b")
+	assert.True(t, ok)
+	assert.Equal(t, 2, value)
+	_, ok = Lookup(doc, "c")
+	assert.False(t, ok)
+	value, ok = Lookup(map[string]interface{}{"c": 3}, "c")
+	assert.True(t, ok)
+	assert.Equal(t, 3, value)
+
+	doc = Set(doc, "a", 5)
+	doc = Set(doc, "c", 6)
+	assert.Equal(t, bson.D{{Name: "a", Value: 5}, {Name: "b", Value: 2}, {Name: "c", Value: 6}}, doc)
+	assert.Equal(t, bson.D{{Name: "a", Value: 5}, {Name: "c", Value: 6}}, Remove(doc, "b"))
+	assert.Equal(t, bson.D{{Name: "a", Value: 5}, {Name: "b", Value: 2}, {Name: "c", Value: 6}}, doc)
+}
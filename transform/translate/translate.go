@@ -0,0 +1,381 @@
+// Package translate is a transform stage that rewrites ops from one server version so they can be
+// applied by another.
+package translate
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Clever/oplog-replay/transform"
+	"labix.org/v2/mgo/bson"
+)
+
+// Version is a server version, e.g. {4, 2, 1}.
+type Version []int
+
+// ParseVersion parses a version like "4.2.1".
+func ParseVersion(version string) (Version, error) {
+	v := Version{}
+	for _, part := range strings.Split(version, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("Invalid server version: %s", version)
+		}
+		v = append(v, n)
+	}
+	return v, nil
+}
+
+// AtLeast returns whether v is the same as or newer than other.
+func (v Version) AtLeast(other Version) bool {
+	for i := 0; i < len(v) || i < len(other); i++ {
+		a, b := 0, 0
+		if i < len(v) {
+			a = v[i]
+		}
+		if i < len(other) {
+			b = other[i]
+		}
+		if a != b {
+			return a > b
+		}
+	}
+	return true
+}
+
+func (v Version) String() string {
+	parts := []string{}
+	for _, n := range v {
+		parts = append(parts, strconv.Itoa(n))
+	}
+	return strings.Join(parts, ".")
+}
+
+var (
+	// indexCommands is the first version without system.indexes, which needs createIndexes
+	indexCommands = Version{4, 2}
+	// diffUpdates is the first version that can apply $v: 2 diff updates
+	diffUpdates = Version{5, 0}
+	// versionedUpdates is the first version that writes $v in updates
+	versionedUpdates = Version{3, 6}
+)
+
+// sourceFields refer to collections, sessions or other entries on the server the oplog came from,
+// so they're removed whatever the target.
+var sourceFields = []string{"ui", "lsid", "txnNumber", "stmtId", "prevOpTime", "preImageOpTime", "postImageOpTime"}
+
+// newFields are fields of entries with the first version that writes them. They're removed for
+// older targets.
+var newFields = map[string]Version{"t": {3, 2}, "wall": {3, 6}}
+
+// Translator rewrites ops for a target server version:
+//
+//   - fields that refer to the source server, like ui and lsid, are removed, as are fields the
+//     target is too old to know, like wall
+//   - $v: 2 diff updates are turned into $set, $unset and $push updates for targets before 5.0
+//   - inserts into system.indexes are turned into createIndexes commands for 4.2 and later
+//
+// Ops in transactions, which are applied with applyOps, are translated too.
+type Translator struct {
+	target    Version
+	diffsOnly bool
+
+	lock   sync.Mutex
+	counts map[string]int
+}
+
+// New returns a Translator for the target version.
+func New(target Version) *Translator {
+	return &Translator{target: target, counts: map[string]int{}}
+}
+
+// NewDiffConverter returns a Translator that only turns $v: 2 diff updates into $set, $unset and
+// $push updates, whatever the target. Stages that rewrite fields, like scrubbing, can't find them
+// in diffs, so it goes before them.
+func NewDiffConverter() *Translator {
+	return &Translator{diffsOnly: true, counts: map[string]int{}}
+}
+
+// Apply implements transform.Stage.
+func (t *Translator) Apply(op map[string]interface{}) ([]map[string]interface{}, error) {
+	return t.translate(op)
+}
+
+// Report implements transform.Reporter.
+func (t *Translator) Report() string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.counts) == 0 {
+		return ""
+	}
+	counts := []string{}
+	for name, count := range t.counts {
+		counts = append(counts, fmt.Sprintf("%s %d", name, count))
+	}
+	sort.Strings(counts)
+	if t.diffsOnly {
+		return "Converted ops: " + strings.Join(counts, ", ")
+	}
+	return fmt.Sprintf("Translated ops for MongoDB %v: %s", t.target, strings.Join(counts, ", "))
+}
+
+func (t *Translator) count(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.counts[name]++
+}
+
+// translate returns the ops to apply for op. It's usually just op, rewritten, but some updates
+// take more than one.
+func (t *Translator) translate(op map[string]interface{}) ([]map[string]interface{}, error) {
+	for _, field := range sourceFields {
+		if _, ok := op[field]; ok && !t.diffsOnly {
+			delete(op, field)
+			t.count("removed " + field)
+		}
+	}
+	for field, version := range newFields {
+		if _, ok := op[field]; ok && !t.diffsOnly && !t.target.AtLeast(version) {
+			delete(op, field)
+			t.count("removed " + field)
+		}
+	}
+
+	ns, _ := op["ns"].(string)
+	switch op["op"] {
+	case "u":
+		return t.translateUpdate(op)
+	case "i":
+		if strings.HasSuffix(ns, ".system.indexes") && !t.diffsOnly && t.target.AtLeast(indexCommands) {
+			if indexCommand(op) {
+				t.count("index builds")
+			}
+		}
+	case "c":
+		command, _ := op["o"].(bson.D)
+		if len(command) > 0 && command[0].Name == "applyOps" {
+			ops, _ := command[0].Value.([]interface{})
+			translated := []interface{}{}
+			for _, nested := range ops {
+				nestedOps, err := t.translateNested(nested)
+				if err != nil {
+					return nil, err
+				}
+				translated = append(translated, nestedOps...)
+			}
+			command[0].Value = translated
+		}
+	}
+	return []map[string]interface{}{op}, nil
+}
+
+// translateNested translates an op in an applyOps command, keeping the order of its fields.
+func (t *Translator) translateNested(nested interface{}) ([]interface{}, error) {
+	switch nestedOp := nested.(type) {
+	case map[string]interface{}:
+		ops, err := t.translate(nestedOp)
+		if err != nil {
+			return nil, err
+		}
+		translated := []interface{}{}
+		for _, op := range ops {
+			translated = append(translated, op)
+		}
+		return translated, nil
+	case bson.D:
+		ops, err := t.translate(nestedOp.Map())
+		if err != nil {
+			return nil, err
+		}
+		translated := []interface{}{}
+		for _, op := range ops {
+			translated = append(translated, inOrder(op, nestedOp))
+		}
+		return translated, nil
+	}
+	return []interface{}{nested}, nil
+}
+
+// inOrder returns op as a document with the fields in the order they have in template, followed
+// by any new ones in alphabetical order.
+func inOrder(op map[string]interface{}, template bson.D) bson.D {
+	doc := bson.D{}
+	for _, field := range template {
+		if value, ok := op[field.Name]; ok {
+			doc = append(doc, bson.DocElem{Name: field.Name, Value: value})
+		}
+	}
+	added := []string{}
+	for name := range op {
+		if _, ok := transform.Lookup(template, name); !ok {
+			added = append(added, name)
+		}
+	}
+	sort.Strings(added)
+	for _, name := range added {
+		doc = append(doc, bson.DocElem{Name: name, Value: op[name]})
+	}
+	return doc
+}
+
+func (t *Translator) translateUpdate(op map[string]interface{}) ([]map[string]interface{}, error) {
+	o, ok := op["o"].(bson.D)
+	if !ok {
+		return []map[string]interface{}{op}, nil
+	}
+	v, _ := transform.Lookup(o, "$v")
+	version, ok := number(v)
+	switch {
+	case !ok:
+	case version == 2 && (t.diffsOnly || !t.target.AtLeast(diffUpdates)):
+		diff, _ := transform.Lookup(o, "diff")
+		updates, err := diffToModifiers(diff)
+		if err != nil {
+			return nil, fmt.Errorf("Can't translate update of %v in %v: %s", op["o2"], op["ns"], err)
+		}
+		t.count("diff updates")
+		ops := []map[string]interface{}{}
+		for i, update := range updates {
+			if i > 0 {
+				op = transform.Copy(op).(map[string]interface{})
+			}
+			op["o"] = update
+			ops = append(ops, op)
+		}
+		return ops, nil
+	case version == 1 && !t.diffsOnly && !t.target.AtLeast(versionedUpdates):
+		op["o"] = transform.Remove(o, "$v")
+		t.count("removed $v")
+	}
+	return []map[string]interface{}{op}, nil
+}
+
+// diffToModifiers turns the diff of a $v: 2 update into updates with $set, $unset and $push
+// modifiers. Shortening an array is a $push of nothing with a $slice, which can't be in the same
+// update as other changes to the array, so it's done by a second update after the first.
+func diffToModifiers(diff interface{}) ([]bson.D, error) {
+	fields, ok := diff.(bson.D)
+	if !ok {
+		return nil, fmt.Errorf("Invalid diff")
+	}
+	m := &modifiers{}
+	if err := m.addDiff(fields, ""); err != nil {
+		return nil, err
+	}
+	update := bson.D{}
+	for _, modifier := range []bson.DocElem{{Name: "$set", Value: m.set}, {Name: "$unset", Value: m.unset}} {
+		if len(modifier.Value.(bson.D)) > 0 {
+			update = append(update, modifier)
+		}
+	}
+	updates := []bson.D{}
+	if len(update) > 0 || len(m.push) == 0 {
+		updates = append(updates, update)
+	}
+	if len(m.push) > 0 {
+		updates = append(updates, bson.D{{Name: "$push", Value: m.push}})
+	}
+	return updates, nil
+}
+
+// modifiers are the fields of each modifier of an update, in the order they're in the diff. The
+// $push fields are the arrays to shorten.
+type modifiers struct {
+	set, unset, push bson.D
+}
+
+// addDiff adds the modifiers for a document diff of the field at prefix. Diffs have sections for
+// updated ("u"), inserted ("i") and deleted ("d") fields, and "s<field>" subdiffs for fields
+// that are documents or arrays.
+func (m *modifiers) addDiff(diff bson.D, prefix string) error {
+	for _, section := range diff {
+		key := section.Name
+		switch {
+		case key == "u" || key == "i" || key == "d":
+			fields, ok := section.Value.(bson.D)
+			if !ok {
+				return fmt.Errorf("Invalid diff section %q", key)
+			}
+			for _, field := range fields {
+				if key == "d" {
+					m.unset = append(m.unset, bson.DocElem{Name: prefix + field.Name, Value: true})
+				} else {
+					m.set = append(m.set, bson.DocElem{Name: prefix + field.Name, Value: field.Value})
+				}
+			}
+		case strings.HasPrefix(key, "s"):
+			if err := m.addSubDiff(section.Value, prefix+key[1:]); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unknown diff section %q", key)
+		}
+	}
+	return nil
+}
+
+// addSubDiff adds the modifiers for the subdiff of the field at path.
+func (m *modifiers) addSubDiff(value interface{}, path string) error {
+	diff, ok := value.(bson.D)
+	if !ok {
+		return fmt.Errorf("Invalid diff of %s", path)
+	}
+	if array, _ := transform.Lookup(diff, "a"); array != true {
+		return m.addDiff(diff, path+".")
+	}
+	// Array diffs have "u<index>" for updated elements, "s<index>" for element subdiffs and "l"
+	// for a new, shorter length.
+	for _, section := range diff {
+		key := section.Name
+		switch {
+		case key == "a":
+		case key == "l":
+			length, _ := number(section.Value)
+			m.push = append(m.push, bson.DocElem{Name: path, Value: bson.D{
+				{Name: "$each", Value: []interface{}{}}, {Name: "$slice", Value: length}}})
+		case strings.HasPrefix(key, "u"):
+			m.set = append(m.set, bson.DocElem{Name: path + "." + key[1:], Value: section.Value})
+		case strings.HasPrefix(key, "s"):
+			if err := m.addSubDiff(section.Value, path+"."+key[1:]); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unknown array diff section %q", key)
+		}
+	}
+	return nil
+}
+
+// indexCommand turns an insert into system.indexes into a createIndexes command.
+func indexCommand(op map[string]interface{}) bool {
+	spec, ok := op["o"].(bson.D)
+	if !ok {
+		return false
+	}
+	value, _ := transform.Lookup(spec, "ns")
+	indexNs, _ := value.(string)
+	parts := strings.SplitN(indexNs, ".", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	op["op"] = "c"
+	op["ns"] = parts[0] + ".$cmd"
+	op["o"] = bson.D{{Name: "createIndexes", Value: parts[1]}, {Name: "indexes", Value: []interface{}{transform.Remove(spec, "ns")}}}
+	return true
+}
+
+// number returns a BSON number as an int.
+func number(value interface{}) (int, bool) {
+	switch n := value.(type) {
+	case int:
+		return n, true
+	case int64:
+		return int(n), true
+	case float64:
+		return int(n), true
+	}
+	return 0, false
+}
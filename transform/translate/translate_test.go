@@ -0,0 +1,237 @@
+package translate
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+var (
+	v3_0 = Version{3, 0, 15}
+	v3_4 = Version{3, 4, 24}
+	v4_0 = Version{4, 0, 28}
+	v4_4 = Version{4, 4, 18}
+	v6_0 = Version{6, 0, 3}
+)
+
+// d builds a document from alternating names and values.
+func d(pairs ...interface{}) bson.D {
+	doc := bson.D{}
+	for i := 0; i < len(pairs); i += 2 {
+		doc = append(doc, bson.DocElem{Name: pairs[i].(string), Value: pairs[i+1]})
+	}
+	return doc
+}
+
+func TestTranslate(t *testing.T) {
+	ts := bson.MongoTimestamp(1 << 32)
+	for _, test := range []struct {
+		name     string
+		target   Version
+		op       map[string]interface{}
+		expected map[string]interface{}
+	}{
+		{
+			name:   "6.0 insert onto 6.0 keeps t and wall",
+			target: v6_0,
+			op: map[string]interface{}{"ts": ts, "t": int64(1), "op": "i", "ns": "app.users", "ui": "uuid", "wall": "now",
+				"lsid": d("id", "session"), "txnNumber": int64(1), "stmtId": 0, "prevOpTime": d("ts", ts),
+				"o": d("_id", 1)},
+			expected: map[string]interface{}{"ts": ts, "t": int64(1), "op": "i", "ns": "app.users", "wall": "now",
+				"o": d("_id", 1)},
+		},
+		{
+			name:     "3.6 insert onto 3.4 drops wall",
+			target:   v3_4,
+			op:       map[string]interface{}{"ts": ts, "t": int64(1), "op": "i", "ns": "app.users", "ui": "uuid", "wall": "now", "o": d("_id", 1)},
+			expected: map[string]interface{}{"ts": ts, "t": int64(1), "op": "i", "ns": "app.users", "o": d("_id", 1)},
+		},
+		{
+			name:     "3.6 insert onto 3.0 drops t and wall",
+			target:   v3_0,
+			op:       map[string]interface{}{"ts": ts, "t": int64(1), "op": "i", "ns": "app.users", "wall": "now", "o": d("_id", 1)},
+			expected: map[string]interface{}{"ts": ts, "op": "i", "ns": "app.users", "o": d("_id", 1)},
+		},
+		{
+			name:   "5.0 diff update onto 4.4 becomes $set and $unset",
+			target: v4_4,
+			op: map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+				"o": d("$v", 2, "diff", d(
+					"u", d("name", "Ann"),
+					"i", d("age", 30),
+					"d", d("nickname", false),
+					"sprofile", d(
+						"u", d("city", "Oslo"),
+						"saddress", d("d", d("zip", false)),
+					),
+					"stags", d("a", true, "u1", "red", "s2", d("u", d("x", 1))),
+				))},
+			expected: map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+				"o": d(
+					"$set", d("name", "Ann", "age", 30, "profile.city", "Oslo", "tags.1", "red", "tags.2.x", 1),
+					"$unset", d("nickname", true, "profile.address.zip", true),
+				)},
+		},
+		{
+			name:   "5.0 array truncation onto 4.0 becomes $push with $slice",
+			target: v4_0,
+			op: map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+				"o": d("$v", 2, "diff", d(
+					"stags", d("a", true, "l", 2),
+				))},
+			expected: map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+				"o": d(
+					"$push", d("tags", d("$each", []interface{}{}, "$slice", 2)),
+				)},
+		},
+		{
+			name:   "5.0 diff update onto 6.0 is kept",
+			target: v6_0,
+			op: map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+				"o": d("$v", 2, "diff", d("u", d("a", 1)))},
+			expected: map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+				"o": d("$v", 2, "diff", d("u", d("a", 1)))},
+		},
+		{
+			name:   "3.6 $v: 1 update onto 3.4 drops $v",
+			target: v3_4,
+			op: map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+				"o": d("$v", 1, "$set", d("a", 1))},
+			expected: map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+				"o": d("$set", d("a", 1))},
+		},
+		{
+			name:   "3.6 $v: 1 update onto 4.0 is kept",
+			target: v4_0,
+			op: map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+				"o": d("$v", 1, "$set", d("a", 1))},
+			expected: map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+				"o": d("$v", 1, "$set", d("a", 1))},
+		},
+		{
+			name:   "3.0 index build onto 4.4 becomes createIndexes",
+			target: v4_4,
+			op: map[string]interface{}{"ts": ts, "op": "i", "ns": "app.system.indexes",
+				"o": d("v", 1, "ns", "app.users", "name", "b_1_a_-1", "unique", true, "key", d("b", 1, "a", -1))},
+			expected: map[string]interface{}{"ts": ts, "op": "c", "ns": "app.$cmd",
+				"o": d("createIndexes", "users", "indexes", []interface{}{
+					d("v", 1, "name", "b_1_a_-1", "unique", true, "key", d("b", 1, "a", -1))})},
+		},
+		{
+			name:   "3.0 index build onto 4.0 is kept",
+			target: v4_0,
+			op: map[string]interface{}{"op": "i", "ns": "app.system.indexes",
+				"o": d("ns", "app.users", "name", "a_1", "key", d("a", 1))},
+			expected: map[string]interface{}{"op": "i", "ns": "app.system.indexes",
+				"o": d("ns", "app.users", "name", "a_1", "key", d("a", 1))},
+		},
+		{
+			name:   "4.0 transaction onto 3.4 translates its ops",
+			target: v3_4,
+			op: map[string]interface{}{"op": "c", "ns": "admin.$cmd", "lsid": d("id", "session"), "txnNumber": int64(1),
+				"o": d("applyOps", []interface{}{
+					d("op", "i", "ns", "app.users", "ui", "uuid", "o", d("_id", 1)),
+					map[string]interface{}{"op": "u", "ns": "app.users", "ui": "uuid", "o2": d("_id", 2),
+						"o": d("$v", 1, "$set", d("a", 1))},
+				})},
+			expected: map[string]interface{}{"op": "c", "ns": "admin.$cmd",
+				"o": d("applyOps", []interface{}{
+					d("op", "i", "ns", "app.users", "o", d("_id", 1)),
+					map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 2),
+						"o": d("$set", d("a", 1))},
+				})},
+		},
+	} {
+		out, err := New(test.target).Apply(test.op)
+		assert.Nil(t, err, test.name)
+		assert.Equal(t, []map[string]interface{}{test.expected}, out, test.name)
+	}
+}
+
+func TestUntranslatableDiff(t *testing.T) {
+	for _, diff := range []interface{}{
+		d("x", d()),
+		d("u", "not a document"),
+		d("stags", d("a", true, "q", 1)),
+		"not a document",
+	} {
+		_, err := New(v4_4).Apply(map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1),
+			"o": d("$v", 2, "diff", diff)})
+		assert.NotNil(t, err)
+	}
+}
+
+func TestArrayResize(t *testing.T) {
+	// A resize along with other changes to the array is a second update, after the first
+	update := d("$v", 2, "diff", d("u", d("name", "Ann"), "stags", d("a", true, "l", 2, "u0", "red", "s1", d("u", d("x", 1)))))
+	out, err := New(v4_4).Apply(map[string]interface{}{"op": "u", "ns": "app.users", "o2": d("_id", 1), "o": update})
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{
+		{"op": "u", "ns": "app.users", "o2": d("_id", 1), "o": d("$set", d("name", "Ann", "tags.0", "red", "tags.1.x", 1))},
+		{"op": "u", "ns": "app.users", "o2": d("_id", 1), "o": d("$push", d("tags", d("$each", []interface{}{}, "$slice", 2)))},
+	}, out)
+	out[0]["o2"].(bson.D)[0].Value = 2
+	assert.Equal(t, d("_id", 1), out[1]["o2"])
+
+	// In a transaction, both updates are applied in its place
+	out, err = New(v4_4).Apply(map[string]interface{}{"op": "c", "ns": "admin.$cmd", "o": d("applyOps", []interface{}{
+		d("op", "u", "ns", "app.users", "o2", d("_id", 1), "o", update),
+		d("op", "d", "ns", "app.users", "o", d("_id", 2)),
+	})})
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{{"op": "c", "ns": "admin.$cmd", "o": d("applyOps", []interface{}{
+		d("op", "u", "ns", "app.users", "o2", d("_id", 1), "o", d("$set", d("name", "Ann", "tags.0", "red", "tags.1.x", 1))),
+		d("op", "u", "ns", "app.users", "o2", d("_id", 1), "o", d("$push", d("tags", d("$each", []interface{}{}, "$slice", 2)))),
+		d("op", "d", "ns", "app.users", "o", d("_id", 2)),
+	})}}, out)
+}
+
+func TestDiffConverter(t *testing.T) {
+	converter := NewDiffConverter()
+	op := map[string]interface{}{"op": "u", "ns": "app.users", "ui": "uuid", "o2": d("_id", 1),
+		"o": d("$v", 2, "diff", d("u", d("a", 1)))}
+	out, err := converter.Apply(op)
+	assert.Nil(t, err)
+	assert.Equal(t, []map[string]interface{}{{"op": "u", "ns": "app.users", "ui": "uuid", "o2": d("_id", 1),
+		"o": d("$set", d("a", 1))}}, out)
+
+	// Everything else is kept
+	for _, op := range []map[string]interface{}{
+		{"op": "u", "ns": "app.users", "o2": d("_id", 1), "o": d("$v", 1, "$set", d("a", 1))},
+		{"op": "i", "ns": "app.system.indexes", "o": d("ns", "app.users", "name", "a_1", "key", d("a", 1))},
+	} {
+		out, err := converter.Apply(op)
+		assert.Nil(t, err)
+		assert.Equal(t, []map[string]interface{}{op}, out)
+	}
+	assert.Equal(t, "Converted ops: diff updates 1", converter.Report())
+}
+
+func TestReport(t *testing.T) {
+	translator := New(v3_4)
+	assert.Equal(t, "", translator.Report())
+	for i := 0; i < 2; i++ {
+		_, err := translator.Apply(map[string]interface{}{"op": "i", "ns": "app.users", "ui": "uuid", "wall": "now",
+			"o": d("_id", i)})
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, "Translated ops for MongoDB 3.4.24: removed ui 2, removed wall 2", translator.Report())
+}
+
+func TestVersion(t *testing.T) {
+	v, err := ParseVersion("4.2.1")
+	assert.Nil(t, err)
+	assert.Equal(t, Version{4, 2, 1}, v)
+	assert.Equal(t, "4.2.1", v.String())
+	assert.True(t, v.AtLeast(Version{4, 2}))
+	assert.True(t, v.AtLeast(Version{4, 2, 1}))
+	assert.False(t, v.AtLeast(Version{4, 2, 2}))
+	assert.False(t, v.AtLeast(Version{5}))
+	assert.True(t, Version{4, 2, 0, 0}.AtLeast(Version{4, 2}))
+
+	for _, version := range []string{"", "4.x", "4.-1"} {
+		_, err := ParseVersion(version)
+		assert.NotNil(t, err, version)
+	}
+}
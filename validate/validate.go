@@ -0,0 +1,265 @@
+// Package validate checks that an oplog dump is well formed before it's replayed.
+package validate
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	bsonScanner "github.com/Clever/oplog-replay/bson"
+	"labix.org/v2/mgo/bson"
+)
+
+// MaxEntrySize is the largest entry that can be replayed, the maximum size of a MongoDB document.
+const MaxEntrySize = 16 * 1024 * 1024
+
+// DefaultMaxHashes is how many h values are remembered by default, to check for duplicates across
+// the whole dump. Each takes about 40 bytes.
+const DefaultMaxHashes = 5000000
+
+// Severity is how bad a problem is.
+type Severity int
+
+const (
+	// Warning is for entries that are unusual but can be replayed.
+	Warning Severity = iota
+	// Error is for entries that will fail to replay, or won't replay correctly.
+	Error
+)
+
+func (s Severity) String() string {
+	if s == Warning {
+		return "warning"
+	}
+	return "error"
+}
+
+// ParseSeverity parses "warning" or "error".
+func ParseSeverity(name string) (Severity, error) {
+	switch name {
+	case "warning":
+		return Warning, nil
+	case "error":
+		return Error, nil
+	}
+	return 0, fmt.Errorf("Unknown severity: %s", name)
+}
+
+// Problem is something wrong with an entry in a dump.
+type Problem struct {
+	// Offset is the byte offset of the start of the entry.
+	Offset   int64
+	Severity Severity
+	// Ts is the entry's timestamp as "seconds:increment", if it has one.
+	Ts      string
+	Message string
+}
+
+func (p Problem) String() string {
+	if p.Ts == "" {
+		return fmt.Sprintf("offset %d: %s: %s", p.Offset, p.Severity, p.Message)
+	}
+	return fmt.Sprintf("offset %d (ts %s): %s: %s", p.Offset, p.Ts, p.Severity, p.Message)
+}
+
+// Result summarizes a validation.
+type Result struct {
+	Entries  int
+	Bytes    int64
+	Warnings int
+	Errors   int
+	// UntrackedHashes counts the entries whose h wasn't remembered because maxHashes had been
+	// reached, so later duplicates of them aren't caught.
+	UntrackedHashes int
+}
+
+// Worst returns the severity of the worst problem found, and false if there were none.
+func (r Result) Worst() (Severity, bool) {
+	if r.Errors > 0 {
+		return Error, true
+	}
+	return Warning, r.Warnings > 0
+}
+
+// ops are the recognized op types.
+var ops = map[string]bool{"i": true, "u": true, "d": true, "c": true, "n": true, "db": true}
+
+// validator holds the state needed to check each entry against the ones before it.
+type validator struct {
+	report func(Problem)
+	result Result
+	lastTs bson.MongoTimestamp
+	// seen maps the h and t of each entry with the current ts to its offset
+	seen map[string]int64
+	// hashes maps the h of up to maxHashes entries anywhere in the dump to their offsets
+	hashes    map[int64]int64
+	maxHashes int
+}
+
+// Validate checks every entry in r, calling report with each problem found. Duplicate h values
+// are found across the whole dump as long as no more than maxHashes entries have one. It only
+// returns an error if r can't be read. Problems that stop the rest of the dump from being read,
+// like a truncated entry, are reported as the last problem.
+func Validate(r io.Reader, maxHashes int, report func(Problem)) (Result, error) {
+	v := &validator{report: report, seen: map[string]int64{}, hashes: map[int64]int64{}, maxHashes: maxHashes}
+	in := bufio.NewReader(r)
+	header := make([]byte, 4)
+	for {
+		offset := v.result.Bytes
+		n, err := io.ReadFull(in, header)
+		if err == io.EOF {
+			return v.result, nil
+		} else if err == io.ErrUnexpectedEOF {
+			v.problem(offset, Error, "", "Truncated entry: only %d bytes left", n)
+			return v.result, nil
+		} else if err != nil {
+			return v.result, err
+		}
+
+		size := int64(int32(binary.LittleEndian.Uint32(header)))
+		if size < 5 {
+			v.problem(offset, Error, "", "Invalid entry size %d: can't find the next entry", size)
+			return v.result, nil
+		}
+		v.result.Entries++
+		if size > MaxEntrySize {
+			v.problem(offset, Error, "", "Entry is %d bytes, over the %d byte limit", size, MaxEntrySize)
+			skipped, err := io.CopyN(ioutil.Discard, in, size-4)
+			v.result.Bytes += 4 + skipped
+			if err == io.EOF {
+				v.problem(offset, Error, "", "Truncated entry: only %d of %d bytes left", 4+skipped, size)
+				return v.result, nil
+			} else if err != nil {
+				return v.result, err
+			}
+			continue
+		}
+
+		raw := make([]byte, size)
+		copy(raw, header)
+		n, err = io.ReadFull(in, raw[4:])
+		v.result.Bytes += 4 + int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			v.problem(offset, Error, "", "Truncated entry: only %d of %d bytes left", 4+n, size)
+			return v.result, nil
+		} else if err != nil {
+			return v.result, err
+		}
+		v.check(offset, raw)
+	}
+}
+
+func (v *validator) problem(offset int64, severity Severity, ts string, format string, args ...interface{}) {
+	if severity == Error {
+		v.result.Errors++
+	} else {
+		v.result.Warnings++
+	}
+	v.report(Problem{Offset: offset, Severity: severity, Ts: ts, Message: fmt.Sprintf(format, args...)})
+}
+
+// check checks a single entry.
+func (v *validator) check(offset int64, raw []byte) {
+	op := map[string]interface{}{}
+	if err := bson.Unmarshal(raw, &op); err != nil {
+		v.problem(offset, Error, "", "Entry doesn't parse: %s", err)
+		return
+	}
+
+	formattedTs := ""
+	if ts, ok := op["ts"].(bson.MongoTimestamp); ok {
+		formattedTs = bsonScanner.FormatTimestamp(ts)
+		v.checkOrder(offset, formattedTs, ts, op)
+	} else {
+		v.problem(offset, Error, "", "Missing ts")
+	}
+
+	problem := func(severity Severity, format string, args ...interface{}) {
+		v.problem(offset, severity, formattedTs, format, args...)
+	}
+	opType, _ := op["op"].(string)
+	ns, _ := op["ns"].(string)
+	if !ops[opType] {
+		problem(Error, "Unrecognized op %q", op["op"])
+		return
+	}
+	if opType == "n" || opType == "db" {
+		return
+	}
+	if opType == "c" {
+		if !strings.HasSuffix(ns, ".$cmd") {
+			problem(Error, "Command has ns %q, which isn't a database's $cmd", ns)
+		}
+	} else if !validNamespace(ns) {
+		problem(Error, "Unrecognized ns %q", op["ns"])
+	}
+
+	o, hasO := op["o"].(map[string]interface{})
+	if !hasO {
+		problem(Error, "'%s' entry is missing its 'o' document", opType)
+		return
+	}
+	switch opType {
+	case "i":
+		if _, ok := o["_id"]; !ok {
+			problem(Warning, "Insert has no _id")
+		}
+	case "u":
+		o2, ok := op["o2"].(map[string]interface{})
+		if !ok {
+			problem(Error, "Update is missing its 'o2' query")
+		} else if _, ok := o2["_id"]; !ok {
+			problem(Warning, "Update query has no _id")
+		}
+	case "d":
+		if _, ok := o["_id"]; !ok {
+			problem(Error, "Delete has no _id")
+		}
+	}
+}
+
+// checkOrder checks that ts isn't before the last entry's, and that the entry isn't a duplicate:
+// that no entry with the same ts has the same h and t, and that no earlier entry has the same h.
+func (v *validator) checkOrder(offset int64, formattedTs string, ts bson.MongoTimestamp, op map[string]interface{}) {
+	if ts < v.lastTs {
+		v.problem(offset, Error, formattedTs, "ts is before the previous entry's ts %s", bsonScanner.FormatTimestamp(v.lastTs))
+		return
+	}
+	if ts != v.lastTs {
+		v.lastTs = ts
+		v.seen = map[string]int64{}
+	}
+	key := fmt.Sprintf("%v/%v", op["h"], op["t"])
+	if seenOffset, ok := v.seen[key]; ok {
+		v.problem(offset, Error, formattedTs, "Duplicate of the entry at offset %d (same ts, h and t)", seenOffset)
+		return
+	}
+	// Entries from MongoDB 4.2 on have no h, and are told apart by their ts alone
+	if h, ok := op["h"].(int64); ok && h != 0 {
+		if seenOffset, ok := v.hashes[h]; ok {
+			v.problem(offset, Error, formattedTs, "Duplicate h %d of the entry at offset %d", h, seenOffset)
+			return
+		}
+		if len(v.hashes) < v.maxHashes {
+			v.hashes[h] = offset
+		} else {
+			v.result.UntrackedHashes++
+		}
+	}
+	if len(v.seen) > 0 {
+		v.problem(offset, Warning, formattedTs, "Shares its ts with another entry")
+	}
+	v.seen[key] = offset
+}
+
+// validNamespace returns whether ns is a "database.collection" namespace.
+func validNamespace(ns string) bool {
+	parts := strings.SplitN(ns, ".", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return false
+	}
+	return !strings.ContainsAny(parts[0], "/\\. \"$")
+}
@@ -0,0 +1,156 @@
+package validate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"labix.org/v2/mgo/bson"
+)
+
+func ts(seconds int64) bson.MongoTimestamp {
+	return bson.MongoTimestamp(seconds << 32)
+}
+
+func marshal(t *testing.T, op bson.M) []byte {
+	raw, err := bson.Marshal(op)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+func validate(t *testing.T, dump []byte) (Result, []Problem) {
+	problems := []Problem{}
+	result, err := Validate(bytes.NewReader(dump), DefaultMaxHashes, func(p Problem) {
+		problems = append(problems, p)
+	})
+	assert.Nil(t, err)
+	return result, problems
+}
+
+func TestValidDump(t *testing.T) {
+	f, err := os.Open("../bson/testdata.bson")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	problems := []Problem{}
+	result, err := Validate(f, DefaultMaxHashes, func(p Problem) { problems = append(problems, p) })
+	assert.Nil(t, err)
+	assert.Equal(t, []Problem{}, problems)
+	assert.Equal(t, 6, result.Entries)
+	_, any := result.Worst()
+	assert.False(t, any)
+}
+
+func TestProblems(t *testing.T) {
+	entries := [][]byte{
+		marshal(t, bson.M{"ts": ts(10), "h": int64(1), "op": "i", "ns": "app.users", "o": bson.M{"_id": 1}}),
+		// Duplicate
+		marshal(t, bson.M{"ts": ts(10), "h": int64(1), "op": "i", "ns": "app.users", "o": bson.M{"_id": 1}}),
+		// Same ts, different h
+		marshal(t, bson.M{"ts": ts(10), "h": int64(2), "op": "i", "ns": "app.users", "o": bson.M{"_id": 2}}),
+		// Out of order
+		marshal(t, bson.M{"ts": ts(9), "h": int64(3), "op": "i", "ns": "app.users", "o": bson.M{"_id": 3}}),
+		marshal(t, bson.M{"ts": ts(11), "h": int64(4), "op": "x", "ns": "app.users", "o": bson.M{}}),
+		marshal(t, bson.M{"ts": ts(12), "h": int64(5), "op": "i", "ns": "users", "o": bson.M{"_id": 1}}),
+		marshal(t, bson.M{"ts": ts(13), "h": int64(6), "op": "u", "ns": "app.users", "o": bson.M{"$set": bson.M{"a": 1}}}),
+		marshal(t, bson.M{"ts": ts(14), "h": int64(7), "op": "d", "ns": "app.users", "o": bson.M{}}),
+		marshal(t, bson.M{"ts": ts(15), "h": int64(8), "op": "c", "ns": "app.users", "o": bson.M{"drop": "users"}}),
+		marshal(t, bson.M{"h": int64(9), "op": "n", "ns": ""}),
+	}
+	var dump []byte
+	offsets := []int64{}
+	for _, entry := range entries {
+		offsets = append(offsets, int64(len(dump)))
+		dump = append(dump, entry...)
+	}
+	result, problems := validate(t, dump)
+
+	assert.Equal(t, len(entries), result.Entries)
+	assert.Equal(t, int64(len(dump)), result.Bytes)
+	expected := []struct {
+		entry    int
+		severity Severity
+	}{{1, Error}, {2, Warning}, {3, Error}, {4, Error}, {5, Error}, {6, Error}, {7, Error}, {8, Error}, {9, Error}}
+	if assert.Equal(t, len(expected), len(problems), "%v", problems) {
+		for i, e := range expected {
+			assert.Equal(t, offsets[e.entry], problems[i].Offset, problems[i].String())
+			assert.Equal(t, e.severity, problems[i].Severity, problems[i].String())
+		}
+	}
+	assert.Equal(t, Result{Entries: 10, Bytes: int64(len(dump)), Warnings: 1, Errors: 8}, result)
+	worst, _ := result.Worst()
+	assert.Equal(t, Error, worst)
+}
+
+func TestDuplicateHashes(t *testing.T) {
+	entries := [][]byte{
+		marshal(t, bson.M{"ts": ts(10), "h": int64(1), "op": "n", "ns": ""}),
+		marshal(t, bson.M{"ts": ts(11), "h": int64(2), "op": "n", "ns": ""}),
+		// The same h as the first entry, with a later ts
+		marshal(t, bson.M{"ts": ts(12), "h": int64(1), "op": "n", "ns": ""}),
+		// Without h, as from MongoDB 4.2 on
+		marshal(t, bson.M{"ts": ts(13), "op": "n", "ns": ""}),
+		marshal(t, bson.M{"ts": ts(14), "op": "n", "ns": ""}),
+	}
+	var dump []byte
+	for _, entry := range entries {
+		dump = append(dump, entry...)
+	}
+	result, problems := validate(t, dump)
+	if assert.Equal(t, 1, len(problems), "%v", problems) {
+		assert.Equal(t, int64(2*len(entries[0])), problems[0].Offset)
+		assert.Contains(t, problems[0].Message, "Duplicate h 1 of the entry at offset 0")
+	}
+	assert.Equal(t, 0, result.UntrackedHashes)
+
+	// Past the limit, h values are still checked against the ones remembered, but not added
+	problems = []Problem{}
+	result, err := Validate(bytes.NewReader(dump), 1, func(p Problem) { problems = append(problems, p) })
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(problems))
+	assert.Equal(t, 1, result.UntrackedHashes)
+}
+
+func TestUnparseableAndTruncated(t *testing.T) {
+	valid := marshal(t, bson.M{"ts": ts(10), "op": "n", "ns": ""})
+	// A document whose only element has an unknown type
+	bad := []byte{12, 0, 0, 0, 0x42, 'a', 0, 1, 0, 0, 0, 0}
+	dump := append(append(append([]byte{}, valid...), bad...), valid[:len(valid)-2]...)
+	result, problems := validate(t, dump)
+	assert.Equal(t, 3, result.Entries)
+	assert.Equal(t, 2, len(problems))
+	assert.Equal(t, int64(len(valid)), problems[0].Offset)
+	assert.Equal(t, int64(len(valid)+len(bad)), problems[1].Offset)
+	assert.Contains(t, problems[1].Message, "Truncated")
+}
+
+func TestOversizedEntry(t *testing.T) {
+	header := make([]byte, 4)
+	binary.LittleEndian.PutUint32(header, MaxEntrySize+1)
+	dump := append(header, make([]byte, MaxEntrySize-3)...)
+	dump = append(dump, marshal(t, bson.M{"ts": ts(10), "op": "n", "ns": ""})...)
+	result, problems := validate(t, dump)
+	// The entry after the oversized one is still checked
+	assert.Equal(t, 2, result.Entries)
+	assert.Equal(t, int64(len(dump)), result.Bytes)
+	assert.Equal(t, 1, len(problems))
+	assert.Equal(t, int64(0), problems[0].Offset)
+}
+
+func TestInvalidSize(t *testing.T) {
+	_, problems := validate(t, []byte{0, 0, 0, 0, 1, 2, 3})
+	assert.Equal(t, 1, len(problems))
+	assert.Contains(t, problems[0].Message, "Invalid entry size")
+}
+
+func TestProblemString(t *testing.T) {
+	p := Problem{Offset: 120, Severity: Warning, Ts: "10:1", Message: "Insert has no _id"}
+	assert.Equal(t, "offset 120 (ts 10:1): warning: Insert has no _id", p.String())
+	p.Ts = ""
+	assert.Equal(t, "offset 120: warning: Insert has no _id", p.String())
+}